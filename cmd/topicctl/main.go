@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jursonmo/practise_new/pkg/topicservice"
+)
+
+// topicctl 通过topicservice 的管理接口(ServiceConfig.Admin.Addr)查看集群状态:
+//
+//	topicctl -addr 127.0.0.1:9100 status
+//	topicctl -addr 127.0.0.1:9100 topics
+//	topicctl -addr 127.0.0.1:9100 rebalance
+//	topicctl -addr 127.0.0.1:9100 pin topic1 topic_service-1
+//	topicctl -addr 127.0.0.1:9100 unpin topic1
+//
+// 修改的命令发给不是leader 的服务时, 自动转给leader
+var (
+	addr    string
+	timeout time.Duration
+	rawJSON bool
+)
+
+func init() {
+	flag.StringVar(&addr, "addr", "127.0.0.1:9100", "the admin addr of any topicservice")
+	flag.DurationVar(&timeout, "timeout", 5*time.Second, "request timeout")
+	flag.BoolVar(&rawJSON, "json", false, "print the raw json response")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: topicctl [flags] status|services|leader|topics|members|subscriptions|rebalance|pin <topic> <service>...|unpin <topic>\n")
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	client := &http.Client{Timeout: timeout}
+	var err error
+	switch cmd := args[0]; cmd {
+	case "status":
+		err = status(client)
+	case "services", "leader", "topics", "members", "subscriptions":
+		err = get(client, cmd)
+	case "rebalance":
+		err = post(client, addr, "rebalance", nil)
+	case "pin", "unpin":
+		if len(args) < 2 || (cmd == "pin" && len(args) < 3) {
+			flag.Usage()
+			os.Exit(2)
+		}
+		req := topicservice.PinRequest{Topic: args[1]}
+		if cmd == "pin" {
+			req.Services = args[2:]
+		}
+		err = post(client, addr, "pin", req)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func request(client *http.Client, method, addr, path string, body interface{}) (int, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, "http://"+addr+"/admin/"+path, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+func printJSON(data []byte) error {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, bytes.TrimSpace(data), "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(buf.String())
+	return nil
+}
+
+func responseError(code int, data []byte) error {
+	var e struct{ Error string }
+	if json.Unmarshal(data, &e) == nil && e.Error != "" {
+		return fmt.Errorf("%d: %s", code, e.Error)
+	}
+	return fmt.Errorf("%d: %s", code, strings.TrimSpace(string(data)))
+}
+
+func get(client *http.Client, path string) error {
+	code, data, err := request(client, http.MethodGet, addr, path, nil)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return responseError(code, data)
+	}
+	return printJSON(data)
+}
+
+// leader 的管理地址没有配置host 时(比如:9100), 用-addr 的host
+func leaderAddr(from, leader string) string {
+	host, port, err := net.SplitHostPort(leader)
+	if err != nil || host != "" {
+		return leader
+	}
+	fromHost, _, err := net.SplitHostPort(from)
+	if err != nil {
+		return leader
+	}
+	return net.JoinHostPort(fromHost, port)
+}
+
+// 最多转发几次, 防止两个服务互相认为对方是leader 时一直转下去
+const maxRedirects = 3
+
+func post(client *http.Client, addr, path string, body interface{}) error {
+	visited := map[string]bool{}
+	for {
+		visited[addr] = true
+		code, data, err := request(client, http.MethodPost, addr, path, body)
+		if err != nil {
+			return err
+		}
+		if code == http.StatusConflict {
+			var e struct{ LeaderAdmin string }
+			if json.Unmarshal(data, &e) == nil && e.LeaderAdmin != "" {
+				leader := leaderAddr(addr, e.LeaderAdmin)
+				if visited[leader] {
+					return fmt.Errorf("%s is not leader, leader %s already tried, leader may be changing, retry later", addr, leader)
+				}
+				if len(visited) > maxRedirects {
+					return fmt.Errorf("%s is not leader, too many redirects(%d), retry later", addr, maxRedirects)
+				}
+				fmt.Fprintf(os.Stderr, "%s is not leader, send to leader %s\n", addr, leader)
+				addr = leader
+				continue
+			}
+		}
+		if code != http.StatusOK {
+			return responseError(code, data)
+		}
+		return printJSON(data)
+	}
+}
+
+func status(client *http.Client) error {
+	code, data, err := request(client, http.MethodGet, addr, "status", nil)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return responseError(code, data)
+	}
+	if rawJSON {
+		return printJSON(data)
+	}
+	var st topicservice.AdminStatus
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+	fmt.Printf("self:      %s (leader:%v, discovery:%s)\n", st.Self, st.IsLeader, st.Discovery)
+	fmt.Printf("leader:    %s %s\n", st.Leader, st.LeaderAdmin)
+	fmt.Printf("services:  %d\n", len(st.Services))
+	for _, v := range st.Services {
+		fmt.Printf("  %s endpoints:%v weight:%d priority:%d\n", v.String(), v.Endpoints, v.Weight, v.Priority)
+	}
+	fmt.Printf("topics:    %d (default balancer:%s)\n", len(st.Topics), st.DefaultBalancer)
+	if st.RingFingerprint != "" {
+		fmt.Printf("ring:      %s\n", st.RingFingerprint)
+	}
+	for _, topic := range sortedTopics(st.Topics) {
+		line := fmt.Sprintf("  %s -> %s", topic, strings.Join(st.Topics[topic], ","))
+		if balancer := st.Balancers[topic]; balancer != "" {
+			line += " @" + balancer
+		}
+		fmt.Println(line)
+	}
+	if len(st.Members) > 0 {
+		fmt.Printf("members:   %d\n", len(st.Members))
+		for _, v := range st.Members {
+			fmt.Printf("  %s\n", v)
+		}
+	}
+	if len(st.Subscriptions) > 0 {
+		fmt.Printf("subscriptions:\n")
+		for _, topic := range sortedTopics(st.Subscriptions) {
+			fmt.Printf("  %s -> %s\n", topic, strings.Join(st.Subscriptions[topic], ","))
+		}
+	}
+	if st.Rebalance != nil {
+		fmt.Printf("rebalance: step:%d moved:%d pending:%d draining:%d\n",
+			st.Rebalance.Step, st.Rebalance.Moved, len(st.Rebalance.Pending), len(st.Rebalance.Draining))
+	}
+	return nil
+}
+
+func sortedTopics(m map[string][]string) []string {
+	topics := make([]string, 0, len(m))
+	for topic := range m {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
@@ -0,0 +1,135 @@
+package hash
+
+import (
+	"fmt"
+	"math"
+)
+
+// DefaultLoadFactor is the default capacity factor of bounded loads,
+// a node holds at most 1.25 times of the average load.
+const DefaultLoadFactor = 1.25
+
+// SetLoadFactor sets the capacity factor used by GetBounded, factor must be larger than 1.
+func (h *ConsistentHash) SetLoadFactor(factor float64) error {
+	if factor <= 1 {
+		return fmt.Errorf("load factor must be larger than 1, got %v", factor)
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.loadFactor = factor
+	return nil
+}
+
+// GetBounded returns the corresponding node from h base on the given v like Get,
+// but skips the nodes whose load reached MaxLoad (consistent hashing with bounded loads),
+// and counts v on the returned node.
+// The later calls with the same v return the same node until Release(v) or the node is removed.
+func (h *ConsistentHash) GetBounded(v any) (any, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	state := h.state.Load()
+	if len(state.keys) == 0 {
+		return nil, false
+	}
+
+	key := repr(v)
+	if node, ok := h.keyNodes[key]; ok {
+		return node, true
+	}
+
+	maxLoad := h.maxLoad()
+	var found any
+	h.walk(state, v, func(node any) bool {
+		if h.loads[repr(node)] < maxLoad {
+			found = node
+			return false
+		}
+		return true
+	})
+	// the nodes on the ring can hold maxLoad*ringNodes > len(h.keyNodes) keys, so one of them is not full,
+	// nodes without points (zero weight) are never walked and not counted in maxLoad.
+	if found == nil {
+		return nil, false
+	}
+
+	h.loads[repr(found)]++
+	h.keyNodes[key] = found
+	return found, true
+}
+
+// Release releases v counted by GetBounded.
+func (h *ConsistentHash) Release(v any) {
+	key := repr(v)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	node, ok := h.keyNodes[key]
+	if !ok {
+		return
+	}
+	delete(h.keyNodes, key)
+	nodeRepr := repr(node)
+	if h.loads[nodeRepr] <= 1 {
+		delete(h.loads, nodeRepr)
+	} else {
+		h.loads[nodeRepr]--
+	}
+}
+
+// Loads returns the number of keys counted on each node by GetBounded.
+func (h *ConsistentHash) Loads() map[string]int {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	loads := make(map[string]int, len(h.nodes))
+	for nodeRepr := range h.nodes {
+		loads[nodeRepr] = h.loads[nodeRepr]
+	}
+	return loads
+}
+
+// MaxLoad returns the max number of keys a node can hold when GetBounded counts the next key.
+func (h *ConsistentHash) MaxLoad() int {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return h.maxLoad()
+}
+
+func (h *ConsistentHash) maxLoad() int {
+	// only the nodes with points hold keys, the zero weight nodes don't share the load
+	var ringNodes int
+	for _, replicas := range h.nodes {
+		if replicas > 0 {
+			ringNodes++
+		}
+	}
+	if ringNodes == 0 {
+		return 0
+	}
+
+	factor := h.loadFactor
+	if factor == 0 {
+		factor = DefaultLoadFactor
+	}
+	avg := float64(len(h.keyNodes)+1) / float64(ringNodes)
+	return int(math.Ceil(avg * factor))
+}
+
+// releaseNode releases all keys counted on the node, they are counted again on other nodes
+// by the next GetBounded.
+func (h *ConsistentHash) releaseNode(nodeRepr string) {
+	if _, ok := h.loads[nodeRepr]; !ok {
+		return
+	}
+
+	delete(h.loads, nodeRepr)
+	for key, node := range h.keyNodes {
+		if repr(node) == nodeRepr {
+			delete(h.keyNodes, key)
+		}
+	}
+}
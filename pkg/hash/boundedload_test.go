@@ -0,0 +1,111 @@
+package hash
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func BenchmarkConsistentHashGetBounded(b *testing.B) {
+	ch := NewConsistentHash()
+	for i := 0; i < keySize; i++ {
+		ch.Add("localhost:" + strconv.Itoa(i))
+	}
+
+	for i := 0; i < b.N; i++ {
+		ch.GetBounded(i)
+		ch.Release(i)
+	}
+}
+
+func TestConsistentHashGetBounded(t *testing.T) {
+	ch := NewConsistentHash()
+	val, ok := ch.GetBounded("any")
+	assert.False(t, ok)
+	assert.Nil(t, val)
+	assert.NotNil(t, ch.SetLoadFactor(1))
+
+	const nodes = 5
+	for i := 0; i < nodes; i++ {
+		ch.Add("localhost:" + strconv.Itoa(i))
+	}
+	keys := make(map[int]any, requestSize)
+	for i := 0; i < requestSize; i++ {
+		key, ok := ch.GetBounded(i)
+		assert.True(t, ok)
+		keys[i] = key
+	}
+
+	// 每个节点都不超过平均值的1.25 倍
+	maxLoad := requestSize * 5 / 4 / nodes
+	total := 0
+	for node, load := range ch.Loads() {
+		assert.True(t, load <= maxLoad, "%s: %d", node, load)
+		total += load
+	}
+	assert.Equal(t, requestSize, total)
+
+	// 同一个key 返回同一个节点, 不重复计数
+	for i := 0; i < requestSize; i++ {
+		key, _ := ch.GetBounded(i)
+		assert.Equal(t, keys[i], key)
+	}
+	load := ch.Loads()[keys[0].(string)]
+	ch.Release(0)
+	ch.Release(0)
+	assert.Equal(t, load-1, ch.Loads()[keys[0].(string)])
+
+	// 重新Add 不影响计数, Remove 后它的key 分配到其他节点
+	ch.Add("localhost:0")
+	loads := ch.Loads()
+	assert.Equal(t, requestSize-1, sumLoads(loads))
+	ch.Remove("localhost:0")
+	assert.Equal(t, requestSize-1-loads["localhost:0"], sumLoads(ch.Loads()))
+	for i := 1; i < requestSize; i++ {
+		key, ok := ch.GetBounded(i)
+		assert.True(t, ok)
+		assert.NotEqual(t, "localhost:0", key)
+		if keys[i] != "localhost:0" {
+			assert.Equal(t, keys[i], key)
+		}
+	}
+	assert.Equal(t, requestSize-1, sumLoads(ch.Loads()))
+}
+
+func TestConsistentHashLoadFactor(t *testing.T) {
+	ch := NewConsistentHash()
+	assert.Nil(t, ch.SetLoadFactor(2))
+	ch.Add("first")
+	ch.Add("second")
+	assert.Equal(t, 1, ch.MaxLoad())
+	for i := 0; i < 100; i++ {
+		ch.GetBounded(i)
+	}
+	assert.Equal(t, 101, ch.MaxLoad())
+}
+
+func TestConsistentHashGetBoundedZeroWeight(t *testing.T) {
+	ch := NewConsistentHash()
+	ch.AddWithWeight("first", 2)
+	ch.AddWithWeight("second", 0)
+	assert.Nil(t, ch.SetLoadFactor(1.1))
+
+	// second 没有虚拟节点, 不分担负载, 所有的key 都在first 上
+	for i := 0; i < requestSize; i++ {
+		node, ok := ch.GetBounded(i)
+		assert.True(t, ok)
+		assert.Equal(t, "first", node)
+	}
+	assert.Equal(t, map[string]int{"first": requestSize, "second": 0}, ch.Loads())
+	assert.Equal(t, int(math.Ceil(float64(requestSize+1)*1.1)), ch.MaxLoad())
+}
+
+func sumLoads(loads map[string]int) int {
+	var total int
+	for _, load := range loads {
+		total += load
+	}
+	return total
+}
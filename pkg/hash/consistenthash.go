@@ -2,9 +2,9 @@ package hash
 
 import (
 	"fmt"
-	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"github.com/jursonmo/practise_new/pkg/lang"
 )
@@ -22,37 +22,65 @@ type (
 	Func func(data []byte) uint64
 
 	// A ConsistentHash is a ring hash implementation.
+	// The ring is immutable, writers build a new one and swap it atomically,
+	// so Get never blocks and never sees an intermediate state.
 	ConsistentHash struct {
 		hashFunc Func
+		hashName string // name of hashFunc, empty if it's not named, see Export
 		replicas int
-		keys     []uint64
-		ring     map[uint64][]any
-		nodes    map[string]lang.PlaceholderType
+		state    atomic.Pointer[ringState]
+		nodes    map[string]int // node repr -> replicas
 		lock     sync.RWMutex
+
+		// bounded loads, see GetBounded
+		loadFactor float64
+		loads      map[string]int // node repr -> number of keys
+		keyNodes   map[string]any // key repr -> node
 	}
 )
 
 // NewConsistentHash returns a ConsistentHash.
 func NewConsistentHash() *ConsistentHash {
-	return NewCustomConsistentHash(minReplicas, Hash)
+	return newConsistentHash(minReplicas, Hash, Murmur3)
 }
 
 // NewCustomConsistentHash returns a ConsistentHash with given replicas and hash func.
+// The hash func is not named, so the ConsistentHash can't be exported unless fn is nil (Murmur3),
+// use NewNamedConsistentHash for the exportable one.
 func NewCustomConsistentHash(replicas int, fn Func) *ConsistentHash {
-	if replicas < minReplicas {
-		replicas = minReplicas
+	if fn == nil {
+		return newConsistentHash(replicas, Hash, Murmur3)
 	}
 
-	if fn == nil {
-		fn = Hash
+	return newConsistentHash(replicas, fn, "")
+}
+
+// NewNamedConsistentHash returns a ConsistentHash with given replicas and the hash func registered with name,
+// see RegisterFunc.
+func NewNamedConsistentHash(replicas int, name string) (*ConsistentHash, error) {
+	fn, ok := funcByName(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown hash func:%q", name)
+	}
+
+	return newConsistentHash(replicas, fn, name), nil
+}
+
+func newConsistentHash(replicas int, fn Func, name string) *ConsistentHash {
+	if replicas < minReplicas {
+		replicas = minReplicas
 	}
 
-	return &ConsistentHash{
+	h := &ConsistentHash{
 		hashFunc: fn,
+		hashName: name,
 		replicas: replicas,
-		ring:     make(map[uint64][]any),
-		nodes:    make(map[string]lang.PlaceholderType),
+		nodes:    make(map[string]int),
+		loads:    make(map[string]int),
+		keyNodes: make(map[string]any),
 	}
+	h.state.Store(&ringState{})
+	return h
 }
 
 // Add adds the node with the number of h.replicas,
@@ -63,10 +91,9 @@ func (h *ConsistentHash) Add(node any) {
 
 // AddWithReplicas adds the node with the number of replicas,
 // replicas will be truncated to h.replicas if it's larger than h.replicas,
-// the later call will overwrite the replicas of the former calls.
+// the later call will overwrite the replicas of the former calls,
+// the bounded loads of the node are kept.
 func (h *ConsistentHash) AddWithReplicas(node any, replicas int) {
-	h.Remove(node)
-
 	if replicas > h.replicas {
 		replicas = h.replicas
 	}
@@ -74,17 +101,15 @@ func (h *ConsistentHash) AddWithReplicas(node any, replicas int) {
 	nodeRepr := repr(node)
 	h.lock.Lock()
 	defer h.lock.Unlock()
-	h.addNode(nodeRepr)
 
-	for i := 0; i < replicas; i++ {
-		hash := h.hashFunc([]byte(nodeRepr + strconv.Itoa(i)))
-		h.keys = append(h.keys, hash)
-		h.ring[hash] = append(h.ring[hash], node)
+	state := h.state.Load()
+	if h.containsNode(nodeRepr) {
+		state = state.without(h.points(nodeRepr, h.replicas), nodeRepr)
 	}
-
-	sort.Slice(h.keys, func(i, j int) bool {
-		return h.keys[i] < h.keys[j]
-	})
+	h.addNode(nodeRepr, replicas)
+	state = state.with(h.points(nodeRepr, replicas), node)
+	state.nodes = len(h.nodes)
+	h.state.Store(state)
 }
 
 // AddWithWeight adds the node with weight, the weight can be 1 to 100, indicates the percent,
@@ -98,19 +123,13 @@ func (h *ConsistentHash) AddWithWeight(node any, weight int) {
 
 // Get returns the corresponding node from h base on the given v.
 func (h *ConsistentHash) Get(v any) (any, bool) {
-	h.lock.RLock()
-	defer h.lock.RUnlock()
-
-	if len(h.ring) == 0 {
+	state := h.state.Load()
+	if len(state.keys) == 0 {
 		return nil, false
 	}
 
 	hash := h.hashFunc([]byte(repr(v)))
-	index := sort.Search(len(h.keys), func(i int) bool {
-		return h.keys[i] >= hash
-	}) % len(h.keys)
-
-	nodes := h.ring[h.keys[index]]
+	nodes := state.owners[state.search(hash)]
 	switch len(nodes) {
 	case 0:
 		return nil, false
@@ -123,7 +142,7 @@ func (h *ConsistentHash) Get(v any) (any, bool) {
 	}
 }
 
-// Remove removes the given node from h.
+// Remove removes the given node from h, the keys counted on it by GetBounded are released.
 func (h *ConsistentHash) Remove(node any) {
 	nodeRepr := repr(node)
 
@@ -134,38 +153,24 @@ func (h *ConsistentHash) Remove(node any) {
 		return
 	}
 
-	for i := 0; i < h.replicas; i++ {
-		hash := h.hashFunc([]byte(nodeRepr + strconv.Itoa(i)))
-		index := sort.Search(len(h.keys), func(i int) bool {
-			return h.keys[i] >= hash
-		})
-		if index < len(h.keys) && h.keys[index] == hash {
-			h.keys = append(h.keys[:index], h.keys[index+1:]...)
-		}
-		h.removeRingNode(hash, nodeRepr)
-	}
-
+	state := h.state.Load().without(h.points(nodeRepr, h.replicas), nodeRepr)
 	h.removeNode(nodeRepr)
+	state.nodes = len(h.nodes)
+	h.state.Store(state)
+	h.releaseNode(nodeRepr)
 }
 
-func (h *ConsistentHash) removeRingNode(hash uint64, nodeRepr string) {
-	if nodes, ok := h.ring[hash]; ok {
-		newNodes := nodes[:0]
-		for _, x := range nodes {
-			if repr(x) != nodeRepr {
-				newNodes = append(newNodes, x)
-			}
-		}
-		if len(newNodes) > 0 {
-			h.ring[hash] = newNodes
-		} else {
-			delete(h.ring, hash)
-		}
+// points returns the hashes of the first n virtual nodes of the node.
+func (h *ConsistentHash) points(nodeRepr string, n int) []uint64 {
+	hashes := make([]uint64, 0, n)
+	for i := 0; i < n; i++ {
+		hashes = append(hashes, h.hashFunc([]byte(nodeRepr+strconv.Itoa(i))))
 	}
+	return hashes
 }
 
-func (h *ConsistentHash) addNode(nodeRepr string) {
-	h.nodes[nodeRepr] = lang.Placeholder
+func (h *ConsistentHash) addNode(nodeRepr string, replicas int) {
+	h.nodes[nodeRepr] = replicas
 }
 
 func (h *ConsistentHash) Nodes() []string {
@@ -0,0 +1,221 @@
+package hash
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// 导出/导入一致性hash 环, 不同进程用同样的节点, 副本数和hash 函数建的环是一样的,
+// 比较Fingerprint 就能知道两个节点看到的环是否一致, leader 也可以把分配用的环原样发布出去。
+
+// Murmur3 is the name of Hash, the default hash func.
+const Murmur3 = "murmur3"
+
+const ringMagic = "CHR1"
+
+var (
+	funcsLock sync.RWMutex
+	funcs     = map[string]Func{Murmur3: Hash}
+)
+
+type (
+	// A Ring is the serializable state of a ConsistentHash,
+	// the ConsistentHash imported from it has the same ring as the exported one.
+	Ring struct {
+		Hash     string     `json:"hash"`     // name of the hash func, see RegisterFunc
+		Replicas int        `json:"replicas"` // max replicas of a node
+		Nodes    []RingNode `json:"nodes"`    // sorted by Name
+	}
+
+	// A RingNode is a node of a Ring.
+	RingNode struct {
+		Name     string `json:"name"` // string representation of the node
+		Replicas int    `json:"replicas"`
+	}
+)
+
+// RegisterFunc registers the hash func with name, the ConsistentHash created by NewNamedConsistentHash
+// with the name can be exported and imported.
+func RegisterFunc(name string, fn Func) {
+	funcsLock.Lock()
+	defer funcsLock.Unlock()
+	funcs[name] = fn
+}
+
+func funcByName(name string) (Func, bool) {
+	funcsLock.RLock()
+	defer funcsLock.RUnlock()
+	fn, ok := funcs[name]
+	return fn, ok
+}
+
+// Export returns the state of h, h must be created with a named hash func,
+// by NewConsistentHash or NewNamedConsistentHash.
+func (h *ConsistentHash) Export() (Ring, error) {
+	if h.hashName == "" {
+		return Ring{}, errors.New("hash func is not named, use NewNamedConsistentHash")
+	}
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	ring := Ring{
+		Hash:     h.hashName,
+		Replicas: h.replicas,
+		Nodes:    make([]RingNode, 0, len(h.nodes)),
+	}
+	for nodeRepr, replicas := range h.nodes {
+		ring.Nodes = append(ring.Nodes, RingNode{Name: nodeRepr, Replicas: replicas})
+	}
+	sort.Slice(ring.Nodes, func(i, j int) bool {
+		return ring.Nodes[i].Name < ring.Nodes[j].Name
+	})
+	return ring, nil
+}
+
+// Fingerprint returns the fingerprint of the ring of h, see Ring.Fingerprint.
+func (h *ConsistentHash) Fingerprint() (string, error) {
+	ring, err := h.Export()
+	if err != nil {
+		return "", err
+	}
+	return ring.Fingerprint(), nil
+}
+
+// NewConsistentHashFromRing returns a ConsistentHash with the same ring as the exported one,
+// the nodes are the names (strings) of the exported nodes.
+func NewConsistentHashFromRing(ring Ring) (*ConsistentHash, error) {
+	if err := ring.validate(); err != nil {
+		return nil, err
+	}
+
+	h, err := NewNamedConsistentHash(ring.Replicas, ring.Hash)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]any, 0, len(ring.Nodes))
+	replicas := make([]int, 0, len(ring.Nodes))
+	for _, node := range ring.Nodes {
+		nodes = append(nodes, node.Name)
+		replicas = append(replicas, node.Replicas)
+	}
+	h.rebuild(nodes, replicas)
+	return h, nil
+}
+
+func (r Ring) validate() error {
+	if _, ok := funcByName(r.Hash); !ok {
+		return fmt.Errorf("unknown hash func:%q", r.Hash)
+	}
+	if r.Replicas < minReplicas {
+		return fmt.Errorf("invalid replicas:%d", r.Replicas)
+	}
+	for i, node := range r.Nodes {
+		if i > 0 && r.Nodes[i-1].Name >= node.Name {
+			return fmt.Errorf("nodes are not sorted or duplicated:%q", node.Name)
+		}
+		if node.Replicas < 0 || node.Replicas > r.Replicas {
+			return fmt.Errorf("invalid replicas:%d of node:%q", node.Replicas, node.Name)
+		}
+	}
+	return nil
+}
+
+// Fingerprint returns the hex sha256 of the binary form of r,
+// the rings with the same fingerprint map every key to the same node.
+func (r Ring) Fingerprint() string {
+	data, _ := r.MarshalBinary()
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// MarshalBinary encodes r to the stable binary form:
+// magic, hash, replicas, number of nodes, then name and replicas of each node, lengths and numbers are uvarint.
+func (r Ring) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(ringMagic)
+	writeString(&buf, r.Hash)
+	writeUvarint(&buf, uint64(r.Replicas))
+	writeUvarint(&buf, uint64(len(r.Nodes)))
+	for _, node := range r.Nodes {
+		writeString(&buf, node.Name)
+		writeUvarint(&buf, uint64(node.Replicas))
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes r from the binary form of MarshalBinary.
+func (r *Ring) UnmarshalBinary(data []byte) error {
+	buf := bytes.NewReader(data)
+	magic := make([]byte, len(ringMagic))
+	if _, err := io.ReadFull(buf, magic); err != nil || string(magic) != ringMagic {
+		return errors.New("invalid ring data")
+	}
+
+	var ring Ring
+	var err error
+	if ring.Hash, err = readString(buf); err != nil {
+		return err
+	}
+	replicas, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return err
+	}
+	ring.Replicas = int(replicas)
+	n, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return err
+	}
+	if n > uint64(buf.Len()) {
+		return errors.New("invalid ring data")
+	}
+	ring.Nodes = make([]RingNode, 0, n)
+	for i := uint64(0); i < n; i++ {
+		var node RingNode
+		if node.Name, err = readString(buf); err != nil {
+			return err
+		}
+		if replicas, err = binary.ReadUvarint(buf); err != nil {
+			return err
+		}
+		node.Replicas = int(replicas)
+		ring.Nodes = append(ring.Nodes, node)
+	}
+	if buf.Len() > 0 {
+		return errors.New("invalid ring data")
+	}
+
+	*r = ring
+	return nil
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func readString(buf *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(buf.Len()) {
+		return "", errors.New("invalid ring data")
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(buf, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,116 @@
+package hash
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsistentHashExport(t *testing.T) {
+	ch := NewConsistentHash()
+	for i := 0; i < keySize; i++ {
+		ch.AddWithWeight("localhost:"+strconv.Itoa(i), 50+i)
+	}
+	ring, err := ch.Export()
+	assert.Nil(t, err)
+	assert.Equal(t, Murmur3, ring.Hash)
+	assert.Equal(t, minReplicas, ring.Replicas)
+	assert.Len(t, ring.Nodes, keySize)
+	assert.Equal(t, RingNode{Name: "localhost:0", Replicas: 50}, ring.Nodes[0])
+
+	// 导入后的环和原来的一样
+	imported, err := NewConsistentHashFromRing(ring)
+	assert.Nil(t, err)
+	assert.Empty(t, Diff(ch, imported))
+	for i := 0; i < requestSize; i++ {
+		expect, _ := ch.Get(i)
+		actual, _ := imported.Get(i)
+		assert.Equal(t, expect, actual)
+	}
+
+	fingerprint, err := ch.Fingerprint()
+	assert.Nil(t, err)
+	assert.Equal(t, ring.Fingerprint(), fingerprint)
+	fingerprint2, _ := imported.Fingerprint()
+	assert.Equal(t, fingerprint, fingerprint2)
+
+	// json 和二进制都能还原
+	data, err := json.Marshal(ring)
+	assert.Nil(t, err)
+	var fromJSON Ring
+	assert.Nil(t, json.Unmarshal(data, &fromJSON))
+	assert.Equal(t, ring, fromJSON)
+	data, err = ring.MarshalBinary()
+	assert.Nil(t, err)
+	var fromBinary Ring
+	assert.Nil(t, fromBinary.UnmarshalBinary(data))
+	assert.Equal(t, ring, fromBinary)
+	assert.NotNil(t, fromBinary.UnmarshalBinary(data[:len(data)-1]))
+	assert.NotNil(t, fromBinary.UnmarshalBinary(append(data, 0)))
+	assert.NotNil(t, fromBinary.UnmarshalBinary([]byte("CHR")))
+
+	// 权重变化后指纹不同
+	imported.AddWithWeight("localhost:0", 60)
+	fingerprint2, _ = imported.Fingerprint()
+	assert.NotEqual(t, fingerprint, fingerprint2)
+}
+
+func TestConsistentHashFingerprintOrder(t *testing.T) {
+	// 加入的顺序不同, hash 冲突的点上节点的顺序也一样, 环和指纹都一样
+	nodes := []string{"localhost:1", "localhost:12", "localhost:120", "localhost:2"}
+	ch1 := NewConsistentHash()
+	ch2 := NewConsistentHash()
+	ch3 := NewConsistentHash()
+	rebuild := make([]any, 0, len(nodes))
+	for i := range nodes {
+		ch1.Add(nodes[i])
+		ch2.Add(nodes[len(nodes)-1-i])
+		rebuild = append(rebuild, nodes[len(nodes)-1-i])
+	}
+	ch3.Rebuild(rebuild, nil)
+	for _, ch := range []*ConsistentHash{ch2, ch3} {
+		assert.Equal(t, ch1.state.Load().owners, ch.state.Load().owners)
+		assert.Empty(t, Diff(ch1, ch))
+		f1, _ := ch1.Fingerprint()
+		f2, _ := ch.Fingerprint()
+		assert.Equal(t, f1, f2)
+	}
+}
+
+func TestConsistentHashExportFunc(t *testing.T) {
+	fn := func(data []byte) uint64 {
+		h := fnv.New64a()
+		h.Write(data)
+		return h.Sum64()
+	}
+	// 没有名字的hash 函数, 即使注册过也不能导出
+	RegisterFunc("fnv64a", fn)
+	custom := NewCustomConsistentHash(minReplicas, fn)
+	custom.Add("first")
+	_, err := custom.Export()
+	assert.NotNil(t, err)
+	_, err = NewNamedConsistentHash(minReplicas, "not_exist")
+	assert.NotNil(t, err)
+
+	ch, err := NewNamedConsistentHash(minReplicas, "fnv64a")
+	assert.Nil(t, err)
+	ch.Add("first")
+	ring, err := ch.Export()
+	assert.Nil(t, err)
+	assert.Equal(t, "fnv64a", ring.Hash)
+	imported, err := NewConsistentHashFromRing(ring)
+	assert.Nil(t, err)
+	assert.Empty(t, Diff(ch, imported))
+
+	_, err = NewConsistentHashFromRing(Ring{Hash: "not_exist", Replicas: minReplicas})
+	assert.NotNil(t, err)
+	_, err = NewConsistentHashFromRing(Ring{Hash: Murmur3, Replicas: minReplicas,
+		Nodes: []RingNode{{Name: "b"}, {Name: "a"}}})
+	assert.NotNil(t, err)
+	_, err = NewConsistentHashFromRing(Ring{Hash: Murmur3, Replicas: minReplicas,
+		Nodes: []RingNode{{Name: "a", Replicas: minReplicas + 1}}})
+	assert.NotNil(t, err)
+}
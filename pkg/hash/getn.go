@@ -0,0 +1,70 @@
+package hash
+
+// GetN returns up to n distinct nodes from h base on the given v, in preference order:
+// walks the ring clockwise from v, the first one is the same as Get(v).
+// The nodes with larger weight own more points on the ring, so they are more likely to be chosen.
+func (h *ConsistentHash) GetN(v any, n int) []any {
+	return h.GetNByZone(v, n, nil)
+}
+
+// GetNByZone is like GetN, but spreads the nodes across zones (racks, or any label of the node):
+// prefers the nodes whose zone is not chosen yet, then fills with the other nodes in preference order
+// if there are fewer than n zones. zone nil means every node is in its own zone.
+func (h *ConsistentHash) GetNByZone(v any, n int, zone func(node any) string) []any {
+	state := h.state.Load()
+	if n <= 0 || len(state.keys) == 0 {
+		return nil
+	}
+	if n > state.nodes {
+		n = state.nodes
+	}
+
+	result := make([]any, 0, n)
+	chosen := make(map[string]bool, n)
+	var skipped []any
+	zones := make(map[string]bool, n)
+	h.walk(state, v, func(node any) bool {
+		nodeRepr := repr(node)
+		if chosen[nodeRepr] {
+			return true
+		}
+		chosen[nodeRepr] = true
+		if zone != nil {
+			z := zone(node)
+			if zones[z] {
+				skipped = append(skipped, node)
+				return true
+			}
+			zones[z] = true
+		}
+		result = append(result, node)
+		return len(result) < n && len(chosen) < state.nodes
+	})
+
+	for _, node := range skipped {
+		if len(result) == n {
+			break
+		}
+		result = append(result, node)
+	}
+	return result
+}
+
+// walk calls fn with the nodes on the ring clockwise from v until fn returns false,
+// the nodes on the same point start from the one chosen by Get. A node may be visited more than once.
+func (h *ConsistentHash) walk(state *ringState, v any, fn func(node any) bool) {
+	index := state.search(h.hashFunc([]byte(repr(v))))
+	var innerIndex uint64
+	for i := 0; i < len(state.keys); i++ {
+		nodes := state.owners[(index+i)%len(state.keys)]
+		if len(nodes) > 1 && innerIndex == 0 {
+			innerIndex = h.hashFunc([]byte(innerRepr(v)))
+		}
+		for j := range nodes {
+			pos := (int(innerIndex%uint64(len(nodes))) + j) % len(nodes)
+			if !fn(nodes[pos]) {
+				return
+			}
+		}
+	}
+}
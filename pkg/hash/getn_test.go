@@ -0,0 +1,96 @@
+package hash
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func BenchmarkConsistentHashGetN(b *testing.B) {
+	ch := NewConsistentHash()
+	for i := 0; i < keySize; i++ {
+		ch.Add("localhost:" + strconv.Itoa(i))
+	}
+
+	for i := 0; i < b.N; i++ {
+		ch.GetN(i, 3)
+	}
+}
+
+func TestConsistentHashGetN(t *testing.T) {
+	ch := NewConsistentHash()
+	assert.Empty(t, ch.GetN("any", 3))
+
+	for i := 0; i < keySize; i++ {
+		ch.Add("localhost:" + strconv.Itoa(i))
+	}
+	assert.Empty(t, ch.GetN("any", 0))
+	for i := 0; i < requestSize; i++ {
+		nodes := ch.GetN(i, 3)
+		assert.Len(t, nodes, 3)
+		node, _ := ch.Get(i)
+		assert.Equal(t, node, nodes[0])
+		assert.NotEqual(t, nodes[0], nodes[1])
+		assert.NotEqual(t, nodes[0], nodes[2])
+		assert.NotEqual(t, nodes[1], nodes[2])
+		// 前面的结果是后面的前缀
+		assert.Equal(t, nodes[:2], ch.GetN(i, 2))
+	}
+	assert.Len(t, ch.GetN("any", keySize*2), keySize)
+
+	// 删除一个节点, 其他节点的先后顺序不变
+	before := ch.GetN("any", keySize)
+	ch.Remove(before[1])
+	after := ch.GetN("any", keySize)
+	assert.Equal(t, append([]any{before[0]}, before[2:]...), after)
+}
+
+func TestConsistentHashGetNWeight(t *testing.T) {
+	ch := NewConsistentHash()
+	ch.AddWithWeight("light", 10)
+	ch.AddWithWeight("heavy", 100)
+	ch.AddWithWeight("zero", 0)
+
+	var first int
+	for i := 0; i < requestSize; i++ {
+		nodes := ch.GetN(i, 3)
+		// 没有权重的节点不在环上
+		assert.ElementsMatch(t, []any{"light", "heavy"}, nodes)
+		if nodes[0] == "heavy" {
+			first++
+		}
+	}
+	assert.True(t, first > requestSize*8/10, first)
+}
+
+func TestConsistentHashGetNByZone(t *testing.T) {
+	ch := NewConsistentHash()
+	for _, zone := range []string{"a", "b", "c"} {
+		for i := 0; i < 4; i++ {
+			ch.Add(zone + "-" + strconv.Itoa(i))
+		}
+	}
+	zoneOf := func(node any) string {
+		return strings.Split(node.(string), "-")[0]
+	}
+
+	for i := 0; i < requestSize; i++ {
+		nodes := ch.GetNByZone(i, 3, zoneOf)
+		assert.Len(t, nodes, 3)
+		node, _ := ch.Get(i)
+		assert.Equal(t, node, nodes[0])
+		assert.ElementsMatch(t, []string{"a", "b", "c"}, []string{zoneOf(nodes[0]), zoneOf(nodes[1]), zoneOf(nodes[2])})
+
+		// zone 不够时, 用其他节点补足
+		nodes = ch.GetNByZone(i, 5, zoneOf)
+		assert.Len(t, nodes, 5)
+		assert.ElementsMatch(t, []string{"a", "b", "c"}, []string{zoneOf(nodes[0]), zoneOf(nodes[1]), zoneOf(nodes[2])})
+		seen := make(map[any]bool)
+		for _, node := range nodes {
+			assert.False(t, seen[node])
+			seen[node] = true
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package hash
+
+import "sync"
+
+// A JumpHash is the jump consistent hash (Lamping and Veach) implementation,
+// the nodes are buckets in the order they are added.
+// Adding a node or removing the last added node moves the minimal keys,
+// removing other nodes moves the last node into the bucket of the removed node,
+// so the keys on the last node move too.
+// Jump consistent hash doesn't support weights, the weight of AddWithWeight is ignored.
+type JumpHash struct {
+	hashFunc Func
+	nodes    []any
+	index    map[string]int // node repr -> bucket
+	lock     sync.RWMutex
+}
+
+// NewJumpHash returns a JumpHash.
+func NewJumpHash() *JumpHash {
+	return NewCustomJumpHash(Hash)
+}
+
+// NewCustomJumpHash returns a JumpHash with given hash func.
+func NewCustomJumpHash(fn Func) *JumpHash {
+	if fn == nil {
+		fn = Hash
+	}
+
+	return &JumpHash{
+		hashFunc: fn,
+		index:    make(map[string]int),
+	}
+}
+
+// Add adds the node as the last bucket, the later call will replace the node in its bucket.
+func (j *JumpHash) Add(node any) {
+	nodeRepr := repr(node)
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if i, ok := j.index[nodeRepr]; ok {
+		j.nodes[i] = node
+		return
+	}
+	j.index[nodeRepr] = len(j.nodes)
+	j.nodes = append(j.nodes, node)
+}
+
+// AddWithWeight is the same as Add, the weight is ignored.
+func (j *JumpHash) AddWithWeight(node any, _ int) {
+	j.Add(node)
+}
+
+// Get returns the corresponding node from j base on the given v.
+func (j *JumpHash) Get(v any) (any, bool) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	if len(j.nodes) == 0 {
+		return nil, false
+	}
+
+	return j.nodes[jump(j.hashFunc([]byte(repr(v))), len(j.nodes))], true
+}
+
+// Remove removes the given node from j, the last node is moved into its bucket.
+func (j *JumpHash) Remove(node any) {
+	nodeRepr := repr(node)
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	i, ok := j.index[nodeRepr]
+	if !ok {
+		return
+	}
+	last := len(j.nodes) - 1
+	if i != last {
+		j.nodes[i] = j.nodes[last]
+		j.index[repr(j.nodes[i])] = i
+	}
+	j.nodes[last] = nil
+	j.nodes = j.nodes[:last]
+	delete(j.index, nodeRepr)
+}
+
+// Nodes returns the string representations of the nodes in bucket order.
+func (j *JumpHash) Nodes() []string {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	nodes := make([]string, 0, len(j.nodes))
+	for _, node := range j.nodes {
+		nodes = append(nodes, repr(node))
+	}
+	return nodes
+}
+
+// jump returns the bucket in [0, buckets) for key.
+func jump(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,146 @@
+package hash
+
+import "sync"
+
+// DefaultMaglevTableSize is the default size of the maglev lookup table,
+// it should be a prime much larger than the number of nodes.
+const DefaultMaglevTableSize = 65537
+
+// A Maglev is the maglev hash implementation, keys are looked up in a table of
+// tableSize entries filled by the nodes in proportion to their weights.
+// Get is O(1), the table is rebuilt on each Add and Remove.
+type Maglev struct {
+	hashFunc  Func
+	tableSize int
+	nodes     nodeList
+	table     []int // entry -> index of nodes
+	lock      sync.RWMutex
+}
+
+// NewMaglev returns a Maglev.
+func NewMaglev() *Maglev {
+	return NewCustomMaglev(DefaultMaglevTableSize, Hash)
+}
+
+// NewCustomMaglev returns a Maglev with given table size and hash func,
+// tableSize is rounded up to a prime.
+func NewCustomMaglev(tableSize int, fn Func) *Maglev {
+	if tableSize < 2 {
+		tableSize = DefaultMaglevTableSize
+	}
+
+	if fn == nil {
+		fn = Hash
+	}
+
+	return &Maglev{
+		hashFunc:  fn,
+		tableSize: nextPrime(tableSize),
+	}
+}
+
+// Add adds the node with the top weight.
+func (m *Maglev) Add(node any) {
+	m.AddWithWeight(node, TopWeight)
+}
+
+// AddWithWeight adds the node with weight, the weight can be 1 to 100,
+// the later call will overwrite the weight of the former calls.
+func (m *Maglev) AddWithWeight(node any, weight int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.nodes = m.nodes.add(node, weight)
+	m.populate()
+}
+
+// Get returns the corresponding node from m base on the given v.
+func (m *Maglev) Get(v any) (any, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if len(m.nodes) == 0 {
+		return nil, false
+	}
+
+	hash := m.hashFunc([]byte(repr(v)))
+	return m.nodes[m.table[hash%uint64(m.tableSize)]].node, true
+}
+
+// Remove removes the given node from m.
+func (m *Maglev) Remove(node any) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var ok bool
+	if m.nodes, ok = m.nodes.remove(repr(node)); ok {
+		m.populate()
+	}
+}
+
+// Nodes returns the string representations of the nodes.
+func (m *Maglev) Nodes() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.nodes.reprs()
+}
+
+// populate fills the lookup table, each node walks its own permutation of the entries
+// (offset + i × skip) and takes weight entries per round, until the table is full.
+func (m *Maglev) populate() {
+	if len(m.nodes) == 0 {
+		m.table = nil
+		return
+	}
+
+	size := uint64(m.tableSize)
+	offsets := make([]uint64, len(m.nodes))
+	skips := make([]uint64, len(m.nodes))
+	next := make([]uint64, len(m.nodes))
+	for i, n := range m.nodes {
+		offsets[i] = m.hashFunc([]byte(n.repr)) % size
+		skips[i] = m.hashFunc([]byte(innerRepr(n.repr)))%(size-1) + 1
+	}
+
+	table := make([]int, m.tableSize)
+	for i := range table {
+		table[i] = -1
+	}
+	for filled := 0; ; {
+		for i, n := range m.nodes {
+			for w := 0; w < n.weight; w++ {
+				entry := (offsets[i] + next[i]*skips[i]) % size
+				for table[entry] >= 0 {
+					next[i]++
+					entry = (offsets[i] + next[i]*skips[i]) % size
+				}
+				table[entry] = i
+				next[i]++
+				filled++
+				if filled == m.tableSize {
+					m.table = table
+					return
+				}
+			}
+		}
+	}
+}
+
+func nextPrime(n int) int {
+	for ; ; n++ {
+		if isPrime(n) {
+			return n
+		}
+	}
+}
+
+func isPrime(n int) bool {
+	if n < 2 {
+		return false
+	}
+	for i := 2; i*i <= n; i++ {
+		if n%i == 0 {
+			return false
+		}
+	}
+	return true
+}
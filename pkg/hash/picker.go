@@ -0,0 +1,107 @@
+package hash
+
+import (
+	"fmt"
+	"sort"
+)
+
+// 几种一致性hash 算法, 按场景选择:
+//   - ring: ConsistentHash, 带虚拟节点的hash 环, 内存是 replicas × nodes, 支持GetBounded/GetN
+//   - rendezvous: 最高随机权重(HRW), 不需要额外的内存, Get 是O(nodes), 适合节点少的场景
+//   - jump: jump consistent hash, 不需要额外的内存, Get 是O(log nodes), 只有删除最后加入的节点时迁移最少, 不支持权重
+//   - maglev: maglev 查找表, Get 是O(1), 每次Add/Remove 重建查找表, 迁移比ring 稍多, 适合节点变化少, 查找多的场景
+const (
+	RingPicker       = "ring"
+	RendezvousPicker = "rendezvous"
+	JumpPicker       = "jump"
+	MaglevPicker     = "maglev"
+)
+
+// A Picker picks the corresponding node for a key.
+type Picker interface {
+	// Add adds the node with the top weight, the later call will overwrite the former calls.
+	Add(node any)
+	// AddWithWeight adds the node with weight, the weight can be 1 to 100,
+	// the later call will overwrite the former calls.
+	AddWithWeight(node any, weight int)
+	// Remove removes the given node.
+	Remove(node any)
+	// Get returns the corresponding node base on the given v.
+	Get(v any) (any, bool)
+	// Nodes returns the string representations of the nodes.
+	Nodes() []string
+}
+
+var (
+	_ Picker = (*ConsistentHash)(nil)
+	_ Picker = (*Rendezvous)(nil)
+	_ Picker = (*JumpHash)(nil)
+	_ Picker = (*Maglev)(nil)
+)
+
+// NewPicker returns the Picker with the given name and the default hash func.
+func NewPicker(name string) (Picker, error) {
+	switch name {
+	case RingPicker:
+		return NewConsistentHash(), nil
+	case RendezvousPicker:
+		return NewRendezvous(), nil
+	case JumpPicker:
+		return NewJumpHash(), nil
+	case MaglevPicker:
+		return NewMaglev(), nil
+	default:
+		return nil, fmt.Errorf("unknown picker:%s", name)
+	}
+}
+
+type weightedNode struct {
+	node   any
+	repr   string
+	weight int
+}
+
+// nodeList keeps the nodes sorted by repr, so the result doesn't depend on the order of adding.
+type nodeList []weightedNode
+
+func (l nodeList) index(nodeRepr string) (int, bool) {
+	i := sort.Search(len(l), func(i int) bool {
+		return l[i].repr >= nodeRepr
+	})
+	return i, i < len(l) && l[i].repr == nodeRepr
+}
+
+func (l nodeList) add(node any, weight int) nodeList {
+	if weight < 1 {
+		weight = 1
+	} else if weight > TopWeight {
+		weight = TopWeight
+	}
+
+	n := weightedNode{node: node, repr: repr(node), weight: weight}
+	i, ok := l.index(n.repr)
+	if ok {
+		l[i] = n
+		return l
+	}
+	l = append(l, weightedNode{})
+	copy(l[i+1:], l[i:])
+	l[i] = n
+	return l
+}
+
+func (l nodeList) remove(nodeRepr string) (nodeList, bool) {
+	i, ok := l.index(nodeRepr)
+	if !ok {
+		return l, false
+	}
+	return append(l[:i], l[i+1:]...), true
+}
+
+func (l nodeList) reprs() []string {
+	nodes := make([]string, 0, len(l))
+	for _, n := range l {
+		nodes = append(nodes, n.repr)
+	}
+	return nodes
+}
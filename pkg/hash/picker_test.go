@@ -0,0 +1,200 @@
+package hash
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var pickerNames = []string{RingPicker, RendezvousPicker, JumpPicker, MaglevPicker}
+
+func newTestPicker(t testing.TB, name string, prefix string, nodes int) Picker {
+	p, err := NewPicker(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < nodes; i++ {
+		p.Add(prefix + strconv.Itoa(i))
+	}
+	return p
+}
+
+func benchmarkPickerGet(b *testing.B, name string) {
+	p := newTestPicker(b, name, "localhost:", keySize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Get(i)
+	}
+}
+
+func BenchmarkRendezvousGet(b *testing.B) {
+	benchmarkPickerGet(b, RendezvousPicker)
+}
+
+func BenchmarkJumpHashGet(b *testing.B) {
+	benchmarkPickerGet(b, JumpPicker)
+}
+
+func BenchmarkMaglevGet(b *testing.B) {
+	benchmarkPickerGet(b, MaglevPicker)
+}
+
+func BenchmarkMaglevAdd(b *testing.B) {
+	m := NewMaglev()
+	for i := 0; i < keySize; i++ {
+		m.Add("localhost:" + strconv.Itoa(i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Add("localhost:" + strconv.Itoa(keySize+i%keySize))
+	}
+}
+
+func TestNewPicker(t *testing.T) {
+	_, err := NewPicker("not_exist")
+	assert.NotNil(t, err)
+
+	for _, name := range pickerNames {
+		p, err := NewPicker(name)
+		assert.Nil(t, err)
+		val, ok := p.Get("any")
+		assert.False(t, ok, name)
+		assert.Nil(t, val, name)
+
+		p.Add("first")
+		p.Add("second")
+		p.Add("second")
+		assert.ElementsMatch(t, []string{"first", "second"}, p.Nodes(), name)
+		p.Remove("first")
+		p.Remove("not_exist")
+		for i := 0; i < 100; i++ {
+			val, ok := p.Get(i)
+			assert.True(t, ok, name)
+			assert.Equal(t, "second", val, name)
+		}
+	}
+}
+
+func TestPickerDistribution(t *testing.T) {
+	for _, name := range pickerNames {
+		p := newTestPicker(t, name, "localhost:", keySize)
+		counts := make(map[any]int)
+		for i := 0; i < requestSize*10; i++ {
+			val, ok := p.Get(i)
+			assert.True(t, ok)
+			counts[val]++
+		}
+		assert.Len(t, counts, keySize, name)
+		// 平均500, ring 的虚拟节点少, 偏差最大
+		for node, n := range counts {
+			assert.True(t, n > 250 && n < 800, "%s %v: %d", name, node, n)
+		}
+	}
+}
+
+func TestPickerWeight(t *testing.T) {
+	for _, name := range []string{RendezvousPicker, MaglevPicker} {
+		p, _ := NewPicker(name)
+		p.AddWithWeight("light", 20)
+		p.AddWithWeight("heavy", 80)
+		counts := make(map[any]int)
+		for i := 0; i < requestSize*10; i++ {
+			val, _ := p.Get(i)
+			counts[val]++
+		}
+		ratio := float64(counts["heavy"]) / float64(counts["light"])
+		assert.True(t, ratio > 3 && ratio < 5, "%s: %f", name, ratio)
+	}
+}
+
+// 加一个节点, key 要么不变, 要么迁到新节点
+func TestPickerIncrementalTransfer(t *testing.T) {
+	prefix := "anything"
+	for _, name := range []string{RendezvousPicker, JumpPicker} {
+		origin := newTestPicker(t, name, prefix, keySize)
+		later := newTestPicker(t, name, prefix, keySize)
+		node := fmt.Sprintf("%s%d", prefix, keySize)
+		later.Add(node)
+
+		var moved int
+		for i := 0; i < requestSize; i++ {
+			before, _ := origin.Get(requestSize + i)
+			after, _ := later.Get(requestSize + i)
+			assert.True(t, before == after || after == node, name)
+			if before != after {
+				moved++
+			}
+		}
+		ratio := float32(moved) / float32(requestSize)
+		assert.True(t, ratio < 2.5/float32(keySize), "%s: %f", name, ratio)
+	}
+}
+
+// 删一个节点, 只有它的key 迁走; jump 只有删除最后一个节点时成立
+func TestPickerLeastTransferOnFailure(t *testing.T) {
+	prefix := "localhost:"
+	for _, name := range []string{RendezvousPicker, JumpPicker} {
+		p := newTestPicker(t, name, prefix, keySize)
+		keys := make(map[int]any, requestSize)
+		for i := 0; i < requestSize; i++ {
+			keys[i], _ = p.Get(requestSize + i)
+		}
+
+		remove := prefix + strconv.Itoa(keySize-1)
+		p.Remove(remove)
+		for i := 0; i < requestSize; i++ {
+			val, _ := p.Get(requestSize + i)
+			assert.NotEqual(t, remove, val, name)
+			if keys[i] != remove {
+				assert.Equal(t, keys[i], val, name)
+			}
+		}
+	}
+}
+
+func TestPickerTransferOnFailure(t *testing.T) {
+	prefix := "localhost:"
+	for _, name := range pickerNames {
+		p := newTestPicker(t, name, prefix, keySize)
+		keys := make(map[int]any, requestSize)
+		for i := 0; i < requestSize; i++ {
+			keys[i], _ = p.Get(requestSize + i)
+		}
+
+		remove := prefix + "3"
+		p.Remove(remove)
+		var transferred int
+		for i := 0; i < requestSize; i++ {
+			val, _ := p.Get(requestSize + i)
+			assert.NotEqual(t, remove, val, name)
+			if keys[i] != val {
+				transferred++
+			}
+		}
+		// jump 删除中间的节点时, 最后一个节点的key 也会迁移
+		limit := 2.5 / float32(keySize)
+		if name == JumpPicker {
+			limit *= 2
+		}
+		ratio := float32(transferred) / float32(requestSize)
+		assert.True(t, ratio < limit, "%s: %f", name, ratio)
+	}
+}
+
+func TestJumpHashRemove(t *testing.T) {
+	j := NewJumpHash()
+	j.Add("a")
+	j.Add("b")
+	j.Add("c")
+	j.Remove("a")
+	assert.Equal(t, []string{"c", "b"}, j.Nodes())
+	j.Add("a")
+	assert.Equal(t, []string{"c", "b", "a"}, j.Nodes())
+}
+
+func TestMaglevTableSize(t *testing.T) {
+	assert.Equal(t, 101, NewCustomMaglev(100, nil).tableSize)
+	assert.Equal(t, DefaultMaglevTableSize, NewCustomMaglev(0, nil).tableSize)
+}
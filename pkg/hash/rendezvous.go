@@ -0,0 +1,83 @@
+package hash
+
+import (
+	"math"
+	"sync"
+)
+
+// A Rendezvous is a rendezvous (highest random weight) hash implementation,
+// each key goes to the node with the highest score of hash(node, key),
+// removing a node only moves the keys on it.
+type Rendezvous struct {
+	hashFunc Func
+	nodes    nodeList
+	lock     sync.RWMutex
+}
+
+// NewRendezvous returns a Rendezvous.
+func NewRendezvous() *Rendezvous {
+	return NewCustomRendezvous(Hash)
+}
+
+// NewCustomRendezvous returns a Rendezvous with given hash func.
+func NewCustomRendezvous(fn Func) *Rendezvous {
+	if fn == nil {
+		fn = Hash
+	}
+
+	return &Rendezvous{hashFunc: fn}
+}
+
+// Add adds the node with the top weight.
+func (r *Rendezvous) Add(node any) {
+	r.AddWithWeight(node, TopWeight)
+}
+
+// AddWithWeight adds the node with weight, the weight can be 1 to 100,
+// the later call will overwrite the weight of the former calls.
+func (r *Rendezvous) AddWithWeight(node any, weight int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.nodes = r.nodes.add(node, weight)
+}
+
+// Get returns the node with the highest score for v.
+func (r *Rendezvous) Get(v any) (any, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if len(r.nodes) == 0 {
+		return nil, false
+	}
+
+	key := repr(v)
+	var best any
+	bestScore := math.Inf(-1)
+	for _, n := range r.nodes {
+		if score := r.score(n, key); score > bestScore {
+			best, bestScore = n.node, score
+		}
+	}
+	return best, true
+}
+
+// score is the weighted rendezvous score weight / -ln(u), u is the hash mapped to (0, 1).
+func (r *Rendezvous) score(n weightedNode, key string) float64 {
+	hash := r.hashFunc([]byte(n.repr + key))
+	u := (float64(hash>>11) + 0.5) / (1 << 53)
+	return float64(n.weight) / -math.Log(u)
+}
+
+// Remove removes the given node from r.
+func (r *Rendezvous) Remove(node any) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.nodes, _ = r.nodes.remove(repr(node))
+}
+
+// Nodes returns the string representations of the nodes.
+func (r *Rendezvous) Nodes() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.nodes.reprs()
+}
@@ -0,0 +1,267 @@
+package hash
+
+import (
+	"math"
+	"sort"
+)
+
+// ringState is an immutable ring, ConsistentHash swaps it atomically on each change.
+type ringState struct {
+	keys   []uint64 // sorted points
+	owners [][]any  // owners[i] are the nodes on keys[i], more than one node when the hashes collide
+	nodes  int      // number of nodes, including the ones without points
+}
+
+// MovedRange is a range of hashes [Start, End] whose owners changed between two rings.
+// From and To are the nodes on the point owning the range, usually one node,
+// more than one when the hashes of the nodes collide, then a key goes to one of them like Get.
+// From or To is empty if the ring is empty.
+type MovedRange struct {
+	Start uint64
+	End   uint64
+	From  []any
+	To    []any
+}
+
+type ringPoint struct {
+	hash uint64
+	node any
+}
+
+// newRingState builds the ring from points, a node is on a point at most once,
+// even if some of its replicas have the same hash.
+func newRingState(points []ringPoint, nodes int) *ringState {
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return repr(points[i].node) < repr(points[j].node)
+	})
+	state := &ringState{
+		keys:   make([]uint64, 0, len(points)),
+		owners: make([][]any, 0, len(points)),
+		nodes:  nodes,
+	}
+	for _, p := range points {
+		if n := len(state.keys); n > 0 && state.keys[n-1] == p.hash {
+			// the same point of the node is kept once like with
+			if owners := state.owners[n-1]; repr(owners[len(owners)-1]) != repr(p.node) {
+				state.owners[n-1] = append(owners, p.node)
+			}
+			continue
+		}
+		state.keys = append(state.keys, p.hash)
+		state.owners = append(state.owners, []any{p.node})
+	}
+	return state
+}
+
+// with returns a new ring with the points of node added.
+func (s *ringState) with(points []uint64, node any) *ringState {
+	added := make([]ringPoint, 0, len(points))
+	for _, hash := range points {
+		added = append(added, ringPoint{hash: hash, node: node})
+	}
+	sort.Slice(added, func(i, j int) bool {
+		return added[i].hash < added[j].hash
+	})
+
+	state := &ringState{
+		keys:   make([]uint64, 0, len(s.keys)+len(added)),
+		owners: make([][]any, 0, len(s.keys)+len(added)),
+		nodes:  s.nodes,
+	}
+	i, j := 0, 0
+	for i < len(s.keys) || j < len(added) {
+		switch {
+		case j == len(added) || (i < len(s.keys) && s.keys[i] < added[j].hash):
+			state.keys = append(state.keys, s.keys[i])
+			state.owners = append(state.owners, s.owners[i])
+			i++
+		case i < len(s.keys) && s.keys[i] == added[j].hash:
+			state.keys = append(state.keys, s.keys[i])
+			state.owners = append(state.owners, insertOwner(s.owners[i], node))
+			i++
+			j++
+		default:
+			state.keys = append(state.keys, added[j].hash)
+			state.owners = append(state.owners, []any{node})
+			j++
+		}
+		// the same point of the node
+		for j < len(added) && j > 0 && added[j].hash == added[j-1].hash {
+			j++
+		}
+	}
+	return state
+}
+
+// insertOwner returns a new slice with node inserted into owners,
+// the nodes on a collided point are sorted by repr, so the ring doesn't depend on the order of adding.
+func insertOwner(owners []any, node any) []any {
+	nodeRepr := repr(node)
+	i := sort.Search(len(owners), func(i int) bool {
+		return repr(owners[i]) >= nodeRepr
+	})
+	result := make([]any, 0, len(owners)+1)
+	result = append(result, owners[:i]...)
+	result = append(result, node)
+	return append(result, owners[i:]...)
+}
+
+// without returns a new ring with the points of node removed.
+func (s *ringState) without(points []uint64, nodeRepr string) *ringState {
+	removed := make(map[uint64]bool, len(points))
+	for _, hash := range points {
+		removed[hash] = true
+	}
+
+	state := &ringState{
+		keys:   make([]uint64, 0, len(s.keys)),
+		owners: make([][]any, 0, len(s.keys)),
+		nodes:  s.nodes,
+	}
+	for i, hash := range s.keys {
+		owners := s.owners[i]
+		if removed[hash] {
+			owners = nil
+			for _, x := range s.owners[i] {
+				if repr(x) != nodeRepr {
+					owners = append(owners, x)
+				}
+			}
+			if len(owners) == 0 {
+				continue
+			}
+		}
+		state.keys = append(state.keys, hash)
+		state.owners = append(state.owners, owners)
+	}
+	return state
+}
+
+// search returns the index of the first key not less than hash, wraps around the ring.
+func (s *ringState) search(hash uint64) int {
+	return sort.Search(len(s.keys), func(i int) bool {
+		return s.keys[i] >= hash
+	}) % len(s.keys)
+}
+
+// ownersOf returns the nodes on the point owning hash.
+func (s *ringState) ownersOf(hash uint64) []any {
+	if len(s.keys) == 0 {
+		return nil
+	}
+	return s.owners[s.search(hash)]
+}
+
+// Rebuild replaces all nodes of h with nodes in one step, weights[i] is the weight of nodes[i],
+// the nodes without weight have the top weight, the later one overwrites the former one like Add.
+// The new ring is built aside and swapped atomically, Get sees either the old ring or the new one.
+// The bounded loads of the nodes not in nodes are released.
+func (h *ConsistentHash) Rebuild(nodes []any, weights []int) {
+	replicas := make([]int, len(nodes))
+	for i := range nodes {
+		weight := TopWeight
+		if i < len(weights) {
+			weight = weights[i]
+		}
+		replicas[i] = h.replicas * weight / TopWeight
+	}
+	h.rebuild(nodes, replicas)
+}
+
+// rebuild is Rebuild with the number of replicas of each node.
+func (h *ConsistentHash) rebuild(nodes []any, replicas []int) {
+	last := make(map[string]int, len(nodes))
+	for i, node := range nodes {
+		last[repr(node)] = i
+	}
+
+	newNodes := make(map[string]int, len(last))
+	points := make([]ringPoint, 0, len(last)*h.replicas)
+	for i, node := range nodes {
+		nodeRepr := repr(node)
+		if last[nodeRepr] != i {
+			continue
+		}
+		n := replicas[i]
+		if n > h.replicas {
+			n = h.replicas
+		}
+
+		newNodes[nodeRepr] = n
+		for _, hash := range h.points(nodeRepr, n) {
+			points = append(points, ringPoint{hash: hash, node: node})
+		}
+	}
+	state := newRingState(points, len(newNodes))
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	old := h.nodes
+	h.nodes = newNodes
+	h.state.Store(state)
+	for nodeRepr := range old {
+		if _, ok := newNodes[nodeRepr]; !ok {
+			h.releaseNode(nodeRepr)
+		}
+	}
+}
+
+// Diff reports the ranges of hashes whose owner changed from ring from to ring to,
+// in ascending order, the adjacent ranges with the same owners are merged.
+// The hash of a key is hashFunc(key), so the rings should use the same hash func.
+func Diff(from, to *ConsistentHash) []MovedRange {
+	fs, ts := from.state.Load(), to.state.Load()
+	points := make([]uint64, 0, len(fs.keys)+len(ts.keys))
+	points = append(points, fs.keys...)
+	points = append(points, ts.keys...)
+	sort.Slice(points, func(i, j int) bool {
+		return points[i] < points[j]
+	})
+
+	var moved []MovedRange
+	report := func(start, end uint64) {
+		fromNodes, toNodes := fs.ownersOf(end), ts.ownersOf(end)
+		if sameNodes(fromNodes, toNodes) {
+			return
+		}
+		if n := len(moved); n > 0 && moved[n-1].End+1 == start &&
+			sameNodes(moved[n-1].From, fromNodes) && sameNodes(moved[n-1].To, toNodes) {
+			moved[n-1].End = end
+			return
+		}
+		moved = append(moved, MovedRange{Start: start, End: end, From: fromNodes, To: toNodes})
+	}
+
+	// the hashes in (previous point, point] go to the point, the hashes after the last point wrap around
+	var start uint64
+	for i, point := range points {
+		if i > 0 && point == points[i-1] {
+			continue
+		}
+		report(start, point)
+		if point == math.MaxUint64 {
+			return moved
+		}
+		start = point + 1
+	}
+	if len(points) > 0 {
+		report(start, math.MaxUint64)
+	}
+	return moved
+}
+
+// sameNodes the nodes on the point are the same in the same order, so the keys go to the same node.
+func sameNodes(a, b []any) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if repr(a[i]) != repr(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,193 @@
+package hash
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const rebuildSize = 500
+
+func BenchmarkConsistentHashAdd(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		ch := NewConsistentHash()
+		for j := 0; j < rebuildSize; j++ {
+			ch.Add("localhost:" + strconv.Itoa(j))
+		}
+	}
+}
+
+func BenchmarkConsistentHashRebuild(b *testing.B) {
+	nodes := make([]any, 0, rebuildSize)
+	for j := 0; j < rebuildSize; j++ {
+		nodes = append(nodes, "localhost:"+strconv.Itoa(j))
+	}
+
+	ch := NewConsistentHash()
+	for i := 0; i < b.N; i++ {
+		ch.Rebuild(nodes, nil)
+	}
+}
+
+func TestConsistentHashRebuild(t *testing.T) {
+	ch := NewConsistentHash()
+	rebuilt := NewConsistentHash()
+	var nodes []any
+	var weights []int
+	for i := 0; i < keySize; i++ {
+		node := "localhost:" + strconv.Itoa(i)
+		ch.AddWithWeight(node, 10+i)
+		nodes = append(nodes, node)
+		weights = append(weights, 10+i)
+	}
+	rebuilt.Add("old")
+	rebuilt.GetBounded("key")
+	rebuilt.Rebuild(nodes, weights)
+
+	// 和逐个Add 的结果一样
+	assert.ElementsMatch(t, ch.Nodes(), rebuilt.Nodes())
+	assert.Equal(t, ch.state.Load().keys, rebuilt.state.Load().keys)
+	for i := 0; i < requestSize; i++ {
+		expect, _ := ch.Get(i)
+		actual, ok := rebuilt.Get(i)
+		assert.True(t, ok)
+		assert.Equal(t, expect, actual)
+	}
+	assert.Empty(t, Diff(ch, rebuilt))
+	// 不在新节点里的计数被释放
+	assert.Equal(t, 0, sumLoads(rebuilt.Loads()))
+
+	// 重复的节点, 后面的覆盖前面的
+	rebuilt.Rebuild([]any{"first", "second", "first"}, []int{100, 100, 0})
+	for i := 0; i < 100; i++ {
+		val, _ := rebuilt.Get(i)
+		assert.Equal(t, "second", val)
+	}
+
+	rebuilt.Rebuild(nil, nil)
+	_, ok := rebuilt.Get("any")
+	assert.False(t, ok)
+}
+
+func TestConsistentHashRebuildConcurrent(t *testing.T) {
+	ring1 := []any{"a", "b", "c"}
+	ring2 := []any{"d", "e", "f"}
+	ch := NewConsistentHash()
+	ch.Rebuild(ring1, nil)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// 只会看到完整的ring1 或ring2
+			nodes := ch.GetN(i, 3)
+			assert.Len(t, nodes, 3)
+			first := nodes[0] == "a" || nodes[0] == "b" || nodes[0] == "c"
+			for _, node := range nodes[1:] {
+				assert.Equal(t, first, node == "a" || node == "b" || node == "c")
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		if i%2 == 0 {
+			ch.Rebuild(ring2, nil)
+		} else {
+			ch.Rebuild(ring1, nil)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestConsistentHashRebuildCollidedReplicas(t *testing.T) {
+	// 只有4 个hash 值, 同一个节点的多个虚拟节点会冲突
+	fn := func(data []byte) uint64 {
+		return uint64(data[len(data)-1] % 4)
+	}
+	added := NewCustomConsistentHash(minReplicas, fn)
+	rebuilt := NewCustomConsistentHash(minReplicas, fn)
+	nodes := []any{"first", "second", "third"}
+	for _, node := range nodes {
+		added.Add(node)
+	}
+	rebuilt.Rebuild(nodes, nil)
+
+	// Add 和Rebuild 的环一样, 冲突的点上每个节点只出现一次
+	assert.Equal(t, added.state.Load().keys, rebuilt.state.Load().keys)
+	assert.Equal(t, added.state.Load().owners, rebuilt.state.Load().owners)
+	for _, owners := range rebuilt.state.Load().owners {
+		assert.Equal(t, nodes, owners)
+	}
+	assert.Empty(t, Diff(added, rebuilt))
+
+	// 删除后也一样
+	added.Remove("second")
+	rebuilt.Rebuild([]any{"first", "third"}, nil)
+	assert.Equal(t, added.state.Load().owners, rebuilt.state.Load().owners)
+}
+
+func TestConsistentHashDiff(t *testing.T) {
+	from := NewConsistentHash()
+	to := NewConsistentHash()
+	assert.Empty(t, Diff(from, to))
+	for i := 0; i < keySize; i++ {
+		from.Add("localhost:" + strconv.Itoa(i))
+		to.Add("localhost:" + strconv.Itoa(i))
+	}
+	assert.Empty(t, Diff(from, to))
+
+	to.Add("localhost:" + strconv.Itoa(keySize))
+	to.Remove("localhost:0")
+	moved := Diff(from, to)
+	assert.NotEmpty(t, moved)
+	for i, r := range moved {
+		assert.True(t, r.Start <= r.End)
+		assert.False(t, sameNodes(r.From, r.To))
+		if i > 0 {
+			assert.True(t, moved[i-1].End < r.Start)
+		}
+	}
+
+	// 每个key 是否迁移, 迁到哪里, 和Diff 的结果一致
+	for i := 0; i < requestSize; i++ {
+		hash := Hash([]byte(strconv.Itoa(i)))
+		before, _ := from.Get(i)
+		after, _ := to.Get(i)
+		var found *MovedRange
+		for j := range moved {
+			if moved[j].Start <= hash && hash <= moved[j].End {
+				found = &moved[j]
+				break
+			}
+		}
+		if before == after {
+			assert.Nil(t, found)
+			continue
+		}
+		if assert.NotNil(t, found) {
+			assert.Contains(t, found.From, before)
+			assert.Contains(t, found.To, after)
+		}
+	}
+
+	// 所有范围都迁到空的ring, 覆盖全部的hash
+	moved = Diff(from, NewConsistentHash())
+	assert.Equal(t, uint64(0), moved[0].Start)
+	assert.Equal(t, uint64(math.MaxUint64), moved[len(moved)-1].End)
+	for i, r := range moved {
+		assert.Empty(t, r.To)
+		if i > 0 {
+			assert.Equal(t, moved[i-1].End+1, r.Start)
+		}
+	}
+}
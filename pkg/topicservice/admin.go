@@ -0,0 +1,254 @@
+package topicservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// 管理接口, 配置了Admin.Addr 才开启, 返回json, 给cmd/topicctl 用:
+//
+//	GET  /admin/status         下面所有信息
+//	GET  /admin/services       注册的服务列表
+//	GET  /admin/leader         当前的leader
+//	GET  /admin/topics         分配的 topic-->services 和每个topic 的负载算法
+//	GET  /admin/members        gossip 成员
+//	GET  /admin/subscriptions  实时的 topic-->services 订阅关系
+//	POST /admin/rebalance      立即重新分配topic
+//	POST /admin/pin            把topic 固定在指定的service 上, body: {"Topic":"t","Services":["s1"]}, Services 为空表示取消
+//
+// 修改的接口只有leader 能处理(gossip 发现模式下每个服务都能重新分配, 但不支持pin),
+// 不是leader 时返回409 和leader 的管理地址(AdminStatus.LeaderAdmin), topicctl 会自动转给leader
+
+type AdminConf struct {
+	Addr string `json:",optional"` // 管理接口监听的地址, 比如127.0.0.1:9100, 为空不开启
+}
+
+type AdminStatus struct {
+	Self            string
+	Discovery       string
+	IsLeader        bool
+	Draining        bool
+	Leader          string
+	LeaderAdmin     string //leader 的管理接口地址
+	Services        []ServiceInfo
+	Topics          map[string][]string //分配的 topic-->services
+	Balancers       map[string]string   //单独指定了负载算法的topic
+	DefaultBalancer string
+	Catalog         map[string]TopicSpec `json:",omitempty"` //topic 目录
+	Members         []string             `json:",omitempty"`
+	Subscriptions   map[string][]string  `json:",omitempty"`
+	Rebalance       *RebalanceStatus     `json:",omitempty"`
+	RingFingerprint string               `json:",omitempty"` //默认负载算法的hash 环的指纹, 各个服务一样说明看到的环一样
+}
+
+type PinRequest struct {
+	Topic    string
+	Services []string
+}
+
+type adminError struct {
+	Error       string
+	LeaderAdmin string `json:",omitempty"`
+}
+
+// Rebalance 立即根据当前的服务列表重新分配topic, etcd 模式下只有leader 能调用
+func (s *Service) Rebalance() error {
+	if s.gossipDiscovery() {
+		s.assignTopicsLocal()
+		return nil
+	}
+	if !s.IsLeader() {
+		return ErrNotLeader
+	}
+	s.assignTopics()
+	return nil
+}
+
+// PinTopic 把topic 固定在services(ServiceInfo.String())上, services 为空表示恢复成默认的负载算法。
+// 通过pinned_ 负载算法实现, 和分配结果一起写到etcd, leader 切换后保持
+func (s *Service) PinTopic(topic string, services ...string) error {
+	if topic == "" {
+		return fmt.Errorf("topic is empty")
+	}
+	if s.gossipDiscovery() {
+		return fmt.Errorf("pin topic is not supported in gossip discovery")
+	}
+	if !s.IsLeader() {
+		return ErrNotLeader
+	}
+	for _, v := range services {
+		if v == "" || strings.ContainsAny(v, pinnedServiceSep+TopicServiceSeq+TopicBalancerSep+TopicsSep) {
+			return fmt.Errorf("invalid service:%q", v)
+		}
+	}
+	if len(services) == 0 {
+		return s.SetTopicBalancer(topic, "")
+	}
+	return s.SetTopicBalancer(topic, PinnedBalancerName(services...))
+}
+
+// AdminStatus 返回本服务看到的集群状态
+func (s *Service) AdminStatus() AdminStatus {
+	status := AdminStatus{
+		Self:            s.Key(),
+		Discovery:       s.sc.Discovery,
+		IsLeader:        s.IsLeader(),
+		Draining:        s.Draining(),
+		Topics:          make(map[string][]string),
+		Balancers:       make(map[string]string),
+		DefaultBalancer: s.balance.DefaultBalancerName(),
+		RingFingerprint: s.RingFingerprint(),
+	}
+	//旧版本注册的信息里可能有密钥
+	for _, v := range s.getServiceList() {
+		status.Services = append(status.Services, v.redacted())
+	}
+	if status.Discovery == "" {
+		status.Discovery = DiscoveryEtcd
+	}
+	if leader, ok := s.Leader(); ok {
+		status.Leader = leader.String()
+		status.LeaderAdmin = leader.Admin.Addr
+	}
+	for topic, services := range s.DistributedTopics() {
+		status.Topics[topic] = strings.Split(services, TopicServiceSeq)
+		if name := s.GetTopicBalancer(topic); name != "" {
+			status.Balancers[topic] = name
+		}
+	}
+	if catalog := s.Catalog(); len(catalog) > 0 {
+		status.Catalog = catalog
+	}
+	if s.topicState != nil {
+		status.Members = s.topicState.Members()
+		sort.Strings(status.Members)
+	}
+	if subs := s.SubscriptionStore(); subs != nil {
+		status.Subscriptions = subs.Subscriptions()
+	}
+	if rs, ok := s.RebalanceStatus(); ok && s.rebalancer.Enabled() {
+		status.Rebalance = &rs
+	}
+	return status
+}
+
+func (s *Service) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	get := func(path string, fn func(status AdminStatus) interface{}) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				writeAdminJSON(w, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+				return
+			}
+			writeAdminJSON(w, http.StatusOK, fn(s.AdminStatus()))
+		})
+	}
+	get("/admin/status", func(status AdminStatus) interface{} { return status })
+	get("/admin/services", func(status AdminStatus) interface{} { return status.Services })
+	get("/admin/leader", func(status AdminStatus) interface{} {
+		return map[string]interface{}{"Leader": status.Leader, "LeaderAdmin": status.LeaderAdmin, "IsLeader": status.IsLeader}
+	})
+	get("/admin/topics", func(status AdminStatus) interface{} {
+		return map[string]interface{}{"Topics": status.Topics, "Balancers": status.Balancers, "DefaultBalancer": status.DefaultBalancer}
+	})
+	get("/admin/members", func(status AdminStatus) interface{} { return status.Members })
+	get("/admin/subscriptions", func(status AdminStatus) interface{} { return status.Subscriptions })
+
+	mux.HandleFunc("/admin/rebalance", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeAdminJSON(w, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+			return
+		}
+		s.writeAdminResult(w, s.Rebalance())
+	})
+	mux.HandleFunc("/admin/pin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeAdminJSON(w, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+			return
+		}
+		var req PinRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			writeAdminJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+			return
+		}
+		s.writeAdminResult(w, s.PinTopic(req.Topic, req.Services...))
+	})
+	return mux
+}
+
+// 修改的结果, 成功时返回分配结果
+func (s *Service) writeAdminResult(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotLeader) {
+		leader, _ := s.Leader()
+		writeAdminJSON(w, http.StatusConflict, adminError{Error: err.Error(), LeaderAdmin: leader.Admin.Addr})
+		return
+	}
+	if err != nil {
+		writeAdminJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+		return
+	}
+	status := s.AdminStatus()
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"Topics": status.Topics, "Balancers": status.Balancers})
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logx.Errorf("write admin response err:%v", err)
+	}
+}
+
+// startAdmin 监听Admin.Addr, Stop 时关闭
+func (s *Service) startAdmin() error {
+	if s.sc.Admin.Addr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", s.sc.Admin.Addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: s.adminHandler(), ReadHeaderTimeout: 5 * time.Second}
+	s.Lock()
+	s.adminServer = server
+	s.adminAddr = ln.Addr().String()
+	s.Unlock()
+	logx.Infof("%s admin listen on %s", s.Key(), ln.Addr())
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logx.Errorf("admin server err:%v", err)
+		}
+	}()
+	return nil
+}
+
+// AdminAddr 返回管理接口实际监听的地址, 没有开启时返回空
+func (s *Service) AdminAddr() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.adminAddr
+}
+
+func (s *Service) stopAdmin() {
+	s.Lock()
+	server := s.adminServer
+	s.adminServer = nil
+	s.Unlock()
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logx.Errorf("shutdown admin server err:%v", err)
+	}
+}
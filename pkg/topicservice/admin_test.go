@@ -0,0 +1,65 @@
+package topicservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminAPI(t *testing.T) {
+	s, err := NewService(&ServiceConfig{
+		Name:      "topic_service",
+		Id:        "1",
+		Discovery: DiscoveryGossip,
+		Gossip:    GossipConf{Enabled: true, Addr: "127.0.0.1"},
+		Admin:     AdminConf{Addr: "127.0.0.1:0"},
+	})
+	assert.Nil(t, err)
+	s.SetTopics([]string{"topic1", "topic2"})
+	assert.Nil(t, s.Start(context.Background()))
+	defer s.Stop()
+	base := "http://" + s.AdminAddr() + "/admin/"
+
+	resp, err := http.Get(base + "status")
+	assert.Nil(t, err)
+	var status AdminStatus
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&status))
+	resp.Body.Close()
+	assert.Equal(t, "topic_service-1", status.Self)
+	assert.Equal(t, DiscoveryGossip, status.Discovery)
+	assert.True(t, status.IsLeader)
+	assert.Equal(t, "topic_service-1", status.Leader)
+	assert.Len(t, status.Services, 1)
+	assert.Equal(t, map[string][]string{"topic1": {"topic_service-1"}, "topic2": {"topic_service-1"}}, status.Topics)
+	assert.Equal(t, ConsistentHashBalancer, status.DefaultBalancer)
+	assert.Len(t, status.Members, 1)
+	assert.Equal(t, []string{"topic_service-1"}, status.Subscriptions["topic1"])
+
+	resp, err = http.Get(base + "members")
+	assert.Nil(t, err)
+	var members []string
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&members))
+	resp.Body.Close()
+	assert.Equal(t, status.Members, members)
+
+	resp, err = http.Get(base + "rebalance")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = http.Post(base+"rebalance", "application/json", nil)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// gossip 发现模式不支持pin
+	body, _ := json.Marshal(PinRequest{Topic: "topic1", Services: []string{"topic_service-1"}})
+	resp, err = http.Post(base+"pin", "application/json", bytes.NewReader(body))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -1,7 +1,9 @@
 package topicservice
 
 import (
+	"fmt"
 	"reflect"
+	"sort"
 	"sync"
 
 	"github.com/jursonmo/practise_new/pkg/hash"
@@ -21,6 +23,71 @@ type ServiceBalancer interface {
 	Balance(topic string, services []ServiceInfo) []ServiceInfo
 }
 
+// TopicRemover 负载算法可以实现的接口, topic 不再分配时调用, 删除负载算法为这个topic 保存的状态(比如topic 计数)
+type TopicRemover interface {
+	RemoveTopic(topic string)
+}
+
+// RingExporter 基于一致性hash 的负载算法可以实现的接口, 导出计算分配结果用的hash 环,
+// leader 把它发布到etcd, 其他服务比较指纹就知道和leader 看到的环是否一样
+type RingExporter interface {
+	Ring() (hash.Ring, error)
+}
+
+// BalancerFactory 创建一个新的负载算法实例, 每个Balance 有自己的实例(实例里有根据services 初始化的状态)
+type BalancerFactory func() ServiceBalancer
+
+var (
+	balancerMu        sync.RWMutex
+	balancerFactories = make(map[string]BalancerFactory) //key: balancer name
+)
+
+// RegisterBalancer 注册负载算法, 注册后可以在配置里用名字(Name())引用
+func RegisterBalancer(name string, factory BalancerFactory) {
+	balancerMu.Lock()
+	defer balancerMu.Unlock()
+	balancerFactories[name] = factory
+}
+
+// NewBalancer 根据名字创建负载算法
+func NewBalancer(name string) (ServiceBalancer, error) {
+	balancerMu.RLock()
+	factory, ok := balancerFactories[name]
+	balancerMu.RUnlock()
+	if !ok {
+		if balancer, ok := parsePinnedBalancer(name); ok {
+			return balancer, nil
+		}
+		if balancer, ok := parseReplicatedBalancer(name); ok {
+			return balancer, nil
+		}
+		return nil, fmt.Errorf("balancer %s not registered", name)
+	}
+	return factory(), nil
+}
+
+// BalancerNames 返回所有已注册的负载算法名字
+func BalancerNames() []string {
+	balancerMu.RLock()
+	defer balancerMu.RUnlock()
+	names := make([]string, 0, len(balancerFactories))
+	for name := range balancerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+const ConsistentHashBalancer = "consistent_hash"
+
+func newConsistentHash() ServiceBalancer {
+	return &myConsistentHash{
+		chash: hash.NewConsistentHash(),
+		name:  ConsistentHashBalancer,
+		desc:  "consistent hash balance alg",
+	}
+}
+
 type myConsistentHash struct {
 	chash *hash.ConsistentHash
 	name  string
@@ -34,23 +101,18 @@ func (h *myConsistentHash) Desc() string {
 	return h.desc
 }
 func (h *myConsistentHash) Init(services []ServiceInfo) {
-	//h.chash.Add node 时, 如果node已经存在,先删除再添加。
+	//一次性重建hash 环再原子替换, 不会看到只加了一部分node 的中间状态
 	logx.Infof("before init nodes:%v", h.chash.Nodes())
-	oldNodes := make(map[string]struct{})
-	for _, node := range h.chash.Nodes() {
-		oldNodes[node] = struct{}{}
-	}
+	nodes := make([]any, 0, len(services))
 	for _, v := range services {
-		h.chash.Add(v)               //v 是ServiceInfo类型， 实现了String()方法，所以可以直接添加
-		delete(oldNodes, v.String()) //把新的node 从oldNodes中删除，剩下的就是需要删除的node
-	}
-	//删除完后，剩下的就是需要添加的node
-	logx.Infof("need to del oldNodes:%v", oldNodes)
-	for node := range oldNodes {
-		h.chash.Remove(node)
+		nodes = append(nodes, v) //v 是ServiceInfo类型， 实现了String()方法，所以可以直接添加
 	}
+	h.chash.Rebuild(nodes, nil)
 	logx.Infof("after init nodes:%v", h.chash.Nodes())
 }
+func (h *myConsistentHash) Ring() (hash.Ring, error) {
+	return h.chash.Export()
+}
 func (h *myConsistentHash) Balance(topic string, services []ServiceInfo) []ServiceInfo {
 	v, ok := h.chash.Get(topic)
 	if !ok {
@@ -65,34 +127,30 @@ type Balance struct {
 	DefaultBalancer ServiceBalancer
 	Services        []ServiceInfo                    //all Services
 	TopicBalance    map[string]*ServiceBalanceResult //key: topic, topic 对应的负载算法以及结果(对应的service/broker列表)
+	balancers       map[string]ServiceBalancer       //key: balancer name, 已经初始化过的负载算法实例
 }
 
 type ServiceBalanceResult struct {
 	Topic string
 	ServiceBalancer
 	ServiceList []ServiceInfo //负载算法计算后的结果 result
+	explicit    bool          //单独给topic 指定的负载算法, 不跟着默认负载算法变化, 即使和默认的是同一个实例
 }
 
 var DefaultBalance *Balance
 
 func init() {
+	RegisterBalancer(ConsistentHashBalancer, newConsistentHash)
 	// 初始化balances
-	//注册默认的负载算法是一致性hash算法
-	DefaultBalance = &Balance{
-		DefaultBalancer: &myConsistentHash{
-			chash: hash.NewConsistentHash(),
-			name:  "consistent_hash",
-			desc:  "consistent hash balance alg",
-		},
-		Services:     []ServiceInfo{},
-		TopicBalance: make(map[string]*ServiceBalanceResult),
-	}
+	//默认的负载算法是一致性hash算法
+	DefaultBalance = NewBalance(newConsistentHash())
 }
 func NewBalance(balancer ServiceBalancer) *Balance {
 	return &Balance{
 		DefaultBalancer: balancer,
 		Services:        []ServiceInfo{},
 		TopicBalance:    make(map[string]*ServiceBalanceResult),
+		balancers:       map[string]ServiceBalancer{balancer.Name(): balancer},
 	}
 }
 
@@ -106,47 +164,237 @@ func (b *Balance) UpdateServices(services []ServiceInfo) {
 	}
 	logx.Infof("balance services change:%+v", services)
 	b.Services = services
-	//update default balancer
-	b.DefaultBalancer.Init(b.Services)
+	//update default balancer 和 topic 指定的balancer
+	for _, balancer := range b.balancers {
+		balancer.Init(b.Services)
+	}
 	//update topic balance , service list 发生更新后，重新更新已经存在缓存中的负载结果
 	for topic, bb := range b.TopicBalance {
 		//根据最新的 Services 和 原来缓存的 ServiceBalancer 来重新计算结果
 		bb.ServiceList = bb.ServiceBalancer.Balance(topic, b.Services)
 	}
 }
+
+// 当topic对应的负载算法发生变化时，需要重新计算结果, balancer 为nil 表示恢复成默认的负载算法
 func (b *Balance) UpdateTopicBalancer(topic string, balancer ServiceBalancer) {
-	//TODO: 当topic对应的负载算法发生变化时，需要重新计算结果
+	b.Lock()
+	defer b.Unlock()
+	explicit := balancer != nil
+	if balancer == nil {
+		balancer = b.DefaultBalancer
+	}
+	balancer = b.addBalancer(balancer)
+	bb, ok := b.TopicBalance[topic]
+	if !ok {
+		bb = &ServiceBalanceResult{Topic: topic}
+		b.TopicBalance[topic] = bb
+	} else if bb.ServiceBalancer != balancer {
+		//topic 不再用原来的负载算法, 删除原来的负载算法为这个topic 保存的状态
+		removeBalancerTopic(bb.ServiceBalancer, topic)
+	}
+	bb.ServiceBalancer = balancer
+	bb.explicit = explicit
+	bb.ServiceList = balancer.Balance(topic, b.Services)
+	b.pruneBalancers()
+	logx.Infof("topic:%s balancer:%s, services:%+v", topic, balancer.Name(), bb.ServiceList)
+}
+
+// SetTopicBalancer 根据注册的名字给topic 指定负载算法, name 为空表示恢复成默认的负载算法
+func (b *Balance) SetTopicBalancer(topic string, name string) error {
+	if name == "" {
+		b.UpdateTopicBalancer(topic, nil)
+		return nil
+	}
+	b.Lock()
+	balancer, ok := b.balancers[name]
+	b.Unlock()
+	if !ok {
+		var err error
+		if balancer, err = NewBalancer(name); err != nil {
+			return err
+		}
+	}
+	b.UpdateTopicBalancer(topic, balancer)
+	return nil
+}
 
+// TopicBalancerName 返回topic 单独指定的负载算法名字, 使用默认负载算法时返回空
+func (b *Balance) TopicBalancerName(topic string) string {
+	b.Lock()
+	defer b.Unlock()
+	bb, ok := b.TopicBalance[topic]
+	if !ok || !bb.explicit {
+		return ""
+	}
+	return bb.ServiceBalancer.Name()
+}
+
+// 同名的负载算法只保留一个实例, 新的实例需要用当前的Services 初始化
+func (b *Balance) addBalancer(balancer ServiceBalancer) ServiceBalancer {
+	old, ok := b.balancers[balancer.Name()]
+	if ok && old == balancer {
+		return old
+	}
+	balancer.Init(b.Services)
+	b.balancers[balancer.Name()] = balancer
+	if ok {
+		//替换同名的旧实例, 使用旧实例的topic 也换成新实例
+		if b.DefaultBalancer == old {
+			b.DefaultBalancer = balancer
+		}
+		for topic, bb := range b.TopicBalance {
+			if bb.ServiceBalancer == old {
+				bb.ServiceBalancer = balancer
+				bb.ServiceList = balancer.Balance(topic, b.Services)
+			}
+		}
+	}
+	return balancer
+}
+
+// DefaultRing 返回默认负载算法的hash 环, 默认负载算法没有实现RingExporter 时ok 为false
+func (b *Balance) DefaultRing() (ring hash.Ring, ok bool, err error) {
+	b.Lock()
+	defer b.Unlock()
+	exporter, ok := b.DefaultBalancer.(RingExporter)
+	if !ok {
+		return hash.Ring{}, false, nil
+	}
+	ring, err = exporter.Ring()
+	return ring, true, err
+}
+
+// DefaultBalancerName 返回默认负载算法的名字
+func (b *Balance) DefaultBalancerName() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.DefaultBalancer.Name()
 }
 
 func (b *Balance) UpdateDefaultBalancer(balancer ServiceBalancer) {
 	b.Lock()
 	defer b.Unlock()
 	oldDefaultBalancer := b.DefaultBalancer
-	b.DefaultBalancer = balancer
+	b.DefaultBalancer = b.addBalancer(balancer)
 	for topic, bb := range b.TopicBalance {
-		//如何缓存里的负载算法是旧的oldDefaultBalancer, 那么就更新负载算法，并重新计算结果。
-		//如果不是，那么就是特别对该topic指定的负载器，不需要重新计算结果，保持原样
-		if bb.ServiceBalancer == oldDefaultBalancer {
+		//没有单独指定负载算法的topic, 换成新的默认负载算法，并重新计算结果。
+		//单独指定的负载器(即使和旧的默认负载算法是同一个实例)，不需要重新计算结果，保持原样
+		if !bb.explicit && bb.ServiceBalancer == oldDefaultBalancer {
+			if oldDefaultBalancer != b.DefaultBalancer {
+				removeBalancerTopic(oldDefaultBalancer, topic)
+			}
 			bb.ServiceBalancer = b.DefaultBalancer
 			//根据最新的 Services 和 原来缓存的 ServiceBalancer 来重新计算结果
 			bb.ServiceList = bb.ServiceBalancer.Balance(topic, b.Services)
 		}
 	}
+	b.pruneBalancers()
 }
 
-func (b *Balance) GetServiceByTopic(topic string) []ServiceInfo {
-	bb := b.GetBalanceResult(topic)
-	if bb == nil {
-		return nil
+// Reset 丢弃负载算法实例里的状态(比如least_topics 的计数)和缓存的结果, 换成同名的新实例重新开始,
+// 单独给topic 指定的负载算法保留, 按topic 排序重新计算。没有注册的实例(不能用NewBalancer 创建)保持原样
+func (b *Balance) Reset() {
+	b.Lock()
+	defer b.Unlock()
+	fresh := make(map[string]ServiceBalancer, len(b.balancers))
+	for name, old := range b.balancers {
+		balancer, err := NewBalancer(name)
+		if err != nil {
+			balancer = old
+		}
+		balancer.Init(b.Services)
+		fresh[name] = balancer
+	}
+	b.balancers = fresh
+	b.DefaultBalancer = fresh[b.DefaultBalancer.Name()]
+	var explicit []string
+	for topic, bb := range b.TopicBalance {
+		if !bb.explicit {
+			delete(b.TopicBalance, topic)
+			continue
+		}
+		explicit = append(explicit, topic)
+	}
+	sort.Strings(explicit)
+	for _, topic := range explicit {
+		bb := b.TopicBalance[topic]
+		bb.ServiceBalancer = fresh[bb.ServiceBalancer.Name()]
+		bb.ServiceList = bb.ServiceBalancer.Balance(topic, b.Services)
 	}
-	return bb.ServiceList
 }
 
-// 根据topic获取对应的负载算法以及结果
+// RemoveTopic topic 不再分配了, 删除缓存的结果和单独指定的负载算法, 并通知负载算法
+func (b *Balance) RemoveTopic(topic string) {
+	b.Lock()
+	defer b.Unlock()
+	b.removeTopic(topic)
+	b.pruneBalancers()
+}
+
+// RetainTopics 删除不在topics 里, 也没有单独指定负载算法的topic 的缓存结果, 并通知负载算法。
+// 单独指定的负载算法保留, topic 以后加回来时还用它
+func (b *Balance) RetainTopics(topics []string) {
+	keep := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		keep[topic] = true
+	}
+	b.Lock()
+	defer b.Unlock()
+	for topic, bb := range b.TopicBalance {
+		if !keep[topic] && !bb.explicit {
+			b.removeTopic(topic)
+		}
+	}
+	b.pruneBalancers()
+}
+
+func (b *Balance) removeTopic(topic string) {
+	if _, ok := b.TopicBalance[topic]; !ok {
+		return
+	}
+	delete(b.TopicBalance, topic)
+	for _, balancer := range b.balancers {
+		removeBalancerTopic(balancer, topic)
+	}
+}
+
+// pruneBalancers 删除默认负载算法和所有topic 都不用的实例, 丢掉它保存的状态(比如least_topics 的计数),
+// 以后再指定这个负载算法时创建新的实例。调用方持有锁
+func (b *Balance) pruneBalancers() {
+	used := map[string]bool{b.DefaultBalancer.Name(): true}
+	for _, bb := range b.TopicBalance {
+		used[bb.ServiceBalancer.Name()] = true
+	}
+	for name := range b.balancers {
+		if !used[name] {
+			delete(b.balancers, name)
+		}
+	}
+}
+
+func removeBalancerTopic(balancer ServiceBalancer, topic string) {
+	if remover, ok := balancer.(TopicRemover); ok {
+		remover.RemoveTopic(topic)
+	}
+}
+
+// GetServiceByTopic 返回topic 分配的service, 是在锁里复制的, 负载算法更新缓存的结果时不影响调用方
+func (b *Balance) GetServiceByTopic(topic string) []ServiceInfo {
+	b.Lock()
+	defer b.Unlock()
+	return append([]ServiceInfo(nil), b.balanceResult(topic).ServiceList...)
+}
+
+// 根据topic获取对应的负载算法以及结果。返回的是缓存, 更新Services 或者负载算法时会在锁里修改它,
+// 只需要service 列表时用GetServiceByTopic
 func (b *Balance) GetBalanceResult(topic string) *ServiceBalanceResult {
 	b.Lock()
 	defer b.Unlock()
+	return b.balanceResult(topic)
+}
+
+// balanceResult 调用方持有锁
+func (b *Balance) balanceResult(topic string) *ServiceBalanceResult {
 	//先从缓存中获取
 	if bb, ok := b.TopicBalance[topic]; ok {
 		return bb
@@ -0,0 +1,138 @@
+package topicservice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 总是选择最后一个service
+type lastBalancer struct {
+	inits int
+}
+
+func (l *lastBalancer) Init(services []ServiceInfo) { l.inits++ }
+func (l *lastBalancer) Name() string                { return "last" }
+func (l *lastBalancer) Desc() string                { return "always pick the last service" }
+func (l *lastBalancer) Balance(topic string, services []ServiceInfo) []ServiceInfo {
+	if len(services) == 0 {
+		return nil
+	}
+	return services[len(services)-1:]
+}
+
+func testServices(ids ...string) []ServiceInfo {
+	services := make([]ServiceInfo, 0, len(ids))
+	for _, id := range ids {
+		services = append(services, ServiceInfo{Name: "s", Id: id})
+	}
+	return services
+}
+
+func TestBalanceUpdateTopicBalancer(t *testing.T) {
+	RegisterBalancer("last", func() ServiceBalancer { return &lastBalancer{} })
+	b := NewBalance(newConsistentHash())
+	b.UpdateServices(testServices("1", "2", "3"))
+
+	assert.Equal(t, "", b.TopicBalancerName("topic1"))
+	assert.Len(t, b.GetServiceByTopic("topic1"), 1)
+
+	assert.Nil(t, b.SetTopicBalancer("topic1", "last"))
+	assert.Equal(t, "last", b.TopicBalancerName("topic1"))
+	assert.Equal(t, "3", b.GetServiceByTopic("topic1")[0].Id)
+
+	// service list 变化后, topic 指定的负载算法也要重新计算
+	b.UpdateServices(testServices("1", "2", "3", "4"))
+	assert.Equal(t, "4", b.GetServiceByTopic("topic1")[0].Id)
+	assert.Equal(t, 2, b.balancers["last"].(*lastBalancer).inits)
+
+	assert.NotNil(t, b.SetTopicBalancer("topic1", "not_exist"))
+
+	assert.Nil(t, b.SetTopicBalancer("topic1", ""))
+	assert.Equal(t, "", b.TopicBalancerName("topic1"))
+}
+
+func TestBalanceExplicitDefaultBalancer(t *testing.T) {
+	b := NewBalance(newConsistentHash())
+	b.UpdateServices(testServices("1", "2", "3"))
+
+	// 单独指定了和默认负载算法同名的负载算法, 默认负载算法换了也不变
+	assert.Nil(t, b.SetTopicBalancer("topic1", ConsistentHashBalancer))
+	assert.Equal(t, ConsistentHashBalancer, b.TopicBalancerName("topic1"))
+	b.GetServiceByTopic("topic2")
+
+	// 同名的新实例替换默认负载算法, 指定的名字还在
+	b.UpdateDefaultBalancer(newConsistentHash())
+	assert.Equal(t, ConsistentHashBalancer, b.TopicBalancerName("topic1"))
+	assert.Equal(t, "", b.TopicBalancerName("topic2"))
+
+	// 换成别的默认负载算法, 没有指定的topic 跟着换, 指定的不变
+	b.UpdateDefaultBalancer(&lastBalancer{})
+	assert.Equal(t, ConsistentHashBalancer, b.TopicBalancerName("topic1"))
+	assert.Equal(t, "", b.TopicBalancerName("topic2"))
+	assert.Equal(t, "3", b.GetServiceByTopic("topic2")[0].Id)
+	assert.Equal(t, ConsistentHashBalancer, b.GetBalanceResult("topic1").Name())
+}
+
+func TestBalanceGetServiceByTopicCopy(t *testing.T) {
+	b := NewBalance(newConsistentHash())
+	b.UpdateServices(testServices("1", "2"))
+	services := b.GetServiceByTopic("topic1")
+	assert.Len(t, services, 1)
+	want := services[0]
+
+	// 返回的是复制的, 修改它或者服务列表更新都不会互相影响
+	services[0] = ServiceInfo{Name: "s", Id: "x"}
+	assert.Equal(t, []ServiceInfo{want}, b.GetServiceByTopic("topic1"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.UpdateServices(testServices("1", "2", "3"))
+	}()
+	_ = b.GetServiceByTopic("topic1")
+	<-done
+}
+
+func TestBalancePruneBalancers(t *testing.T) {
+	b := NewBalance(newConsistentHash())
+	b.UpdateServices(testServices("1", "2"))
+
+	assert.Nil(t, b.SetTopicBalancer("topic1", LeastTopicsBalancer))
+	assert.Nil(t, b.SetTopicBalancer("topic2", LeastTopicsBalancer))
+	least := b.balancers[LeastTopicsBalancer].(*leastTopicsBalancer)
+	assert.Len(t, least.assigned, 2)
+
+	// topic1 恢复成默认的负载算法, least_topics 里topic1 的计数也要删掉
+	assert.Nil(t, b.SetTopicBalancer("topic1", ""))
+	assert.Equal(t, map[string]string{"topic2": least.assigned["topic2"]}, least.assigned)
+
+	// 没有topic 用least_topics 了, 实例删掉, 再指定时是新的实例
+	b.RemoveTopic("topic2")
+	assert.NotContains(t, b.balancers, LeastTopicsBalancer)
+	assert.Nil(t, b.SetTopicBalancer("topic3", LeastTopicsBalancer))
+	assert.NotSame(t, least, b.balancers[LeastTopicsBalancer])
+	assert.Len(t, b.balancers[LeastTopicsBalancer].(*leastTopicsBalancer).assigned, 1)
+
+	// 默认负载算法换掉后, 旧的默认负载算法没有topic 用了也删掉
+	b.GetServiceByTopic("topic4")
+	b.UpdateDefaultBalancer(&lastBalancer{})
+	assert.NotContains(t, b.balancers, ConsistentHashBalancer)
+	assert.Equal(t, "2", b.GetServiceByTopic("topic4")[0].Id)
+
+	// 单独指定的topic 不会被RetainTopics 删掉, 恢复成默认的以后才删掉, 只剩默认负载算法
+	b.RetainTopics(nil)
+	assert.Contains(t, b.balancers, LeastTopicsBalancer) //topic3 单独指定的保留
+	assert.Nil(t, b.SetTopicBalancer("topic3", ""))
+	b.RetainTopics(nil)
+	assert.Equal(t, []string{"last"}, balancerNames(b))
+}
+
+func balancerNames(b *Balance) []string {
+	b.Lock()
+	defer b.Unlock()
+	var names []string
+	for name := range b.balancers {
+		names = append(names, name)
+	}
+	return names
+}
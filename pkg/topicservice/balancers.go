@@ -0,0 +1,327 @@
+package topicservice
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jursonmo/practise_new/pkg/hash"
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// 内置的负载算法, 都会在init 里注册, 可以在配置里用名字引用:
+//   - weighted_consistent_hash: 按ServiceConfig.Weight 加权的一致性hash
+//   - priority: 只在Priority 最高(数值最大)的一组service 里做一致性hash, 这组service 都不在了才用下一组
+//   - least_topics: 新的topic 分配给当前topic 数最少的service, 已经分配的topic 保持不变
+//   - replicated_N: 每个topic 返回N 个不同的service, 用于把热点topic 分散到多个broker
+//   - pinned_s1,s2: 把topic 固定在指定的service 上, 不用注册, 名字里带着service, 见PinnedBalancerName
+const (
+	WeightedConsistentHashBalancer = "weighted_consistent_hash"
+	PriorityBalancer               = "priority"
+	LeastTopicsBalancer            = "least_topics"
+	replicatedBalancerPrefix       = "replicated_"
+	pinnedBalancerPrefix           = "pinned_"
+	pinnedServiceSep               = ","
+)
+
+func init() {
+	RegisterBalancer(WeightedConsistentHashBalancer, func() ServiceBalancer { return NewWeightedConsistentHash() })
+	RegisterBalancer(PriorityBalancer, func() ServiceBalancer { return NewPriorityBalancer() })
+	RegisterBalancer(LeastTopicsBalancer, func() ServiceBalancer { return NewLeastTopicsBalancer() })
+	RegisterReplicatedBalancer(2)
+	RegisterReplicatedBalancer(3)
+}
+
+// 没有配置Weight 的service 按最大权重处理
+func serviceWeight(s ServiceInfo) int {
+	if s.Weight <= 0 {
+		return hash.TopWeight
+	}
+	return s.Weight
+}
+
+// weightedConsistentHash 按权重加权的一致性hash, 权重是1~100
+type weightedConsistentHash struct {
+	mu    sync.RWMutex
+	chash *hash.ConsistentHash
+}
+
+func NewWeightedConsistentHash() ServiceBalancer {
+	return &weightedConsistentHash{chash: hash.NewConsistentHash()}
+}
+
+func (h *weightedConsistentHash) Name() string {
+	return WeightedConsistentHashBalancer
+}
+func (h *weightedConsistentHash) Desc() string {
+	return "consistent hash weighted by service weight"
+}
+func (h *weightedConsistentHash) Init(services []ServiceInfo) {
+	// 权重可能变化, 所以每次都重建
+	chash := hash.NewConsistentHash()
+	for _, v := range services {
+		chash.AddWithWeight(v, serviceWeight(v))
+	}
+	h.mu.Lock()
+	h.chash = chash
+	h.mu.Unlock()
+}
+func (h *weightedConsistentHash) Balance(topic string, services []ServiceInfo) []ServiceInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	v, ok := h.chash.Get(topic)
+	if !ok {
+		return nil
+	}
+	return []ServiceInfo{v.(ServiceInfo)}
+}
+
+// priorityBalancer 按Priority 分组, 只用优先级最高的一组, 组内用一致性hash
+type priorityBalancer struct {
+	mu    sync.RWMutex
+	chash *hash.ConsistentHash
+	tier  int
+}
+
+func NewPriorityBalancer() ServiceBalancer {
+	return &priorityBalancer{chash: hash.NewConsistentHash()}
+}
+
+func (p *priorityBalancer) Name() string {
+	return PriorityBalancer
+}
+func (p *priorityBalancer) Desc() string {
+	return "consistent hash in the highest priority tier, failover to lower tier"
+}
+func (p *priorityBalancer) Init(services []ServiceInfo) {
+	chash := hash.NewConsistentHash()
+	tier := 0
+	if len(services) > 0 {
+		tier = services[0].Priority
+		for _, v := range services {
+			if v.Priority > tier {
+				tier = v.Priority
+			}
+		}
+		for _, v := range services {
+			if v.Priority == tier {
+				chash.AddWithWeight(v, serviceWeight(v))
+			}
+		}
+	}
+	p.mu.Lock()
+	if p.tier != tier {
+		logx.Infof("priority balancer use tier:%d", tier)
+	}
+	p.chash = chash
+	p.tier = tier
+	p.mu.Unlock()
+}
+func (p *priorityBalancer) Balance(topic string, services []ServiceInfo) []ServiceInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	v, ok := p.chash.Get(topic)
+	if !ok {
+		return nil
+	}
+	return []ServiceInfo{v.(ServiceInfo)}
+}
+
+// leastTopicsBalancer 新的topic 分配给topic 数最少的service,
+// 已经分配的topic 只要service 还在就保持不变; service 不在了, 它的topic 下次Balance 时重新分配。
+// 分配结果只保存在内存里, leader 切换后新leader 会重新分配。topic 删除后通过RemoveTopic 减掉计数。
+type leastTopicsBalancer struct {
+	mu       sync.Mutex
+	services map[string]ServiceInfo //key: service String()
+	assigned map[string]string      //key: topic, value: service String()
+	counts   map[string]int         //key: service String(), value: topic 数
+}
+
+func NewLeastTopicsBalancer() ServiceBalancer {
+	return &leastTopicsBalancer{
+		services: make(map[string]ServiceInfo),
+		assigned: make(map[string]string),
+		counts:   make(map[string]int),
+	}
+}
+
+func (l *leastTopicsBalancer) Name() string {
+	return LeastTopicsBalancer
+}
+func (l *leastTopicsBalancer) Desc() string {
+	return "assign new topic to the service with least topics"
+}
+func (l *leastTopicsBalancer) Init(services []ServiceInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.services = make(map[string]ServiceInfo, len(services))
+	for _, v := range services {
+		l.services[v.String()] = v
+	}
+	l.counts = make(map[string]int, len(services))
+	for topic, service := range l.assigned {
+		if _, ok := l.services[service]; !ok {
+			delete(l.assigned, topic)
+			continue
+		}
+		l.counts[service]++
+	}
+}
+func (l *leastTopicsBalancer) Balance(topic string, services []ServiceInfo) []ServiceInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if service, ok := l.assigned[topic]; ok {
+		return []ServiceInfo{l.services[service]}
+	}
+	if len(l.services) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(l.services))
+	for name := range l.services {
+		names = append(names, name)
+	}
+	// topic 数一样时按名字选, 保证结果是确定的
+	sort.Strings(names)
+	least := names[0]
+	for _, name := range names[1:] {
+		if l.counts[name] < l.counts[least] {
+			least = name
+		}
+	}
+	l.assigned[topic] = least
+	l.counts[least]++
+	return []ServiceInfo{l.services[least]}
+}
+
+func (l *leastTopicsBalancer) RemoveTopic(topic string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	service, ok := l.assigned[topic]
+	if !ok {
+		return
+	}
+	delete(l.assigned, topic)
+	if l.counts[service]--; l.counts[service] <= 0 {
+		delete(l.counts, service)
+	}
+}
+
+// replicatedBalancer 每个topic 返回n 个不同的service, 按 hash(topic+service) 排序(rendezvous hash),
+// service 增减时只影响选中它的topic。
+type replicatedBalancer struct {
+	n int
+}
+
+// ReplicatedBalancerName 返回每个topic 返回n 个service 的负载算法名字
+func ReplicatedBalancerName(n int) string {
+	return fmt.Sprintf("%s%d", replicatedBalancerPrefix, n)
+}
+
+// RegisterReplicatedBalancer 注册每个topic 返回n 个service 的负载算法, 默认已经注册了replicated_2 和 replicated_3
+func RegisterReplicatedBalancer(n int) {
+	RegisterBalancer(ReplicatedBalancerName(n), func() ServiceBalancer { return NewReplicatedBalancer(n) })
+}
+
+// parseReplicatedBalancer 没有注册的replicated_N 也可以用, 比如topic 目录里指定了副本数
+func parseReplicatedBalancer(name string) (ServiceBalancer, bool) {
+	if !strings.HasPrefix(name, replicatedBalancerPrefix) {
+		return nil, false
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(name, replicatedBalancerPrefix))
+	if err != nil || n < 1 {
+		return nil, false
+	}
+	return NewReplicatedBalancer(n), true
+}
+
+func NewReplicatedBalancer(n int) ServiceBalancer {
+	if n < 1 {
+		n = 1
+	}
+	return &replicatedBalancer{n: n}
+}
+
+func (r *replicatedBalancer) Name() string {
+	return ReplicatedBalancerName(r.n)
+}
+func (r *replicatedBalancer) Desc() string {
+	return fmt.Sprintf("assign each topic to %d distinct services", r.n)
+}
+func (r *replicatedBalancer) Init(services []ServiceInfo) {}
+func (r *replicatedBalancer) Balance(topic string, services []ServiceInfo) []ServiceInfo {
+	type scored struct {
+		score   uint64
+		service ServiceInfo
+	}
+	list := make([]scored, 0, len(services))
+	for _, v := range services {
+		list = append(list, scored{score: hash.Hash([]byte(topic + "/" + v.String())), service: v})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].score > list[j].score
+	})
+	n := r.n
+	if n > len(list) {
+		n = len(list)
+	}
+	result := make([]ServiceInfo, 0, n)
+	for _, v := range list[:n] {
+		result = append(result, v.service)
+	}
+	return result
+}
+
+// pinnedBalancer 把topic 固定在指定的service 上, 按指定的顺序返回还在的service,
+// 指定的service 都不在了, 就从所有service 里选一个, 避免topic 没有service。
+// 名字里带着service, 和分配结果一起写到etcd, leader 切换后新leader 能恢复。
+type pinnedBalancer struct {
+	services []string
+}
+
+// PinnedBalancerName 返回把topic 固定在services(ServiceInfo.String())上的负载算法名字
+func PinnedBalancerName(services ...string) string {
+	return pinnedBalancerPrefix + strings.Join(services, pinnedServiceSep)
+}
+
+// parsePinnedBalancer 名字是pinned_ 开头的负载算法不需要注册
+func parsePinnedBalancer(name string) (ServiceBalancer, bool) {
+	if !strings.HasPrefix(name, pinnedBalancerPrefix) {
+		return nil, false
+	}
+	var services []string
+	for _, v := range strings.Split(strings.TrimPrefix(name, pinnedBalancerPrefix), pinnedServiceSep) {
+		if v != "" {
+			services = append(services, v)
+		}
+	}
+	if len(services) == 0 {
+		return nil, false
+	}
+	return &pinnedBalancer{services: services}, true
+}
+
+func (p *pinnedBalancer) Name() string {
+	return PinnedBalancerName(p.services...)
+}
+func (p *pinnedBalancer) Desc() string {
+	return fmt.Sprintf("pin topic to services %v", p.services)
+}
+func (p *pinnedBalancer) Init(services []ServiceInfo) {}
+func (p *pinnedBalancer) Balance(topic string, services []ServiceInfo) []ServiceInfo {
+	alive := make(map[string]ServiceInfo, len(services))
+	for _, v := range services {
+		alive[v.String()] = v
+	}
+	var result []ServiceInfo
+	for _, name := range p.services {
+		if v, ok := alive[name]; ok {
+			result = append(result, v)
+		}
+	}
+	if len(result) == 0 {
+		return NewReplicatedBalancer(1).Balance(topic, services)
+	}
+	return result
+}
@@ -0,0 +1,138 @@
+package topicservice
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPriorityBalancer(t *testing.T) {
+	services := testServices("1", "2", "3")
+	services[1].Priority = 1
+	services[2].Priority = 1
+
+	b := NewPriorityBalancer()
+	b.Init(services)
+	for i := 0; i < 20; i++ {
+		ss := b.Balance(fmt.Sprintf("topic%d", i), services)
+		assert.Len(t, ss, 1)
+		assert.NotEqual(t, "1", ss[0].Id)
+	}
+
+	// 高优先级的都不在了, 用低优先级的
+	b.Init(services[:1])
+	assert.Equal(t, "1", b.Balance("topic1", services[:1])[0].Id)
+}
+
+func TestLeastTopicsBalancer(t *testing.T) {
+	services := testServices("1", "2")
+	b := NewLeastTopicsBalancer()
+	b.Init(services)
+
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		counts[b.Balance(fmt.Sprintf("topic%d", i), services)[0].Id]++
+	}
+	assert.Equal(t, map[string]int{"1": 5, "2": 5}, counts)
+
+	// 已经分配的topic 不变
+	first := b.Balance("topic0", services)[0].Id
+	services = testServices("1", "2", "3")
+	b.Init(services)
+	assert.Equal(t, first, b.Balance("topic0", services)[0].Id)
+	assert.Equal(t, "3", b.Balance("topic10", services)[0].Id)
+
+	// service 不在了, 它的topic 重新分配
+	services = testServices("1", "3")
+	b.Init(services)
+	for i := 0; i < 10; i++ {
+		assert.NotEqual(t, "2", b.Balance(fmt.Sprintf("topic%d", i), services)[0].Id)
+	}
+}
+
+func TestLeastTopicsBalancerRemoveTopic(t *testing.T) {
+	services := testServices("1", "2")
+	b := NewBalance(NewLeastTopicsBalancer())
+	b.UpdateServices(services)
+	for i := 0; i < 10; i++ {
+		b.GetServiceByTopic(fmt.Sprintf("topic%d", i))
+	}
+	least := b.DefaultBalancer.(*leastTopicsBalancer)
+	assert.Equal(t, map[string]int{"s-1": 5, "s-2": 5}, least.counts)
+
+	// 删除的topic 不再计数, 新topic 分配给topic 少的service
+	b.RetainTopics([]string{"topic0", "topic2", "topic4", "topic6", "topic8", "topic1"})
+	assert.Len(t, least.assigned, 6)
+	assert.Equal(t, 6, least.counts["s-1"]+least.counts["s-2"])
+	counts := map[string]int{"s-1": least.counts["s-1"], "s-2": least.counts["s-2"]}
+	for i := 10; i < 14; i++ {
+		counts[b.GetServiceByTopic(fmt.Sprintf("topic%d", i))[0].String()]++
+	}
+	assert.Equal(t, map[string]int{"s-1": 5, "s-2": 5}, counts)
+
+	b.RemoveTopic("topic0")
+	assert.NotContains(t, least.assigned, "topic0")
+	assert.NotContains(t, b.TopicBalance, "topic0")
+}
+
+func TestReplicatedBalancer(t *testing.T) {
+	services := testServices("1", "2", "3", "4")
+	b, err := NewBalancer(ReplicatedBalancerName(3))
+	assert.Nil(t, err)
+	b.Init(services)
+
+	before := make(map[string][]ServiceInfo)
+	for i := 0; i < 50; i++ {
+		topic := fmt.Sprintf("topic%d", i)
+		ss := b.Balance(topic, services)
+		assert.Len(t, ss, 3)
+		ids := map[string]struct{}{}
+		for _, s := range ss {
+			ids[s.Id] = struct{}{}
+		}
+		assert.Len(t, ids, 3)
+		before[topic] = ss
+	}
+
+	// 删除一个service, 没有选中它的topic 结果不变
+	services = testServices("1", "2", "3")
+	for topic, ss := range before {
+		removed := false
+		for _, s := range ss {
+			if s.Id == "4" {
+				removed = true
+			}
+		}
+		if !removed {
+			assert.Equal(t, ss, b.Balance(topic, services))
+		}
+	}
+	assert.Len(t, NewReplicatedBalancer(5).Balance("topic", services), 3)
+}
+
+func TestPinnedBalancer(t *testing.T) {
+	services := testServices("1", "2", "3")
+	name := PinnedBalancerName(services[2].String(), services[0].String())
+	b, err := NewBalancer(name)
+	assert.Nil(t, err)
+	assert.Equal(t, name, b.Name())
+	assert.Equal(t, []ServiceInfo{services[2], services[0]}, b.Balance("topic1", services))
+
+	// 固定的service 不在了, 用剩下的; 都不在了, 从所有service 里选一个
+	assert.Equal(t, []ServiceInfo{services[0]}, b.Balance("topic1", services[:2]))
+	assert.Len(t, b.Balance("topic1", services[1:2]), 1)
+
+	_, err = NewBalancer(PinnedBalancerName())
+	assert.NotNil(t, err)
+}
+
+func TestParseReplicatedBalancer(t *testing.T) {
+	b, err := NewBalancer(ReplicatedBalancerName(5))
+	assert.Nil(t, err)
+	assert.Equal(t, "replicated_5", b.Name())
+	_, err = NewBalancer("replicated_x")
+	assert.NotNil(t, err)
+	_, err = NewBalancer("replicated_0")
+	assert.NotNil(t, err)
+}
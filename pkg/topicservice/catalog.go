@@ -0,0 +1,251 @@
+package topicservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// topic 目录: 运行时增删改topic, 不用重启broker 改SetTopics。
+//   - 每个topic 一个key: /ns/as/catalog/topic1, value 是TopicSpec(json)
+//   - 所有服务都watch /ns/as/catalog/, topic 目录变化后, leader 重新分配, 分配的topic 是SetTopics 的和目录里的并集
+//   - TopicSpec 可以指定topic 的负载算法和副本数, 没有指定负载算法时副本数大于1 用replicated_N
+//   - 需要etcd, gossip 发现模式下没有目录
+
+var (
+	ErrTopicExists   = errors.New("topic already exists in catalog")
+	ErrTopicNotFound = errors.New("topic not found in catalog")
+)
+
+// TopicSpec topic 目录里的一个topic
+type TopicSpec struct {
+	Name     string
+	Balancer string            `json:",omitempty"` // 负载算法的名字, 为空用默认的
+	Replicas int               `json:",omitempty"` // 每个topic 分配给几个service, Balancer 为空时有效
+	Metadata map[string]string `json:",omitempty"`
+}
+
+// BalancerName topic 实际使用的负载算法, 为空表示默认的
+func (t TopicSpec) BalancerName() string {
+	if t.Balancer != "" {
+		return t.Balancer
+	}
+	if t.Replicas > 1 {
+		return ReplicatedBalancerName(t.Replicas)
+	}
+	return ""
+}
+
+func (t TopicSpec) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("topic name is empty")
+	}
+	// 这些字符在etcd 的key 和分配结果里有特殊含义
+	if strings.ContainsAny(t.Name, "/:"+TopicsSep+TopicServiceSeq+TopicBalancerSep) {
+		return fmt.Errorf("invalid topic name:%q", t.Name)
+	}
+	if t.Replicas < 0 {
+		return fmt.Errorf("invalid replicas:%d", t.Replicas)
+	}
+	if name := t.BalancerName(); name != "" {
+		if _, err := NewBalancer(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Service) CatalogPath() string {
+	return fmt.Sprintf("/%s/%s/catalog", s.sc.Ns, s.sc.As)
+}
+
+func (s *Service) catalogKey(topic string) string {
+	return s.CatalogPath() + "/" + topic
+}
+
+func (s *Service) catalogClient() (*clientv3.Client, error) {
+	cli := s.getEtcdClient()
+	if cli == nil {
+		return nil, fmt.Errorf("topic catalog requires etcd discovery")
+	}
+	return cli, nil
+}
+
+func (s *Service) putCatalogTopic(ctx context.Context, spec TopicSpec, cmp clientv3.Cmp, failErr error) error {
+	if err := spec.validate(); err != nil {
+		return err
+	}
+	cli, err := s.catalogClient()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	resp, err := cli.Txn(ctx).If(cmp).Then(clientv3.OpPut(s.catalogKey(spec.Name), string(data))).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("%w: %s", failErr, spec.Name)
+	}
+	return nil
+}
+
+// CreateTopic 在topic 目录里添加topic, 已经存在时返回ErrTopicExists
+func (s *Service) CreateTopic(ctx context.Context, spec TopicSpec) error {
+	return s.putCatalogTopic(ctx, spec, clientv3.Compare(clientv3.CreateRevision(s.catalogKey(spec.Name)), "=", 0), ErrTopicExists)
+}
+
+// UpdateTopic 修改topic 目录里的topic, 不存在时返回ErrTopicNotFound
+func (s *Service) UpdateTopic(ctx context.Context, spec TopicSpec) error {
+	return s.putCatalogTopic(ctx, spec, clientv3.Compare(clientv3.CreateRevision(s.catalogKey(spec.Name)), ">", 0), ErrTopicNotFound)
+}
+
+// DeleteTopic 从topic 目录里删除topic, 不存在时返回ErrTopicNotFound。SetTopics 里的topic 不受影响
+func (s *Service) DeleteTopic(ctx context.Context, topic string) error {
+	cli, err := s.catalogClient()
+	if err != nil {
+		return err
+	}
+	resp, err := cli.Delete(ctx, s.catalogKey(topic))
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return fmt.Errorf("%w: %s", ErrTopicNotFound, topic)
+	}
+	return nil
+}
+
+// Catalog 返回watch 到的topic 目录
+func (s *Service) Catalog() map[string]TopicSpec {
+	s.Lock()
+	defer s.Unlock()
+	catalog := make(map[string]TopicSpec, len(s.catalog))
+	for topic, spec := range s.catalog {
+		catalog[topic] = spec
+	}
+	return catalog
+}
+
+// parseCatalog key 是 prefix+topic, 不合法的记录跳过
+func parseCatalog(prefix string, kvs map[string]string) map[string]TopicSpec {
+	catalog := make(map[string]TopicSpec, len(kvs))
+	for k, v := range kvs {
+		var spec TopicSpec
+		if err := json.Unmarshal([]byte(v), &spec); err != nil {
+			logx.Errorf("invalid catalog key:%s, value:%s, err:%v", k, v, err)
+			continue
+		}
+		spec.Name = strings.TrimPrefix(k, prefix)
+		if err := spec.validate(); err != nil {
+			logx.Errorf("invalid catalog key:%s, err:%v", k, err)
+			continue
+		}
+		catalog[spec.Name] = spec
+	}
+	return catalog
+}
+
+func (s *Service) startDiscovCatalog() error {
+	prefix := s.CatalogPath() + "/"
+	return WatchPrefix(s.ctx, s.getEtcdClient(), prefix, func(kvs map[string]string) {
+		s.updateCatalog(parseCatalog(prefix, kvs))
+	})
+}
+
+// updateCatalog 保存topic 目录, 更新topic 的负载算法, leader 重新分配
+func (s *Service) updateCatalog(catalog map[string]TopicSpec) {
+	s.Lock()
+	old := s.catalog
+	s.catalog = catalog
+	s.Unlock()
+
+	changed := len(old) != len(catalog)
+	for topic, spec := range catalog {
+		prev, ok := old[topic]
+		if !ok || prev.BalancerName() != spec.BalancerName() {
+			changed = true
+			s.setCatalogBalancer(topic, s.catalogBalancer(topic, prev), s.catalogBalancer(topic, spec))
+		}
+	}
+	for topic, prev := range old {
+		if _, ok := catalog[topic]; !ok {
+			s.removeCatalogTopic(topic, s.catalogBalancer(topic, prev))
+		}
+	}
+	if !changed {
+		return
+	}
+	logx.Infof("%s topic catalog changed, len:%d", s.Key(), len(catalog))
+	if s.IsLeader() {
+		s.assignTopics()
+	}
+}
+
+// catalogBalancer 目录里的topic 应该用的负载算法, 目录里没有指定时用配置里给topic 指定的。
+// spec 是空的(目录里还没有这个topic)时就是配置里的
+func (s *Service) catalogBalancer(topic string, spec TopicSpec) string {
+	if name := spec.BalancerName(); name != "" {
+		return name
+	}
+	return s.sc.TopicBalancers[topic]
+}
+
+// setCatalogBalancer prev 是目录之前设置的负载算法, 当前的不是prev 说明是管理接口(PinTopic 等)设置的, 不覆盖
+func (s *Service) setCatalogBalancer(topic, prev, name string) {
+	cur := s.balance.TopicBalancerName(topic)
+	if cur == name {
+		return
+	}
+	if cur != prev {
+		logx.Infof("topic:%s balancer:%s is not set by catalog, keep it, catalog balancer:%s", topic, cur, name)
+		return
+	}
+	if err := s.balance.SetTopicBalancer(topic, name); err != nil {
+		logx.Errorf("set catalog topic:%s balancer:%s err:%v", topic, name, err)
+	}
+}
+
+// removeCatalogTopic topic 从目录里删除了, 恢复成配置里的负载算法; 不是SetTopics 里的topic, 也没有别的负载算法时,
+// 删除缓存的分配结果, 负载算法(比如least_topics)不再计算这个topic
+func (s *Service) removeCatalogTopic(topic, prev string) {
+	name := s.sc.TopicBalancers[topic]
+	s.setCatalogBalancer(topic, prev, name)
+	if name != "" || s.isStaticTopic(topic) || s.balance.TopicBalancerName(topic) != "" {
+		return
+	}
+	s.balance.RemoveTopic(topic)
+}
+
+// isStaticTopic topic 是否是SetTopics 设置的
+func (s *Service) isStaticTopic(topic string) bool {
+	s.Lock()
+	defer s.Unlock()
+	for _, v := range s.topics {
+		if v == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// catalogTopics 目录里的topic, 排序后返回
+func (s *Service) catalogTopics() []string {
+	s.Lock()
+	defer s.Unlock()
+	topics := make([]string, 0, len(s.catalog))
+	for topic := range s.catalog {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
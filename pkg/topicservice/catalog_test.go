@@ -0,0 +1,84 @@
+package topicservice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zeromicro/go-zero/core/discov"
+)
+
+func TestTopicSpec(t *testing.T) {
+	assert.Equal(t, "", TopicSpec{Name: "t"}.BalancerName())
+	assert.Equal(t, "replicated_4", TopicSpec{Name: "t", Replicas: 4}.BalancerName())
+	assert.Equal(t, PriorityBalancer, TopicSpec{Name: "t", Balancer: PriorityBalancer, Replicas: 4}.BalancerName())
+
+	assert.Nil(t, TopicSpec{Name: "t", Replicas: 4}.validate())
+	assert.NotNil(t, TopicSpec{}.validate())
+	assert.NotNil(t, TopicSpec{Name: "a/b"}.validate())
+	assert.NotNil(t, TopicSpec{Name: "a|b"}.validate())
+	assert.NotNil(t, TopicSpec{Name: "t", Replicas: -1}.validate())
+	assert.NotNil(t, TopicSpec{Name: "t", Balancer: "not_exist"}.validate())
+}
+
+func TestParseCatalog(t *testing.T) {
+	prefix := "/ns/as/catalog/"
+	catalog := parseCatalog(prefix, map[string]string{
+		prefix + "topic1": `{"Replicas":2,"Metadata":{"owner":"x"}}`,
+		prefix + "topic2": `{}`,
+		prefix + "topic3": `not json`,
+		prefix + "topic4": `{"Balancer":"not_exist"}`,
+	})
+	assert.Equal(t, map[string]TopicSpec{
+		"topic1": {Name: "topic1", Replicas: 2, Metadata: map[string]string{"owner": "x"}},
+		"topic2": {Name: "topic2"},
+	}, catalog)
+}
+
+func TestServiceUpdateCatalog(t *testing.T) {
+	s, err := NewService(&ServiceConfig{
+		Name:           "topic_service",
+		Id:             "1",
+		Etcd:           discov.EtcdConf{Hosts: []string{"127.0.0.1:2379"}, Key: "services"},
+		TopicBalancers: map[string]string{"topic3": PriorityBalancer},
+	})
+	assert.Nil(t, err)
+	s.SetTopics([]string{"topic1", "topic2"})
+
+	s.updateCatalog(map[string]TopicSpec{
+		"topic2": {Name: "topic2"},
+		"topic3": {Name: "topic3", Replicas: 3},
+	})
+	assert.Equal(t, []string{"topic1", "topic2", "topic3"}, s.GetTopics())
+	assert.Equal(t, "replicated_3", s.balance.TopicBalancerName("topic3"))
+	assert.Equal(t, "", s.balance.TopicBalancerName("topic2"))
+
+	// 删除后恢复配置里的负载算法
+	s.updateCatalog(map[string]TopicSpec{})
+	assert.Equal(t, []string{"topic1", "topic2"}, s.GetTopics())
+	assert.Equal(t, PriorityBalancer, s.balance.TopicBalancerName("topic3"))
+	assert.Empty(t, s.Catalog())
+
+	// 删除的topic 不再缓存分配结果, SetTopics 里的保留
+	s.updateCatalog(map[string]TopicSpec{"topic2": {Name: "topic2"}, "topic4": {Name: "topic4"}})
+	s.balance.GetServiceByTopic("topic2")
+	s.balance.GetServiceByTopic("topic4")
+	s.updateCatalog(map[string]TopicSpec{})
+	assert.NotContains(t, s.balance.TopicBalance, "topic4")
+	assert.Contains(t, s.balance.TopicBalance, "topic2")
+
+	// 管理接口固定的topic, 目录修改和删除都不覆盖
+	pinned := PinnedBalancerName("topic_service-1")
+	assert.Nil(t, s.balance.SetTopicBalancer("topic5", pinned))
+	s.updateCatalog(map[string]TopicSpec{"topic5": {Name: "topic5", Replicas: 2}})
+	assert.Equal(t, pinned, s.balance.TopicBalancerName("topic5"))
+	s.updateCatalog(map[string]TopicSpec{})
+	assert.Equal(t, pinned, s.balance.TopicBalancerName("topic5"))
+
+	// 目录设置的负载算法, 修改后跟着变
+	s.updateCatalog(map[string]TopicSpec{"topic6": {Name: "topic6", Replicas: 2}})
+	s.updateCatalog(map[string]TopicSpec{"topic6": {Name: "topic6", Balancer: PriorityBalancer}})
+	assert.Equal(t, PriorityBalancer, s.balance.TopicBalancerName("topic6"))
+	s.updateCatalog(map[string]TopicSpec{})
+	assert.Equal(t, "", s.balance.TopicBalancerName("topic6"))
+	assert.NotContains(t, s.balance.TopicBalance, "topic6")
+}
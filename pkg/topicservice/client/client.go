@@ -0,0 +1,259 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jursonmo/practise_new/pkg/hash"
+	"github.com/jursonmo/practise_new/pkg/topicservice"
+	"github.com/zeromicro/go-zero/core/discov"
+	"github.com/zeromicro/go-zero/core/logx"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// 客户端SDK: 只读地watch /ns/as/services 和 /ns/as/topics, 不注册自己,
+// 缓存leader 推荐的 topic-->services 对应关系, 客户端发送或者订阅某个topic 时, 优先连接推荐的service。
+// 推荐的service 连不上时, 可以按顺序使用Fallbacks 里的其他service。
+
+var ErrNoService = errors.New("no service available")
+
+type Config struct {
+	Ns   string          `json:",optional"`
+	As   string          `json:",optional"`
+	Etcd discov.EtcdConf // Etcd.Key 是服务注册的key, 跟ServiceConfig.Etcd.Key 一样, 默认services
+}
+
+// Resolution 一个topic 的推荐结果
+type Resolution struct {
+	Topic     string
+	Services  []string //推荐的service, ServiceInfo.String()
+	Endpoints []string //推荐的service 的endpoints
+	Fallbacks []string //其他service 的endpoints, 推荐的service 都连不上时按顺序使用
+}
+
+// TopicChange topic 推荐的service 发生了变化, From 为空表示新的topic, To 为空表示topic 被删除
+type TopicChange struct {
+	Topic string
+	From  []string
+	To    []string
+}
+
+type TopicChangeHandler func(change TopicChange)
+
+type Client struct {
+	conf       Config
+	etcdClient *clientv3.Client
+	cancel     context.CancelFunc
+
+	mu       sync.RWMutex
+	services map[string]topicservice.ServiceInfo //key: ServiceInfo.String()
+	topics   map[string][]string                 //key: topic, value: 推荐的service
+	handlers []TopicChangeHandler
+}
+
+func New(conf Config) (*Client, error) {
+	if len(conf.Etcd.Hosts) == 0 {
+		return nil, fmt.Errorf("etcd hosts is empty")
+	}
+	if conf.Ns == "" {
+		conf.Ns = "ns"
+	}
+	if conf.As == "" {
+		conf.As = "as"
+	}
+	if conf.Etcd.Key == "" {
+		conf.Etcd.Key = "services"
+	}
+	return &Client{
+		conf:     conf,
+		services: make(map[string]topicservice.ServiceInfo),
+		topics:   make(map[string][]string),
+	}, nil
+}
+
+func (c *Client) servicesPath() string {
+	return fmt.Sprintf("/%s/%s/%s/", c.conf.Ns, c.conf.As, c.conf.Etcd.Key)
+}
+
+func (c *Client) topicsPath() string {
+	return fmt.Sprintf("/%s/%s/topics/", c.conf.Ns, c.conf.As)
+}
+
+func (c *Client) Start(ctx context.Context) error {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   c.conf.Etcd.Hosts,
+		Username:    c.conf.Etcd.User,
+		Password:    c.conf.Etcd.Pass,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+	c.etcdClient = cli
+	ctx, c.cancel = context.WithCancel(ctx)
+
+	if err := topicservice.WatchPrefix(ctx, cli, c.servicesPath(), c.updateServices); err != nil {
+		c.Stop()
+		return err
+	}
+	if err := topicservice.WatchPrefix(ctx, cli, c.topicsPath(), c.updateTopics); err != nil {
+		c.Stop()
+		return err
+	}
+	return nil
+}
+
+func (c *Client) Stop() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	if c.etcdClient != nil {
+		c.etcdClient.Close()
+	}
+}
+
+// OnTopicChange 注册topic 推荐的service 变化的回调, 客户端可以据此重新连接
+func (c *Client) OnTopicChange(fn TopicChangeHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers = append(c.handlers, fn)
+}
+
+func (c *Client) updateServices(kvs map[string]string) {
+	services := make(map[string]topicservice.ServiceInfo, len(kvs))
+	for _, v := range kvs {
+		var sc topicservice.ServiceInfo
+		if err := json.Unmarshal([]byte(v), &sc); err != nil {
+			logx.Errorf("invalid service:%s, err:%v", v, err)
+			continue
+		}
+		services[sc.String()] = sc
+	}
+	c.mu.Lock()
+	c.services = services
+	c.mu.Unlock()
+}
+
+func (c *Client) updateTopics(kvs map[string]string) {
+	vals := make([]string, 0, len(kvs))
+	for _, v := range kvs {
+		vals = append(vals, v)
+	}
+	distributed, _ := topicservice.ParseTopicValues(vals)
+	topics := make(map[string][]string, len(distributed))
+	for topic, ss := range distributed {
+		if ss == "" {
+			topics[topic] = nil
+			continue
+		}
+		topics[topic] = strings.Split(ss, topicservice.TopicServiceSeq)
+	}
+
+	c.mu.Lock()
+	old := c.topics
+	c.topics = topics
+	handlers := append([]TopicChangeHandler(nil), c.handlers...)
+	c.mu.Unlock()
+
+	changes := diffTopics(old, topics)
+	for _, change := range changes {
+		logx.Infof("topic:%s moved from %v to %v", change.Topic, change.From, change.To)
+		for _, fn := range handlers {
+			fn(change)
+		}
+	}
+}
+
+func diffTopics(old, new map[string][]string) []TopicChange {
+	var changes []TopicChange
+	for topic, to := range new {
+		from, ok := old[topic]
+		if ok && strings.Join(from, topicservice.TopicServiceSeq) == strings.Join(to, topicservice.TopicServiceSeq) {
+			continue
+		}
+		changes = append(changes, TopicChange{Topic: topic, From: from, To: to})
+	}
+	for topic, from := range old {
+		if _, ok := new[topic]; !ok {
+			changes = append(changes, TopicChange{Topic: topic, From: from})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Topic < changes[j].Topic
+	})
+	return changes
+}
+
+// Resolve 返回topic 推荐的service 和endpoints, 以及备用的endpoints。
+// topic 没有分配或者推荐的service 都不在了, 从所有service 里按 hash(topic+service) 选, 保证同一个topic 选到同样的service。
+func (c *Client) Resolve(topic string) (Resolution, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.services) == 0 {
+		return Resolution{}, ErrNoService
+	}
+
+	res := Resolution{Topic: topic}
+	recommended := make(map[string]bool)
+	for _, name := range c.topics[topic] {
+		sc, ok := c.services[name]
+		if !ok {
+			continue
+		}
+		recommended[name] = true
+		res.Services = append(res.Services, name)
+		res.Endpoints = append(res.Endpoints, sc.Endpoints...)
+	}
+
+	others := make([]string, 0, len(c.services))
+	for name := range c.services {
+		if !recommended[name] {
+			others = append(others, name)
+		}
+	}
+	scores := make(map[string]uint64, len(others))
+	for _, name := range others {
+		scores[name] = hash.Hash([]byte(topic + "/" + name))
+	}
+	sort.Slice(others, func(i, j int) bool {
+		return scores[others[i]] > scores[others[j]]
+	})
+	for _, name := range others {
+		res.Fallbacks = append(res.Fallbacks, c.services[name].Endpoints...)
+	}
+
+	if len(res.Endpoints) == 0 {
+		if len(res.Fallbacks) == 0 {
+			return res, ErrNoService
+		}
+		// 没有推荐的service, 用第一个备用的
+		res.Endpoints, res.Fallbacks = []string{res.Fallbacks[0]}, res.Fallbacks[1:]
+	}
+	return res, nil
+}
+
+// GetEndpoints 返回topic 推荐的endpoints, 后面跟着备用的endpoints
+func (c *Client) GetEndpoints(topic string) ([]string, error) {
+	res, err := c.Resolve(topic)
+	if err != nil {
+		return nil, err
+	}
+	return append(res.Endpoints, res.Fallbacks...), nil
+}
+
+// Topics 返回当前所有的 topic-->推荐的service
+func (c *Client) Topics() map[string][]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	topics := make(map[string][]string, len(c.topics))
+	for topic, services := range c.topics {
+		topics[topic] = append([]string(nil), services...)
+	}
+	return topics
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jursonmo/practise_new/pkg/topicservice"
+	"github.com/stretchr/testify/assert"
+	"github.com/zeromicro/go-zero/core/discov"
+)
+
+func newTestClient(t *testing.T) *Client {
+	c, err := New(Config{Etcd: discov.EtcdConf{Hosts: []string{"127.0.0.1:2379"}}})
+	assert.Nil(t, err)
+	services := make(map[string]string)
+	for _, id := range []string{"1", "2", "3"} {
+		data, err := json.Marshal(topicservice.ServiceConfig{
+			Name:      "s",
+			Id:        id,
+			Endpoints: []string{"tcp://127.0.0.1:808" + id},
+		})
+		assert.Nil(t, err)
+		services["/ns/as/services/"+id] = string(data)
+	}
+	c.updateServices(services)
+	return c
+}
+
+func TestResolve(t *testing.T) {
+	c := newTestClient(t)
+	var changes []TopicChange
+	c.OnTopicChange(func(change TopicChange) {
+		changes = append(changes, change)
+	})
+
+	c.updateTopics(map[string]string{
+		"/ns/as/topics/s-1": "topic1:s-1|s-2;topic3:s-9",
+	})
+	assert.Len(t, changes, 2)
+
+	res, err := c.Resolve("topic1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"s-1", "s-2"}, res.Services)
+	assert.Equal(t, []string{"tcp://127.0.0.1:8081", "tcp://127.0.0.1:8082"}, res.Endpoints)
+	assert.Equal(t, []string{"tcp://127.0.0.1:8083"}, res.Fallbacks)
+
+	// 推荐的service 不在了, 使用备用的, 同一个topic 结果稳定
+	res, err = c.Resolve("topic3")
+	assert.Nil(t, err)
+	assert.Empty(t, res.Services)
+	assert.Len(t, res.Endpoints, 1)
+	assert.Len(t, res.Fallbacks, 2)
+	res2, _ := c.Resolve("topic3")
+	assert.Equal(t, res, res2)
+
+	changes = nil
+	c.updateTopics(map[string]string{
+		"/ns/as/topics/s-2": "topic1:s-2",
+	})
+	assert.Equal(t, []TopicChange{
+		{Topic: "topic1", From: []string{"s-1", "s-2"}, To: []string{"s-2"}},
+		{Topic: "topic3", From: []string{"s-9"}},
+	}, changes)
+
+	endpoints, err := c.GetEndpoints("topic1")
+	assert.Nil(t, err)
+	assert.Equal(t, "tcp://127.0.0.1:8082", endpoints[0])
+	assert.Len(t, endpoints, 3)
+}
+
+func TestResolveNoService(t *testing.T) {
+	c, err := New(Config{Etcd: discov.EtcdConf{Hosts: []string{"127.0.0.1:2379"}}})
+	assert.Nil(t, err)
+	_, err = c.Resolve("topic1")
+	assert.Equal(t, ErrNoService, err)
+}
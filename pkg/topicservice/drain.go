@@ -0,0 +1,176 @@
+package topicservice
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// 优雅下线(Drain), 在Stop 之前调用:
+//  1. 在注册信息里标记Draining(gossip 发现模式下是节点元数据), leader 分配topic 时跳过draining 的服务, 把它的topic 迁走
+//  2. 等分配结果里没有本服务, 客户端会按新的分配结果迁移到其他服务
+//  3. 等本服务上客户端的订阅(AddTopicState 添加的topic)变成0, 即客户端都走了。
+//     不看SubscriptionStore.LocalSubscriptions, gossip 模式下它包括SetTopics 的静态topic, 永远不会变成0
+//  4. 超时或者完成后注销, 其他服务不再把本服务当成候选
+
+const drainCheckInterval = time.Millisecond * 100
+
+// Draining 是否正在下线
+func (s *Service) Draining() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.draining
+}
+
+// activeServices 去掉draining 的服务。更新注册信息时新旧两个注册会短暂同时存在, 所以同一个服务只要有一个draining 就去掉;
+// 所有服务都在draining 时还是用全部, 避免topic 没有服务
+func activeServices(list []ServiceInfo) []ServiceInfo {
+	draining := make(map[string]bool)
+	for _, v := range list {
+		if v.Draining {
+			draining[v.String()] = true
+		}
+	}
+	if len(draining) == 0 {
+		return list
+	}
+	active := make([]ServiceInfo, 0, len(list))
+	seen := make(map[string]bool, len(list))
+	for _, v := range list {
+		if draining[v.String()] || seen[v.String()] {
+			continue
+		}
+		seen[v.String()] = true
+		active = append(active, v)
+	}
+	if len(active) == 0 {
+		return list
+	}
+	return active
+}
+
+// assignableServices 可以分配topic 的服务, 自己在draining 时, 不等注册信息更新就把自己去掉
+func (s *Service) assignableServices() []ServiceInfo {
+	list := activeServices(s.getServiceList())
+	if !s.Draining() {
+		return list
+	}
+	others := make([]ServiceInfo, 0, len(list))
+	for _, v := range list {
+		if v.String() != s.Key() {
+			others = append(others, v)
+		}
+	}
+	if len(others) == 0 {
+		return list
+	}
+	return others
+}
+
+// Drain 优雅下线, ctx 的deadline 是最多等多久, 超时也会注销, 返回ctx 的错误。之后调用Stop 退出
+func (s *Service) Drain(ctx context.Context) error {
+	s.Lock()
+	if s.draining {
+		s.Unlock()
+		return fmt.Errorf("%s is already draining", s.Key())
+	}
+	s.draining = true
+	s.Unlock()
+	logx.Infof("%s start draining", s.Key())
+
+	if err := s.markDraining(); err != nil {
+		return err
+	}
+	if s.IsLeader() {
+		// leader 自己下线, 直接重新分配, 不用等watch
+		s.assignTopics()
+	}
+
+	err := s.waitDrain(ctx, func() bool { return !s.assignedToSelf() })
+	if err == nil {
+		err = s.waitDrain(ctx, func() bool { return len(s.ClientTopics()) == 0 })
+	}
+	if err != nil {
+		logx.Errorf("%s drain not finished, err:%v", s.Key(), err)
+	}
+	s.deregister()
+	logx.Infof("%s drained", s.Key())
+	return err
+}
+
+// ClientTopics 本服务上客户端订阅的topic, 排序后返回
+func (s *Service) ClientTopics() []string {
+	s.Lock()
+	defer s.Unlock()
+	topics := make([]string, 0, len(s.clientTopics))
+	for topic := range s.clientTopics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// 在注册信息里标记draining: 先用新的值注册, 再注销旧的, 避免服务短暂消失导致topic 迁移两次
+func (s *Service) markDraining() error {
+	if s.gossipDiscovery() {
+		if err := s.topicState.UpdateMeta(func(meta *NodeMetadata) { meta.Draining = true }); err != nil {
+			logx.Errorf("update gossip meta err:%v", err)
+		}
+		s.updateGossipMembers()
+		return nil
+	}
+	sc := *s.sc
+	sc.Draining = true
+	pub, err := s.publish(sc)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	old := s.pubClient
+	s.pubClient = pub
+	s.Unlock()
+	if old != nil {
+		old.Stop()
+	}
+	return nil
+}
+
+// 分配结果里是否还有本服务
+func (s *Service) assignedToSelf() bool {
+	for _, services := range s.DistributedTopics() {
+		for _, v := range strings.Split(services, TopicServiceSeq) {
+			if v == s.Key() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Service) waitDrain(ctx context.Context, done func() bool) error {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for !done() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// 注销, 其他服务的服务列表里不再有本服务
+func (s *Service) deregister() {
+	s.Lock()
+	pub := s.pubClient
+	s.pubClient = nil
+	s.Unlock()
+	if pub != nil {
+		pub.Stop()
+	}
+}
@@ -0,0 +1,85 @@
+package topicservice
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActiveServices(t *testing.T) {
+	services := testServices("1", "2", "3")
+	assert.Equal(t, services, activeServices(services))
+
+	// 更新注册信息时同一个服务有新旧两个注册
+	draining := services[1]
+	draining.Draining = true
+	list := append(append([]ServiceInfo{}, services...), draining)
+	assert.Equal(t, []ServiceInfo{services[0], services[2]}, activeServices(list))
+
+	// 都在draining 时用全部
+	assert.Equal(t, []ServiceInfo{draining}, activeServices([]ServiceInfo{draining}))
+}
+
+func TestServiceDrain(t *testing.T) {
+	s1 := newGossipService(t, "1", nil)
+	s2 := newGossipService(t, "2", []string{s1.topicState.cluster.LocalNode().Address()})
+	assert.Eventually(t, func() bool {
+		return s1.assignedToSelf() && s2.assignedToSelf()
+	}, 5*time.Second, 10*time.Millisecond)
+	// 客户端订阅的topic, 静态topic 不算
+	s2.AddTopicState("client1")
+	s2.AddTopicState("client2")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s2.Drain(ctx) }()
+
+	// 两边都把s2 的topic 迁走
+	assert.Eventually(t, func() bool {
+		return !s2.assignedToSelf() && !strings.Contains(strings.Join(mapValues(s1.DistributedTopics()), ";"), s2.Key())
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, s2.Draining())
+	assert.NotNil(t, s2.Drain(ctx))
+
+	// 客户端都走了, 订阅变成0 后完成
+	select {
+	case <-done:
+		t.Fatal("drain finished before subscriptions left")
+	case <-time.After(200 * time.Millisecond):
+	}
+	s2.DelTopicState("client1")
+	select {
+	case <-done:
+		t.Fatal("drain finished before subscriptions left")
+	case <-time.After(200 * time.Millisecond):
+	}
+	s2.DelTopicState("client2")
+	assert.Empty(t, s2.ClientTopics())
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("drain not finished")
+	}
+}
+
+func TestServiceDrainTimeout(t *testing.T) {
+	s := newGossipService(t, "1", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	// 只有一个服务, topic 迁不走
+	assert.Equal(t, context.DeadlineExceeded, s.Drain(ctx))
+	assert.True(t, s.assignedToSelf())
+}
+
+func mapValues(m map[string]string) []string {
+	values := make([]string, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
@@ -0,0 +1,247 @@
+package topicservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// 基于etcd 的leader选举(concurrency.Election):
+//  1. 每个服务用带租约的session 在 /ns/as/leader 下竞选, 同一时刻只有一个服务能成为leader, 只有leader 才分配topic
+//  2. leader 挂了或者租约丢失(session.Done), 选举key 被etcd 删除, 其他竞选者自动接替
+//  3. 所有服务都watch /ns/as/leader, 感知leader 的变化, 并回调 OnLeaderChange 注册的函数
+//  4. 选举key 的value 是leader 的ServiceConfig(json, 去掉了密钥), 即leader 的身份发布在 /ns/as/leader 下
+
+const (
+	defaultElectionTTL = 10 // 选举session 租约的ttl, 单位秒
+	// 没有配置IsLeader 的服务延迟竞选, 让配置了IsLeader 的服务优先成为leader
+	electionDelay      = time.Second * 2
+	electionRetryDelay = time.Second
+)
+
+type LeaderChangeHandler func(leader ServiceConfig)
+
+func (s *Service) LeaderPath() string {
+	return fmt.Sprintf("/%s/%s/leader", s.sc.Ns, s.sc.As)
+}
+
+// OnLeaderChange 注册leader 变化的回调, leader 的身份来自 /ns/as/leader
+func (s *Service) OnLeaderChange(fn LeaderChangeHandler) {
+	s.Lock()
+	defer s.Unlock()
+	s.leaderHandlers = append(s.leaderHandlers, fn)
+}
+
+// Leader 返回当前观察到的leader
+func (s *Service) Leader() (ServiceConfig, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if s.leader == nil {
+		return ServiceConfig{}, false
+	}
+	return *s.leader, true
+}
+
+func (s *Service) electionTTL() int {
+	if s.sc.ElectionTTL > 0 {
+		return s.sc.ElectionTTL
+	}
+	return defaultElectionTTL
+}
+
+func newEtcdClient(conf ServiceConfig) (*clientv3.Client, error) {
+	return clientv3.New(clientv3.Config{
+		Endpoints:   conf.Etcd.Hosts, // etcd 服务地址
+		Username:    conf.Etcd.User,
+		Password:    conf.Etcd.Pass,
+		DialTimeout: 5 * time.Second,
+	})
+}
+
+func (s *Service) startElection() {
+	go s.campaignLoop()
+	go s.observeLoop()
+}
+
+// 竞选leader, 失去leader 身份后重新竞选, 直到服务退出
+func (s *Service) campaignLoop() {
+	val, err := publicValue(*s.sc)
+	if err != nil {
+		logx.Error(err)
+		return
+	}
+	cli := s.getEtcdClient()
+	for {
+		if !s.sc.IsLeader && !sleepCtx(s.ctx, electionDelay) {
+			return
+		}
+		session, err := concurrency.NewSession(cli,
+			concurrency.WithTTL(s.electionTTL()), concurrency.WithContext(s.ctx))
+		if err != nil {
+			logx.Errorf("%s create election session err:%v", s.sc.String(), err)
+			if !sleepCtx(s.ctx, electionRetryDelay) {
+				return
+			}
+			continue
+		}
+		election := concurrency.NewElection(session, s.LeaderPath())
+		// Campaign 会一直阻塞, 直到成为leader 或者ctx 取消
+		if err := election.Campaign(s.ctx, string(val)); err != nil {
+			logx.Errorf("%s campaign err:%v", s.sc.String(), err)
+			session.Close()
+			if !sleepCtx(s.ctx, electionRetryDelay) {
+				return
+			}
+			continue
+		}
+		logx.Infof("I am the leader, name:%s, id:%s, key:%s", s.sc.Name, s.sc.Id, election.Key())
+		s.setElection(election)
+		s.resetRebalance()
+		s.restoreTopicBalancers()
+		s.assignTopics()
+
+		select {
+		case <-session.Done():
+			// 租约丢失, 其他服务可能已经成为leader, 不能再写topic 信息
+			logx.Errorf("%s election session done, lose leader", s.sc.String())
+			s.metrics.Load().leaseLostInc("election")
+			s.setElection(nil)
+		case <-s.ctx.Done():
+			// 一般Stop 已经Resign 过了
+			s.resign()
+			session.Close()
+			return
+		}
+	}
+}
+
+func (s *Service) setElection(election *concurrency.Election) {
+	s.Lock()
+	defer s.Unlock()
+	s.election = election
+	s.isLeader = election != nil
+}
+
+// resign 主动放弃leader, 删除选举key, 其他服务不用等租约过期就能接替。
+// Stop 在关闭etcd client 之前调用, 否则Resign 会因为client 已经关闭而失败
+func (s *Service) resign() {
+	s.Lock()
+	election := s.election
+	s.election = nil
+	s.isLeader = false
+	s.Unlock()
+	if election == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := election.Resign(ctx); err != nil {
+		logx.Errorf("%s resign err:%v", s.sc.String(), err)
+	}
+}
+
+// watch /ns/as/leader, 最早创建的key 就是leader
+func (s *Service) observeLoop() {
+	cli := s.getEtcdClient()
+	for {
+		resp, err := cli.Get(s.ctx, s.LeaderPath(), clientv3.WithFirstCreate()...)
+		if err != nil {
+			logx.Errorf("get leader err:%v", err)
+			if !sleepCtx(s.ctx, electionRetryDelay) {
+				return
+			}
+			continue
+		}
+		if len(resp.Kvs) > 0 {
+			s.updateLeader(resp.Kvs[0].Value)
+		} else {
+			// leader 的key 被删除了, 还没有新的leader
+			s.clearLeader()
+		}
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		wch := cli.Watch(ctx, s.LeaderPath(), clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+		for wresp := range wch {
+			if wresp.Err() != nil {
+				logx.Errorf("watch leader err:%v", wresp.Err())
+				break
+			}
+			if len(wresp.Events) > 0 {
+				// leader 可能变化了, 重新获取
+				break
+			}
+		}
+		cancel()
+		if s.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (s *Service) updateLeader(val []byte) {
+	var leader ServiceConfig
+	if err := json.Unmarshal(val, &leader); err != nil {
+		logx.Errorf("invalid leader value:%s, err:%v", string(val), err)
+		return
+	}
+	s.setLeader(leader)
+}
+
+// setLeader 记录观察到的leader, leader 变化时回调OnLeaderChange 注册的函数
+func (s *Service) setLeader(leader ServiceConfig) {
+	s.Lock()
+	if s.leader != nil && s.leader.Id == leader.Id {
+		s.leader = &leader
+		s.Unlock()
+		return
+	}
+	s.leader = &leader
+	handlers := append([]LeaderChangeHandler(nil), s.leaderHandlers...)
+	s.Unlock()
+	s.metrics.Load().leaderChanged()
+
+	logx.Infof("%s observe leader change, leader:%s", s.sc.String(), leader.String())
+	for _, fn := range handlers {
+		fn(leader)
+	}
+}
+
+// clearLeader 没有leader 时清除之前观察到的leader, 不回调, 下一个leader 出现时再回调
+func (s *Service) clearLeader() {
+	s.Lock()
+	leader := s.leader
+	s.leader = nil
+	s.Unlock()
+	if leader != nil {
+		logx.Infof("%s observe leader:%s gone, no leader now", s.sc.String(), leader.String())
+	}
+}
+
+// PublishLeader 更新leader 在 /ns/as/leader 下发布的身份信息, 只有leader 才能发布
+func (s *Service) PublishLeader() error {
+	s.Lock()
+	election := s.election
+	s.Unlock()
+	if election == nil {
+		return fmt.Errorf("%s is not leader", s.sc.String())
+	}
+	val, err := publicValue(*s.sc)
+	if err != nil {
+		return err
+	}
+	return election.Proclaim(s.ctx, string(val))
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,91 @@
+package topicservice
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+func TestElectionCampaign(t *testing.T) {
+	c := newTestCluster(t)
+	s1 := c.start("1", true, nil)
+	s2 := c.start("2", false, nil)
+	alive := []*Service{s1, s2}
+	assert.Equal(t, s1.Key(), c.waitLeader(alive).Key())
+	assert.False(t, s2.IsLeader())
+
+	// 只有leader 能发布身份, 其他服务观察到新的身份
+	assert.NotNil(t, s2.PublishLeader())
+	s1.sc.Version = "v2"
+	assert.Nil(t, s1.PublishLeader())
+	assert.Eventually(t, func() bool {
+		leader, ok := s2.Leader()
+		return ok && leader.Version == "v2"
+	}, 10*time.Second, 20*time.Millisecond)
+}
+
+func TestElectionResign(t *testing.T) {
+	c := newTestCluster(t)
+	// 租约很长, 只有leader 主动Resign 才能很快换leader
+	c.conf = func(sc *ServiceConfig) { sc.ElectionTTL = 60 }
+	s1 := c.start("1", true, nil)
+	s2 := c.start("2", false, nil)
+	assert.Equal(t, s1.Key(), c.waitLeader([]*Service{s1, s2}).Key())
+
+	start := time.Now()
+	assert.Nil(t, s1.Stop())
+	assert.Equal(t, s2.Key(), c.waitLeader([]*Service{s2}).Key())
+	assert.Less(t, time.Since(start), 30*time.Second)
+}
+
+func TestElectionObserve(t *testing.T) {
+	c := newTestCluster(t)
+	// 只观察leader, 不竞选
+	s := c.service("observer")
+	ctx := context.Background()
+
+	var lock sync.Mutex
+	var changes []string
+	s.OnLeaderChange(func(leader ServiceConfig) {
+		lock.Lock()
+		defer lock.Unlock()
+		changes = append(changes, leader.String())
+	})
+	go s.observeLoop()
+
+	client, err := clientv3.New(clientv3.Config{Endpoints: c.hosts, DialTimeout: 5 * time.Second})
+	assert.Nil(t, err)
+	defer client.Close()
+	session, err := concurrency.NewSession(client, concurrency.WithTTL(60))
+	assert.Nil(t, err)
+	defer session.Close()
+	election := concurrency.NewElection(session, s.LeaderPath())
+	val, _ := json.Marshal(ServiceConfig{Name: "topic_service", Id: "1"})
+	assert.Nil(t, election.Campaign(ctx, string(val)))
+	assert.Eventually(t, func() bool {
+		leader, ok := s.Leader()
+		return ok && leader.Id == "1"
+	}, 10*time.Second, 20*time.Millisecond)
+
+	// leader 退出, 没有接替的服务, 不能还认为它是leader
+	assert.Nil(t, election.Resign(ctx))
+	assert.Eventually(t, func() bool {
+		_, ok := s.Leader()
+		return !ok
+	}, 10*time.Second, 20*time.Millisecond)
+
+	// 同一个服务再次成为leader, 也要回调
+	assert.Nil(t, election.Campaign(ctx, string(val)))
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(changes) == 2
+	}, 10*time.Second, 20*time.Millisecond)
+	assert.Equal(t, []string{"topic_service-1", "topic_service-1"}, changes)
+}
@@ -0,0 +1,604 @@
+package topicservice
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// Forwarder 把publish 到本service 的数据转发给其他有客户端订阅该topic 的service:
+//  1. 从SubscriptionStore 查到订阅了topic 的service(比如TopicState.GlobalTopics 里的ServiceSet), 跳过自己
+//  2. 每个peer 一条长连接, 一个有界的发送队列, 队列里的数据攒批(BatchSize/FlushInterval)后一次写出
+//  3. 队列满了(peer 处理慢或者连不上)Publish 就阻塞, 直到队列有空位或者ctx 结束, 这就是背压
+//  4. peer 收到数据后交给本地订阅者, 发现本地已经没有客户端订阅topic 时回复stale, 发送方据此清理过时的订阅关系
+//
+// 协议: type(1 byte) + body len(4 bytes) + body
+//   - frameBatch: count(4 bytes) + count * [topic len(2 bytes) + topic + payload len(4 bytes) + payload]
+//   - frameStale: topic, 接收方回复发送方
+//
+// peer 空闲超过IdleTimeout 就关闭连接并回收, 离开的service 没有数据要发时也不会一直占着goroutine,
+// 之后再有数据要发时重新建立。
+// 转发是at-most-once 的, 连接断开时正在写的那一批数据会丢掉。
+const (
+	frameBatch byte = 1
+	frameStale byte = 2
+
+	maxForwardFrameSize = 16 << 20
+	// 一批数据攒到maxForwardBatchBytes 就写出, 单条数据不超过maxForwardMsgSize,
+	// 所以一批最多maxForwardBatchBytes+maxForwardMsgSize, 不会超过maxForwardFrameSize
+	maxForwardBatchBytes = maxForwardFrameSize / 2
+	maxForwardMsgSize    = maxForwardFrameSize/2 - 4
+
+	defaultForwardBatchSize     = 64
+	defaultForwardQueueSize     = 1024
+	defaultForwardFlushInterval = 5  // 毫秒
+	defaultForwardWriteTimeout  = 3  // 秒
+	defaultForwardIdleTimeout   = 60 // 秒
+)
+
+var (
+	ErrForwarderClosed = errors.New("forwarder closed")
+	ErrPayloadTooLarge = errors.New("forward payload too large")
+)
+
+type ForwardConf struct {
+	Addr          string `json:",optional"` // 接收转发数据的监听地址, 随ServiceConfig 注册, 其他service 用它连接; 为空不开启转发
+	BatchSize     int    `json:",optional"` // 一次最多合并多少条数据, 默认64
+	QueueSize     int    `json:",optional"` // 每个peer 的发送队列长度, 满了Publish 会阻塞, 默认1024
+	FlushInterval int    `json:",optional"` // 攒批最多等多久(毫秒), 默认5毫秒
+	WriteTimeout  int    `json:",optional"` // 写超时(秒), 默认3秒
+	IdleTimeout   int    `json:",optional"` // peer 多久(秒)没有数据要发就关闭连接并回收, 默认60秒
+}
+
+// DeliverHandler 把其他service 转发过来的数据交给本地订阅topic 的客户端, 返回false 表示本地已经没有客户端订阅topic
+type DeliverHandler func(topic string, payload []byte) bool
+
+// StaleHandler service 回复说它已经没有客户端订阅topic 了, 订阅关系里 topic-->service 的记录过时了
+type StaleHandler func(topic, service string)
+
+// PeerResolver 返回service 接收转发数据的地址, service 已经不在了返回false
+type PeerResolver func(service string) (addr string, ok bool)
+
+type forwardMsg struct {
+	topic   string
+	payload []byte
+}
+
+// size 编码到batch 里的大小
+func (m forwardMsg) size() int {
+	return 2 + len(m.topic) + 4 + len(m.payload)
+}
+
+type Forwarder struct {
+	conf    ForwardConf
+	self    string
+	subs    SubscriptionStore
+	resolve PeerResolver
+	deliver DeliverHandler
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	ln     net.Listener
+
+	mu            sync.Mutex
+	peers         map[string]*forwardPeer //key: service
+	conns         map[net.Conn]struct{}   //接收的连接, Close 时关闭
+	staleHandlers []StaleHandler
+}
+
+// NewForwarder self 是本service 的名字(ServiceInfo.String()), 转发时跳过;
+// deliver 为nil 时只转发, 不接收其他service 转发过来的数据
+func NewForwarder(conf ForwardConf, self string, subs SubscriptionStore, resolve PeerResolver, deliver DeliverHandler) *Forwarder {
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = defaultForwardBatchSize
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = defaultForwardQueueSize
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = defaultForwardFlushInterval
+	}
+	if conf.WriteTimeout <= 0 {
+		conf.WriteTimeout = defaultForwardWriteTimeout
+	}
+	if conf.IdleTimeout <= 0 {
+		conf.IdleTimeout = defaultForwardIdleTimeout
+	}
+	f := &Forwarder{
+		conf:    conf,
+		self:    self,
+		subs:    subs,
+		resolve: resolve,
+		deliver: deliver,
+		peers:   make(map[string]*forwardPeer),
+		conns:   make(map[net.Conn]struct{}),
+	}
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	return f
+}
+
+// OnStale 注册订阅关系过时的回调
+func (f *Forwarder) OnStale(fn StaleHandler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.staleHandlers = append(f.staleHandlers, fn)
+}
+
+// Start 监听Addr, 接收其他service 转发过来的数据
+func (f *Forwarder) Start(ctx context.Context) error {
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.Close()
+		case <-f.ctx.Done():
+		}
+	}()
+	if f.conf.Addr == "" || f.deliver == nil {
+		return nil
+	}
+	ln, err := net.Listen("tcp", f.conf.Addr)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.ln = ln
+	f.mu.Unlock()
+	go f.accept(ln)
+	return nil
+}
+
+// Addr 返回实际监听的地址, 没有监听时返回空
+func (f *Forwarder) Addr() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ln == nil {
+		return ""
+	}
+	return f.ln.Addr().String()
+}
+
+// Publish 把topic 的数据转发给所有订阅了topic 的其他service, 返回放进发送队列的service 数。
+// 某个service 的发送队列满了会阻塞, 直到有空位或者ctx 结束。
+// 超过一个frame 能放下的数据返回ErrPayloadTooLarge, 否则接收方会断开连接, 整批数据都丢了
+func (f *Forwarder) Publish(ctx context.Context, topic string, payload []byte) (int, error) {
+	if f.ctx.Err() != nil {
+		return 0, ErrForwarderClosed
+	}
+	if len(topic) > math.MaxUint16 {
+		return 0, fmt.Errorf("topic too long:%d", len(topic))
+	}
+	msg := forwardMsg{topic: topic, payload: payload}
+	if msg.size() > maxForwardMsgSize {
+		return 0, fmt.Errorf("%w: %d", ErrPayloadTooLarge, len(payload))
+	}
+	n := 0
+	for _, service := range f.subs.Subscribers(topic) {
+		if service == f.self {
+			continue
+		}
+		ok, err := f.enqueue(ctx, service, msg)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// enqueue 放进service 的发送队列, peer 刚好空闲回收了就重新建一个
+func (f *Forwarder) enqueue(ctx context.Context, service string, msg forwardMsg) (bool, error) {
+	for {
+		p := f.peer(service)
+		ok, err := p.enqueue(ctx, msg)
+		// enqueue 返回false 时done 已经关闭了, 读idle 不用加锁
+		if ok || err != nil || !p.idle {
+			return ok, err
+		}
+	}
+}
+
+func (f *Forwarder) peer(service string) *forwardPeer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.peers[service]
+	if !ok {
+		p = &forwardPeer{
+			f:       f,
+			service: service,
+			queue:   make(chan forwardMsg, f.conf.QueueSize),
+			done:    make(chan struct{}),
+		}
+		f.peers[service] = p
+		go p.run()
+	}
+	return p
+}
+
+func (f *Forwarder) removePeer(p *forwardPeer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.peers[p.service] == p {
+		delete(f.peers, p.service)
+	}
+	close(p.done)
+}
+
+func (f *Forwarder) stale(topic, service string) {
+	f.mu.Lock()
+	handlers := append([]StaleHandler(nil), f.staleHandlers...)
+	f.mu.Unlock()
+	logx.Infof("service:%s has no subscriber of topic:%s", service, topic)
+	for _, fn := range handlers {
+		fn(topic, service)
+	}
+}
+
+func (f *Forwarder) Close() error {
+	f.cancel()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var err error
+	if f.ln != nil {
+		err = f.ln.Close()
+	}
+	for conn := range f.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (f *Forwarder) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if f.ctx.Err() == nil {
+				logx.Errorf("forwarder accept err:%v", err)
+			}
+			return
+		}
+		f.mu.Lock()
+		if f.ctx.Err() != nil {
+			f.mu.Unlock()
+			conn.Close()
+			return
+		}
+		f.conns[conn] = struct{}{}
+		f.mu.Unlock()
+		go f.serve(conn)
+	}
+}
+
+// serve 接收一个peer 转发过来的数据, 本地没有订阅者的topic 回复stale
+func (f *Forwarder) serve(conn net.Conn) {
+	defer func() {
+		f.mu.Lock()
+		delete(f.conns, conn)
+		f.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		typ, body, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF && f.ctx.Err() == nil {
+				logx.Errorf("forwarder read from %s err:%v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if typ != frameBatch {
+			continue
+		}
+		msgs, err := decodeBatch(body)
+		if err != nil {
+			logx.Errorf("forwarder decode batch from %s err:%v", conn.RemoteAddr(), err)
+			return
+		}
+		stale := make(map[string]bool)
+		for _, msg := range msgs {
+			if stale[msg.topic] {
+				continue
+			}
+			if !f.deliver(msg.topic, msg.payload) {
+				stale[msg.topic] = true
+				if err := writeFrame(w, frameStale, []byte(msg.topic)); err != nil {
+					return
+				}
+			}
+		}
+		if len(stale) > 0 {
+			conn.SetWriteDeadline(time.Now().Add(time.Duration(f.conf.WriteTimeout) * time.Second))
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// forwardPeer 到一个service 的长连接和发送队列
+type forwardPeer struct {
+	f       *Forwarder
+	service string
+	queue   chan forwardMsg
+	done    chan struct{} //peer 已经不在了, 或者空闲回收了
+
+	// enqueue 拿读锁, 空闲回收拿写锁, 回收时不会有数据正在放进队列
+	mu   sync.RWMutex
+	idle bool //空闲回收的, 关闭done 之前设置
+}
+
+// enqueue 放进发送队列, peer 已经不在了返回false, 数据丢掉
+func (p *forwardPeer) enqueue(ctx context.Context, msg forwardMsg) (bool, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	// select 在多个case 都满足时随机选, 先检查done, 不要放进已经没有人读的队列
+	select {
+	case <-p.done:
+		return false, nil
+	default:
+	}
+	select {
+	case p.queue <- msg:
+		return true, nil
+	case <-p.done:
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-p.f.ctx.Done():
+		return false, ErrForwarderClosed
+	}
+}
+
+// closeIdle 队列是空的, 也没有正在enqueue 的, 就从Forwarder 里删掉。
+// 不能等写锁: enqueue 可能拿着读锁阻塞在满了的队列上, 等run 来读
+func (p *forwardPeer) closeIdle() bool {
+	if !p.mu.TryLock() {
+		return false
+	}
+	defer p.mu.Unlock()
+	if len(p.queue) > 0 {
+		return false
+	}
+	p.idle = true
+	p.f.removePeer(p)
+	return true
+}
+
+func (p *forwardPeer) run() {
+	f := p.f
+	var conn net.Conn
+	var w *bufio.Writer
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	flush := time.Duration(f.conf.FlushInterval) * time.Millisecond
+	idleTimeout := time.Duration(f.conf.IdleTimeout) * time.Second
+	idle := time.NewTimer(idleTimeout)
+	defer idle.Stop()
+	batch := make([]forwardMsg, 0, f.conf.BatchSize)
+	for {
+		size := 4
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-idle.C:
+			if p.closeIdle() {
+				logx.Infof("forward peer:%s is idle for %v, close it", p.service, idleTimeout)
+				return
+			}
+			idle.Reset(idleTimeout)
+			continue
+		case msg := <-p.queue:
+			batch = append(batch, msg)
+			size += msg.size()
+		}
+		// 攒批: 凑够BatchSize 或者maxForwardBatchBytes, 或者等了FlushInterval 就写出
+		timer := time.NewTimer(flush)
+	collect:
+		for len(batch) < f.conf.BatchSize && size < maxForwardBatchBytes {
+			select {
+			case msg := <-p.queue:
+				batch = append(batch, msg)
+				size += msg.size()
+			case <-timer.C:
+				break collect
+			case <-f.ctx.Done():
+				break collect
+			}
+		}
+		timer.Stop()
+
+		for conn == nil {
+			addr, ok := f.resolve(p.service)
+			if !ok {
+				logx.Errorf("forward peer:%s is gone, drop %d messages", p.service, len(batch)+len(p.queue))
+				f.removePeer(p)
+				return
+			}
+			c, err := net.DialTimeout("tcp", addr, time.Duration(f.conf.WriteTimeout)*time.Second)
+			if err != nil {
+				logx.Errorf("dial forward peer:%s addr:%s err:%v", p.service, addr, err)
+				if !sleepCtx(f.ctx, electionRetryDelay) {
+					return
+				}
+				continue
+			}
+			conn, w = c, bufio.NewWriter(c)
+			go p.readStale(c)
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(time.Duration(f.conf.WriteTimeout) * time.Second))
+		err := writeFrame(w, frameBatch, encodeBatch(batch))
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			logx.Errorf("forward %d messages to peer:%s err:%v", len(batch), p.service, err)
+			conn.Close()
+			conn = nil
+		}
+		batch = batch[:0]
+		idle.Reset(idleTimeout)
+	}
+}
+
+func (p *forwardPeer) readStale(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		typ, body, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		if typ == frameStale {
+			p.f.stale(string(body), p.service)
+		}
+	}
+}
+
+func writeFrame(w *bufio.Writer, typ byte, body []byte) error {
+	var hdr [5]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(body)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[1:])
+	if size > maxForwardFrameSize {
+		return 0, nil, fmt.Errorf("frame too large:%d", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], body, nil
+}
+
+func encodeBatch(msgs []forwardMsg) []byte {
+	size := 4
+	for _, msg := range msgs {
+		size += msg.size()
+	}
+	buf := make([]byte, 0, size)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(msgs)))
+	for _, msg := range msgs {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(msg.topic)))
+		buf = append(buf, msg.topic...)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(msg.payload)))
+		buf = append(buf, msg.payload...)
+	}
+	return buf
+}
+
+func decodeBatch(buf []byte) ([]forwardMsg, error) {
+	if len(buf) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	count := binary.BigEndian.Uint32(buf)
+	buf = buf[4:]
+	msgs := make([]forwardMsg, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(buf) < 2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		n := int(binary.BigEndian.Uint16(buf))
+		buf = buf[2:]
+		if len(buf) < n+4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		topic := string(buf[:n])
+		buf = buf[n:]
+		m := int(binary.BigEndian.Uint32(buf))
+		buf = buf[4:]
+		if len(buf) < m {
+			return nil, io.ErrUnexpectedEOF
+		}
+		msgs = append(msgs, forwardMsg{topic: topic, payload: buf[:m:m]})
+		buf = buf[m:]
+	}
+	return msgs, nil
+}
+
+// SetDeliverHandler 设置处理其他service 转发过来的数据的回调, 需要在Start 之前调用
+func (s *Service) SetDeliverHandler(fn DeliverHandler) {
+	s.Lock()
+	defer s.Unlock()
+	s.deliver = fn
+}
+
+// Forward 把客户端publish 到本service 的数据转发给其他订阅了topic 的service, 返回转发的service 数
+func (s *Service) Forward(ctx context.Context, topic string, payload []byte) (int, error) {
+	if s.forwarder == nil {
+		return 0, fmt.Errorf("forwarder is not enabled")
+	}
+	return s.forwarder.Publish(ctx, topic, payload)
+}
+
+// forwardAddr 从服务列表里找到service 注册的Forward.Addr
+func (s *Service) forwardAddr(service string) (string, bool) {
+	// 优先用gossip 元数据, 不用等etcd 的服务列表
+	if s.topicState != nil {
+		if meta, ok := s.topicState.PeerMeta(service); ok && meta.ForwardAddr != "" {
+			return meta.ForwardAddr, true
+		}
+	}
+	for _, v := range s.getServiceList() {
+		if v.String() == service && v.Forward.Addr != "" {
+			return v.Forward.Addr, true
+		}
+	}
+	return "", false
+}
+
+func (s *Service) startForwarder() error {
+	subs := s.SubscriptionStore()
+	if s.sc.Forward.Addr == "" || subs == nil {
+		return nil
+	}
+	s.Lock()
+	handler := s.deliver
+	s.Unlock()
+	var deliver DeliverHandler
+	if handler != nil {
+		deliver = func(topic string, payload []byte) bool {
+			if handler(topic, payload) {
+				return true
+			}
+			// 本地已经没有客户端订阅topic, 删掉自己的记录并通知其他service
+			s.DelTopicState(topic)
+			return false
+		}
+	}
+	f := NewForwarder(s.sc.Forward, s.Key(), subs, s.forwardAddr, deliver)
+	f.OnStale(func(topic, service string) {
+		if err := subs.RemoveSubscriber(topic, service); err != nil {
+			logx.Errorf("remove stale subscriber topic:%s service:%s err:%v", topic, service, err)
+		}
+	})
+	if err := f.Start(s.ctx); err != nil {
+		return err
+	}
+	s.forwarder = f
+	return nil
+}
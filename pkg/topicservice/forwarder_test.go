@@ -0,0 +1,254 @@
+package topicservice
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memSubscriptionStore 测试用的订阅关系, 只在内存里
+type memSubscriptionStore struct {
+	mu   sync.Mutex
+	subs map[string][]string
+}
+
+func (m *memSubscriptionStore) Subscribe(topics ...string) error   { return nil }
+func (m *memSubscriptionStore) Unsubscribe(topics ...string) error { return nil }
+func (m *memSubscriptionStore) RemoveSubscriber(topic, service string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var left []string
+	for _, v := range m.subs[topic] {
+		if v != service {
+			left = append(left, v)
+		}
+	}
+	m.subs[topic] = left
+	return nil
+}
+func (m *memSubscriptionStore) Subscribers(topic string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.subs[topic]...)
+}
+func (m *memSubscriptionStore) Subscriptions() map[string][]string { return nil }
+func (m *memSubscriptionStore) LocalSubscriptions() []string       { return nil }
+func (m *memSubscriptionStore) Close() error                       { return nil }
+
+func TestForwardBatchCodec(t *testing.T) {
+	msgs := []forwardMsg{
+		{topic: "topic1", payload: []byte("hello")},
+		{topic: "a/b/c", payload: nil},
+		{topic: "", payload: []byte{0, 1, 2}},
+	}
+	got, err := decodeBatch(encodeBatch(msgs))
+	assert.Nil(t, err)
+	assert.Equal(t, len(msgs), len(got))
+	for i := range msgs {
+		assert.Equal(t, msgs[i].topic, got[i].topic)
+		assert.Equal(t, string(msgs[i].payload), string(got[i].payload))
+	}
+
+	_, err = decodeBatch(encodeBatch(msgs)[:10])
+	assert.NotNil(t, err)
+}
+
+func TestForwarder(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	receiver := NewForwarder(ForwardConf{Addr: "127.0.0.1:0"}, "s-2", &memSubscriptionStore{}, nil,
+		func(topic string, payload []byte) bool {
+			if topic == "topic2" {
+				return false
+			}
+			mu.Lock()
+			received = append(received, string(payload))
+			mu.Unlock()
+			return true
+		})
+	assert.Nil(t, receiver.Start(context.Background()))
+	defer receiver.Close()
+
+	store := &memSubscriptionStore{subs: map[string][]string{
+		"topic1": {"s-1", "s-2"},
+		"topic2": {"s-2"},
+	}}
+	resolve := func(service string) (string, bool) {
+		return receiver.Addr(), service == "s-2"
+	}
+	sender := NewForwarder(ForwardConf{BatchSize: 4}, "s-1", store, resolve, nil)
+	assert.Nil(t, sender.Start(context.Background()))
+	defer sender.Close()
+	stale := make(chan string, 1)
+	sender.OnStale(func(topic, service string) {
+		store.RemoveSubscriber(topic, service)
+		stale <- topic + "/" + service
+	})
+
+	var want []string
+	for i := 0; i < 10; i++ {
+		payload := fmt.Sprintf("msg-%d", i)
+		want = append(want, payload)
+		n, err := sender.Publish(context.Background(), "topic1", []byte(payload))
+		assert.Nil(t, err)
+		assert.Equal(t, 1, n) //跳过自己
+	}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return assert.ObjectsAreEqual(want, received)
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// s-2 上没有客户端订阅topic2 了, 回复stale
+	n, err := sender.Publish(context.Background(), "topic2", []byte("x"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	select {
+	case v := <-stale:
+		assert.Equal(t, "topic2/s-2", v)
+	case <-time.After(3 * time.Second):
+		t.Fatal("no stale signal")
+	}
+	assert.Empty(t, store.Subscribers("topic2"))
+}
+
+func TestForwarderBackpressure(t *testing.T) {
+	// 一个没有人监听的地址, 一直连不上
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	store := &memSubscriptionStore{subs: map[string][]string{"topic1": {"s-2"}}}
+	sender := NewForwarder(ForwardConf{BatchSize: 1, QueueSize: 1, FlushInterval: 1}, "s-1", store,
+		func(service string) (string, bool) { return addr, true }, nil)
+	defer sender.Close()
+
+	var lastErr error
+	for i := 0; i < 5 && lastErr == nil; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		_, lastErr = sender.Publish(ctx, "topic1", []byte("x"))
+		cancel()
+	}
+	assert.Equal(t, context.DeadlineExceeded, lastErr)
+
+	sender.Close()
+	_, err = sender.Publish(context.Background(), "topic1", []byte("x"))
+	assert.Equal(t, ErrForwarderClosed, err)
+}
+
+func TestForwarderLargePayload(t *testing.T) {
+	var mu sync.Mutex
+	received := 0
+	receiver := NewForwarder(ForwardConf{Addr: "127.0.0.1:0"}, "s-2", &memSubscriptionStore{}, nil,
+		func(topic string, payload []byte) bool {
+			mu.Lock()
+			received++
+			mu.Unlock()
+			return true
+		})
+	assert.Nil(t, receiver.Start(context.Background()))
+	defer receiver.Close()
+
+	store := &memSubscriptionStore{subs: map[string][]string{"topic1": {"s-2"}}}
+	sender := NewForwarder(ForwardConf{FlushInterval: 100}, "s-1", store,
+		func(service string) (string, bool) { return receiver.Addr(), true }, nil)
+	defer sender.Close()
+
+	_, err := sender.Publish(context.Background(), "topic1", make([]byte, maxForwardFrameSize))
+	assert.ErrorIs(t, err, ErrPayloadTooLarge)
+
+	// 几条加起来超过一个frame, 分成多批写, 接收方都能收到
+	payload := make([]byte, maxForwardMsgSize-100)
+	for i := 0; i < 3; i++ {
+		n, err := sender.Publish(context.Background(), "topic1", payload)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, n)
+	}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return received == 3
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestForwarderRemovedPeer(t *testing.T) {
+	store := &memSubscriptionStore{subs: map[string][]string{"topic1": {"s-2"}}}
+	sender := NewForwarder(ForwardConf{}, "s-1", store, func(service string) (string, bool) { return "", false }, nil)
+	defer sender.Close()
+
+	// peer 不在了, 队列还有空位也不能放进去
+	p := sender.peer("s-2")
+	ok, err := p.enqueue(context.Background(), forwardMsg{topic: "topic1"})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	<-p.done
+	for i := 0; i < 100; i++ {
+		ok, err := p.enqueue(context.Background(), forwardMsg{topic: "topic1"})
+		assert.Nil(t, err)
+		assert.False(t, ok)
+	}
+	assert.Empty(t, p.queue)
+}
+
+func TestForwarderIdlePeer(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	receiver := NewForwarder(ForwardConf{Addr: "127.0.0.1:0"}, "s-2", &memSubscriptionStore{}, nil,
+		func(topic string, payload []byte) bool {
+			mu.Lock()
+			received = append(received, string(payload))
+			mu.Unlock()
+			return true
+		})
+	assert.Nil(t, receiver.Start(context.Background()))
+	defer receiver.Close()
+
+	store := &memSubscriptionStore{subs: map[string][]string{"topic1": {"s-2"}}}
+	resolve := func(service string) (string, bool) { return receiver.Addr(), true }
+	sender := NewForwarder(ForwardConf{IdleTimeout: 1}, "s-1", store, resolve, nil)
+	defer sender.Close()
+	peers := func() int {
+		sender.mu.Lock()
+		defer sender.mu.Unlock()
+		return len(sender.peers)
+	}
+
+	n, err := sender.Publish(context.Background(), "topic1", []byte("msg-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 1, peers())
+	// 没有数据要发, peer 回收掉, 连接也关闭
+	assert.Eventually(t, func() bool {
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		return peers() == 0 && len(receiver.conns) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 再发数据重新建立peer
+	n, err = sender.Publish(context.Background(), "topic1", []byte("msg-2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return assert.ObjectsAreEqual([]string{"msg-1", "msg-2"}, received)
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// 回收的peer 不能再放数据, Forwarder.enqueue 换成新的peer
+	p := sender.peer("s-2")
+	assert.Eventually(t, func() bool { return peers() == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, p.idle)
+	ok, err := p.enqueue(context.Background(), forwardMsg{topic: "topic1"})
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = sender.enqueue(context.Background(), "s-2", forwardMsg{topic: "topic1", payload: []byte("msg-3")})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.NotSame(t, p, sender.peer("s-2"))
+}
@@ -0,0 +1,285 @@
+package topicservice
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// GossipCodec 编码gossip 广播的消息和push/pull 的全量状态, 都是GossipMessage。
+// 接收时按第一个字节自动识别: binaryGossipMagic 是binary, '{' 或 '[' 是json, 其他的用配置的codec,
+// 所以同一个集群里的节点可以用不同的codec(比如调试时把某个节点切成json)。
+type GossipCodec interface {
+	Name() string
+	Encode(msg GossipMessage) ([]byte, error)
+	Decode(b []byte) (GossipMessage, error)
+}
+
+// GossipMessage From 是发送的节点, 广播的消息里From 只能修改自己的记录
+type GossipMessage struct {
+	From    string
+	Updates []TopicInfo
+}
+
+const (
+	GossipCodecJSON   = "json"
+	GossipCodecBinary = "binary"
+
+	binaryGossipMagic byte = 0xB1
+	binaryFlagFlate   byte = 1 << 0
+
+	// maxGossipDecodedSize 解压后的最大长度, 防止压缩炸弹。
+	// 最大的消息是push/pull 的全量状态, memberlist 限制push/pull 状态不超过20MB(maxPushStateBytes), 广播的消息更小
+	maxGossipDecodedSize = 20 << 20
+)
+
+var (
+	gossipCodecsMu sync.RWMutex
+	gossipCodecs   = map[string]GossipCodec{
+		GossipCodecJSON:   JSONGossipCodec{},
+		GossipCodecBinary: &BinaryGossipCodec{},
+	}
+)
+
+// RegisterGossipCodec 注册自定义的codec, 可以在GossipConf.Codec 里用名字引用
+func RegisterGossipCodec(codec GossipCodec) {
+	gossipCodecsMu.Lock()
+	defer gossipCodecsMu.Unlock()
+	gossipCodecs[codec.Name()] = codec
+}
+
+// NewGossipCodec 根据名字返回codec, 空表示json; binary 且compress 时返回压缩的binary codec
+func NewGossipCodec(name string, compress bool) (GossipCodec, error) {
+	if name == "" {
+		name = GossipCodecJSON
+	}
+	if name == GossipCodecBinary {
+		return &BinaryGossipCodec{Compress: compress}, nil
+	}
+	gossipCodecsMu.RLock()
+	defer gossipCodecsMu.RUnlock()
+	codec, ok := gossipCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown gossip codec:%s", name)
+	}
+	return codec, nil
+}
+
+// decodeGossip 按第一个字节识别codec
+func decodeGossip(codec GossipCodec, b []byte) (GossipMessage, error) {
+	if len(b) == 0 {
+		return GossipMessage{}, io.ErrUnexpectedEOF
+	}
+	switch b[0] {
+	case binaryGossipMagic:
+		return (&BinaryGossipCodec{}).Decode(b)
+	case '{', '[':
+		return JSONGossipCodec{}.Decode(b)
+	}
+	return codec.Decode(b)
+}
+
+// JSONGossipCodec 可读, 方便调试, 兼容以前的格式
+type JSONGossipCodec struct{}
+
+func (JSONGossipCodec) Name() string {
+	return GossipCodecJSON
+}
+
+func (JSONGossipCodec) Encode(msg GossipMessage) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (JSONGossipCodec) Decode(b []byte) (GossipMessage, error) {
+	var msg GossipMessage
+	if len(b) > 0 && b[0] == '{' {
+		if err := json.Unmarshal(b, &msg); err == nil && (msg.From != "" || msg.Updates != nil) {
+			return msg, nil
+		}
+		// 没有版本的旧节点的全量状态: map[topic]*ServiceSet
+		var remoteTopics map[string]*ServiceSet
+		if err := json.Unmarshal(b, &remoteTopics); err != nil {
+			return msg, err
+		}
+		for topic, info := range remoteTopics {
+			for service := range info.Services {
+				msg.Updates = append(msg.Updates, TopicInfo{Op: ADD, Topic: topic, Service: service})
+			}
+		}
+		return msg, nil
+	}
+	// 没有发送者的旧格式: []TopicInfo
+	err := json.Unmarshal(b, &msg.Updates)
+	return msg, err
+}
+
+// BinaryGossipCodec 紧凑的二进制格式:
+//
+//	magic(1) flags(1) body, flags&binaryFlagFlate 时body 是flate 压缩的
+//	body: from, service 表, topic 数, 每个topic: topic, 记录数, 每条记录: service 序号<<1|deleted, version
+//
+// 字符串都是uvarint 长度+内容, 数字都是uvarint; service 名字只出现一次, 记录里用序号引用
+type BinaryGossipCodec struct {
+	Compress bool
+}
+
+func (c *BinaryGossipCodec) Name() string {
+	return GossipCodecBinary
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func (c *BinaryGossipCodec) Encode(msg GossipMessage) ([]byte, error) {
+	services := make(map[string]uint64)
+	var serviceNames []string
+	topics := make(map[string][]TopicInfo)
+	var topicNames []string
+	for _, info := range msg.Updates {
+		if _, ok := services[info.Service]; !ok {
+			services[info.Service] = uint64(len(serviceNames))
+			serviceNames = append(serviceNames, info.Service)
+		}
+		if _, ok := topics[info.Topic]; !ok {
+			topicNames = append(topicNames, info.Topic)
+		}
+		topics[info.Topic] = append(topics[info.Topic], info)
+	}
+	sort.Strings(topicNames)
+
+	body := make([]byte, 0, 64+len(msg.Updates)*8)
+	body = appendString(body, msg.From)
+	body = binary.AppendUvarint(body, uint64(len(serviceNames)))
+	for _, name := range serviceNames {
+		body = appendString(body, name)
+	}
+	body = binary.AppendUvarint(body, uint64(len(topicNames)))
+	for _, topic := range topicNames {
+		body = appendString(body, topic)
+		infos := topics[topic]
+		body = binary.AppendUvarint(body, uint64(len(infos)))
+		for _, info := range infos {
+			ref := services[info.Service] << 1
+			if info.Op == DEL {
+				ref |= 1
+			}
+			body = binary.AppendUvarint(body, ref)
+			body = binary.AppendUvarint(body, info.Version)
+		}
+	}
+
+	if !c.Compress {
+		return append([]byte{binaryGossipMagic, 0}, body...), nil
+	}
+	var buf bytes.Buffer
+	buf.Write([]byte{binaryGossipMagic, binaryFlagFlate})
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type binaryReader struct {
+	buf []byte
+	err error
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *binaryReader) string() string {
+	n := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if uint64(len(r.buf)) < n {
+		r.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s
+}
+
+// count 读一个数量, 数量不可能超过剩下的字节数, 防止恶意的数据分配过大的内存。出错时返回0, 调用方可以直接make
+func (r *binaryReader) count() int {
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(r.buf)) {
+		r.err = errors.New("invalid count")
+	}
+	if r.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (c *BinaryGossipCodec) Decode(b []byte) (GossipMessage, error) {
+	var msg GossipMessage
+	if len(b) < 2 || b[0] != binaryGossipMagic {
+		return msg, errors.New("not binary gossip message")
+	}
+	body := b[2:]
+	if b[1]&binaryFlagFlate != 0 {
+		data, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(body)), maxGossipDecodedSize+1))
+		if err != nil {
+			return msg, err
+		}
+		if len(data) > maxGossipDecodedSize {
+			return msg, fmt.Errorf("gossip message too large, more than %d bytes after decompress", maxGossipDecodedSize)
+		}
+		body = data
+	}
+	r := &binaryReader{buf: body}
+	msg.From = r.string()
+	services := make([]string, r.count())
+	for i := range services {
+		services[i] = r.string()
+	}
+	topicNum := r.count()
+	for i := 0; i < topicNum && r.err == nil; i++ {
+		topic := r.string()
+		n := r.count()
+		for j := 0; j < n && r.err == nil; j++ {
+			ref := r.uvarint()
+			version := r.uvarint()
+			if r.err != nil {
+				break
+			}
+			idx := ref >> 1
+			if idx >= uint64(len(services)) {
+				return msg, fmt.Errorf("invalid service index:%d", idx)
+			}
+			op := ADD
+			if ref&1 == 1 {
+				op = DEL
+			}
+			msg.Updates = append(msg.Updates, TopicInfo{Op: op, Topic: topic, Service: services[idx], Version: version})
+		}
+	}
+	return msg, r.err
+}
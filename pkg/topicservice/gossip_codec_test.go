@@ -0,0 +1,146 @@
+package topicservice
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testGossipMessage(topics, services int) GossipMessage {
+	msg := GossipMessage{From: "s-0"}
+	for i := 0; i < topics; i++ {
+		for j := 0; j < services; j++ {
+			op := ADD
+			if (i+j)%7 == 0 {
+				op = DEL
+			}
+			msg.Updates = append(msg.Updates, TopicInfo{
+				Op:      op,
+				Topic:   fmt.Sprintf("device/%d/status", i),
+				Service: fmt.Sprintf("broker-%d", j),
+				Version: uint64(i*services + j + 1),
+			})
+		}
+	}
+	return msg
+}
+
+func TestGossipCodecRoundTrip(t *testing.T) {
+	msg := testGossipMessage(50, 3)
+	for _, name := range []string{GossipCodecJSON, GossipCodecBinary} {
+		for _, compress := range []bool{false, true} {
+			codec, err := NewGossipCodec(name, compress)
+			assert.Nil(t, err)
+			b, err := codec.Encode(msg)
+			assert.Nil(t, err)
+			// 接收方不管自己配置的是什么codec 都能解开
+			for _, other := range []GossipCodec{JSONGossipCodec{}, &BinaryGossipCodec{}} {
+				got, err := decodeGossip(other, b)
+				assert.Nil(t, err)
+				assert.Equal(t, msg.From, got.From)
+				assert.ElementsMatch(t, msg.Updates, got.Updates, "%s compress:%v", name, compress)
+			}
+		}
+	}
+
+	_, err := NewGossipCodec("gob", false)
+	assert.NotNil(t, err)
+
+	b, _ := (&BinaryGossipCodec{}).Encode(msg)
+	_, err = decodeGossip(JSONGossipCodec{}, b[:len(b)/2])
+	assert.NotNil(t, err)
+}
+
+func TestGossipCodecLegacyJSON(t *testing.T) {
+	legacyState, _ := json.Marshal(map[string]*ServiceSet{"topic1": {Services: map[string]struct{}{"s-1": {}}}})
+	msg, err := decodeGossip(&BinaryGossipCodec{}, legacyState)
+	assert.Nil(t, err)
+	assert.Equal(t, []TopicInfo{{Op: ADD, Topic: "topic1", Service: "s-1"}}, msg.Updates)
+
+	legacyMsg, _ := json.Marshal([]TopicInfo{{Op: DEL, Topic: "topic1", Service: "s-1", Version: 2}})
+	msg, err = decodeGossip(&BinaryGossipCodec{}, legacyMsg)
+	assert.Nil(t, err)
+	assert.Equal(t, "", msg.From)
+	assert.Equal(t, []TopicInfo{{Op: DEL, Topic: "topic1", Service: "s-1", Version: 2}}, msg.Updates)
+}
+
+func TestGossipCodecSize(t *testing.T) {
+	msg := testGossipMessage(20000, 3)
+	jsonBytes, _ := JSONGossipCodec{}.Encode(msg)
+	binaryBytes, _ := (&BinaryGossipCodec{}).Encode(msg)
+	compressed, _ := (&BinaryGossipCodec{Compress: true}).Encode(msg)
+	t.Logf("json:%d binary:%d compressed:%d", len(jsonBytes), len(binaryBytes), len(compressed))
+	assert.Less(t, len(binaryBytes)*3, len(jsonBytes))
+	assert.Less(t, len(compressed), len(binaryBytes))
+}
+
+func TestGossipCodecDecompressLimit(t *testing.T) {
+	// 压缩后很小, 解压后超过限制的数据要拒绝
+	var buf bytes.Buffer
+	buf.Write([]byte{binaryGossipMagic, binaryFlagFlate})
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write(make([]byte, maxGossipDecodedSize+1))
+	w.Close()
+	assert.Less(t, buf.Len(), 1<<20)
+	_, err := (&BinaryGossipCodec{}).Decode(buf.Bytes())
+	assert.NotNil(t, err)
+}
+
+func TestGossipCodecInvalidCount(t *testing.T) {
+	codec := &BinaryGossipCodec{}
+	uvarint := func(v uint64) []byte { return binary.AppendUvarint(nil, v) }
+	header := []byte{binaryGossipMagic, 0}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	// 数量超过剩下的字节数, 不能按它分配内存
+	for _, b := range [][]byte{
+		join(header, uvarint(0), uvarint(1<<62)),
+		join(header, uvarint(0), uvarint(1<<40)),
+		join(header, uvarint(0), uvarint(0), uvarint(1<<62)),
+		join(header, uvarint(0), uvarint(0), uvarint(1), uvarint(1), []byte("t"), uvarint(1<<62)),
+		join(header, uvarint(0), []byte{0xff, 0xff}),
+	} {
+		assert.NotPanics(t, func() {
+			_, err := codec.Decode(b)
+			assert.NotNil(t, err)
+		})
+	}
+
+	// 截断的消息都返回错误, 不会panic
+	full, err := codec.Encode(testGossipMessage(5, 3))
+	assert.Nil(t, err)
+	for i := 0; i < len(full); i++ {
+		assert.NotPanics(t, func() {
+			_, err := codec.Decode(full[:i])
+			assert.NotNil(t, err, "len:%d", i)
+		})
+	}
+}
+
+func TestGossipDeltaState(t *testing.T) {
+	s, err := NewTopicStateWithConf("s-1", GossipConf{Addr: "127.0.0.1", Codec: GossipCodecBinary, DeltaState: true})
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Nil(t, s.UpdateTopic(ADD, []string{"topic1", "topic2"}, false))
+	assert.Nil(t, s.UpdateTopic(DEL, []string{"topic2"}, false))
+	s.merge([]TopicInfo{{Op: ADD, Topic: "topic1", Service: "s-2", Version: 1}})
+
+	d := &GossipDelegate{state: s}
+	msg, err := decodeGossip(JSONGossipCodec{}, d.LocalState(false))
+	assert.Nil(t, err)
+	assert.Equal(t, "s-1", msg.From)
+	assert.Equal(t, []TopicInfo{
+		{Op: ADD, Topic: "topic1", Service: "s-1", Version: 1},
+		{Op: DEL, Topic: "topic2", Service: "s-1", Version: 3},
+	}, msg.Updates)
+
+	s2, err := NewTopicStateWithConf("s-3", GossipConf{Addr: "127.0.0.1"})
+	assert.Nil(t, err)
+	defer s2.Close()
+	(&GossipDelegate{state: s2}).MergeRemoteState(d.LocalState(false), false)
+	assert.Equal(t, map[string][]string{"topic1": {"s-1"}}, s2.Subscriptions())
+}
@@ -0,0 +1,180 @@
+package topicservice
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// gossip 发现模式(ServiceConfig.Discovery = "gossip"), 不需要etcd, 适合小规模部署和测试:
+//  1. 通过GossipConf.Seeds 加入memberlist 集群, 服务列表来自gossip 成员的元数据(NodeMetadata), 不用注册到etcd
+//  2. leader 是确定的: 配置了IsLeader 的服务优先, 然后按Key() 排序取第一个, 所有服务看到的成员一样时, 选出的leader 也一样
+//  3. 每个服务用同样的成员列表和负载算法在本地计算 topic-->services, 不需要leader 写到etcd 再watch
+//  4. 依赖etcd 的功能不可用: 分步迁移(Rebalance), 交接(OnHandoff), etcd 的订阅关系存储
+
+const (
+	DiscoveryEtcd   = "etcd"
+	DiscoveryGossip = "gossip"
+
+	seedJoinRetryDelay = time.Second * 3
+)
+
+func (s *Service) gossipDiscovery() bool {
+	return s.sc.Discovery == DiscoveryGossip
+}
+
+// 检查gossip 发现模式的配置, 在NewService 里调用
+func checkGossipDiscovery(sc *ServiceConfig) error {
+	if !sc.Gossip.Enabled {
+		return fmt.Errorf("gossip discovery requires Gossip.Enabled")
+	}
+	if sc.Rebalance.MaxMoves > 0 {
+		logx.Errorf("rebalance is not supported in gossip discovery, ignored")
+	}
+	return nil
+}
+
+// 把gossip 成员的元数据转成服务的配置
+func memberInfo(meta NodeMetadata) ServiceInfo {
+	return ServiceInfo{
+		Name:      meta.Name,
+		Id:        meta.Id,
+		Endpoints: meta.Endpoints,
+		Weight:    meta.Weight,
+		Priority:  meta.Priority,
+		Version:   meta.Version,
+		IsLeader:  meta.IsLeader,
+		Draining:  meta.Draining,
+		Forward:   ForwardConf{Addr: meta.ForwardAddr},
+		Gossip:    GossipConf{Enabled: true},
+	}
+}
+
+// gossipMembers 根据gossip 成员的元数据生成服务列表, 包括自己, 按Key() 排序。
+// 自己也用元数据生成, 保证每个服务算出来的列表一样
+func (s *Service) gossipMembers() []ServiceInfo {
+	list := []ServiceInfo{memberInfo(s.topicState.LocalMeta())}
+	for name, meta := range s.topicState.PeersMeta() {
+		if meta.Name == "" || meta.Id == "" {
+			logx.Debugf("gossip node:%s has no service meta, skip", name)
+			continue
+		}
+		list = append(list, memberInfo(meta))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].String() < list[j].String()
+	})
+	return list
+}
+
+// electGossipLeader list 已经按Key() 排序
+func electGossipLeader(list []ServiceInfo) ServiceInfo {
+	for _, v := range list {
+		if v.IsLeader {
+			return v
+		}
+	}
+	return list[0]
+}
+
+func (s *Service) startGossipDiscovery() error {
+	changed := make(chan struct{}, 1)
+	s.topicState.OnMemberChange(func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	s.updateGossipMembers()
+	go s.joinSeeds()
+	go func() {
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-changed:
+				s.updateGossipMembers()
+			}
+		}
+	}()
+	return nil
+}
+
+// 加入种子节点, 失败后重试, 直到加入成功或者服务退出; 没有配置种子时自己就是第一个节点, 等别人来加入
+func (s *Service) joinSeeds() {
+	seeds := s.sc.Gossip.Seeds
+	if len(seeds) == 0 {
+		return
+	}
+	for {
+		err := s.topicState.Join(seeds)
+		if err == nil {
+			logx.Infof("%s join gossip seeds:%v", s.Key(), seeds)
+			return
+		}
+		logx.Errorf("%s join gossip seeds:%v err:%v", s.Key(), seeds, err)
+		if !sleepCtx(s.ctx, seedJoinRetryDelay) {
+			return
+		}
+	}
+}
+
+// 成员变化后重新选leader, 服务列表变化时重新分配topic
+func (s *Service) updateGossipMembers() {
+	list := s.gossipMembers()
+	leader := electGossipLeader(list)
+	s.Lock()
+	changed := !reflect.DeepEqual(s.serviceList, list)
+	s.serviceList = list
+	s.isLeader = leader.String() == s.Key()
+	s.Unlock()
+
+	s.setLeader(leader)
+	if changed {
+		logx.Infof("%s gossip service list changed, len:%d", s.Key(), len(list))
+		s.assignTopicsLocal()
+	}
+}
+
+// assignTopicsLocal 本地计算 topic-->services, 结果和etcd 模式下从etcd 拿到的一样保存在distributedTopics。
+// 每个节点各自计算, 没有leader 统一, 所以计算只能依赖所有节点都一样的输入:
+// 服务列表排序, topic 排序, 每次都从新的负载算法实例开始(不带上次计算留下的状态, 比如least_topics 的计数)。
+// 负载算法本身也要是确定的, 同样的输入同样的结果
+func (s *Service) assignTopicsLocal() {
+	s.assignLock.Lock()
+	defer s.assignLock.Unlock()
+	list := s.assignableServices()
+	if len(list) == 0 {
+		return
+	}
+	start := time.Now()
+	s.balance.UpdateServices(list)
+	s.balance.Reset()
+	counts := make(map[string]int, len(list))
+	topics := make(map[string]string)
+	balancers := make(map[string]string)
+	all := s.GetTopics()
+	sort.Strings(all)
+	s.balance.RetainTopics(all)
+	for _, topic := range all {
+		services := s.balance.GetServiceByTopic(topic)
+		names := make([]string, 0, len(services))
+		for _, v := range services {
+			names = append(names, v.String())
+			counts[v.String()]++
+		}
+		topics[topic] = strings.Join(names, TopicServiceSeq)
+		if name := s.balance.TopicBalancerName(topic); name != "" {
+			balancers[topic] = name
+		}
+	}
+	s.SetDistributedTopics(topics)
+	s.Lock()
+	s.distributedBalancers = balancers
+	s.Unlock()
+	s.metrics.Load().assigned("local", start, counts)
+}
@@ -0,0 +1,106 @@
+package topicservice
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newGossipService(t *testing.T, id string, seeds []string) *Service {
+	s, err := NewService(&ServiceConfig{
+		Name:      "topic_service",
+		Id:        id,
+		Discovery: DiscoveryGossip,
+		Gossip:    GossipConf{Enabled: true, Addr: "127.0.0.1", Seeds: seeds},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetTopics([]string{"topic1", "topic2", "topic3", "topic4"})
+	assert.Nil(t, s.Start(context.Background()))
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+func TestGossipDiscovery(t *testing.T) {
+	_, err := NewService(&ServiceConfig{Name: "topic_service", Id: "1", Discovery: DiscoveryGossip})
+	assert.NotNil(t, err)
+
+	s1 := newGossipService(t, "1", nil)
+	assert.True(t, s1.IsLeader())
+	assert.Len(t, s1.DistributedTopics(), 4)
+
+	seed := s1.topicState.cluster.LocalNode().Address()
+	s2 := newGossipService(t, "2", []string{seed})
+	s3 := newGossipService(t, "3", []string{seed})
+	services := []*Service{s1, s2, s3}
+
+	// 所有服务看到同样的成员, 选出同一个leader, 本地算出同样的分配结果
+	assert.Eventually(t, func() bool {
+		for _, s := range services {
+			if len(s.getServiceList()) != 3 || !assert.ObjectsAreEqual(s1.DistributedTopics(), s.DistributedTopics()) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, s := range services {
+		leader, ok := s.Leader()
+		assert.True(t, ok)
+		assert.Equal(t, "topic_service-1", leader.String())
+	}
+	assert.False(t, s2.IsLeader())
+
+	// leader 离开, 剩下的服务选出新leader 并重新分配
+	assert.Nil(t, s1.Stop())
+	assert.Eventually(t, func() bool {
+		for _, services := range s2.DistributedTopics() {
+			if strings.Contains(services, "topic_service-1") {
+				return false
+			}
+		}
+		return len(s3.getServiceList()) == 2 && assert.ObjectsAreEqual(s2.DistributedTopics(), s3.DistributedTopics())
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, s2.IsLeader())
+	assert.False(t, s3.IsLeader())
+}
+
+func TestGossipAssignDeterministic(t *testing.T) {
+	// least_topics 有状态, 每个节点各自计算, 历史不同(s1 先单独分配过)、topic 顺序不同也要得到一样的结果
+	start := func(id string, seeds []string, topics []string) *Service {
+		s, err := NewService(&ServiceConfig{
+			Name:           "topic_service",
+			Id:             id,
+			Discovery:      DiscoveryGossip,
+			Balancer:       LeastTopicsBalancer,
+			TopicBalancers: map[string]string{"topic9": LeastTopicsBalancer},
+			Gossip:         GossipConf{Enabled: true, Addr: "127.0.0.1", Seeds: seeds},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetTopics(topics)
+		assert.Nil(t, s.Start(context.Background()))
+		t.Cleanup(func() { s.Stop() })
+		return s
+	}
+	topics := []string{"topic1", "topic2", "topic3", "topic4", "topic5", "topic6", "topic9"}
+	reversed := make([]string, 0, len(topics))
+	for i := len(topics) - 1; i >= 0; i-- {
+		reversed = append(reversed, topics[i])
+	}
+	s1 := start("1", nil, topics)
+	assert.Len(t, s1.DistributedTopics(), len(topics))
+	s2 := start("2", []string{s1.topicState.cluster.LocalNode().Address()}, reversed)
+
+	assert.Eventually(t, func() bool {
+		return len(s1.getServiceList()) == 2 && len(s2.getServiceList()) == 2 &&
+			assert.ObjectsAreEqual(s1.DistributedTopics(), s2.DistributedTopics())
+	}, 5*time.Second, 10*time.Millisecond)
+	// 两个服务都分到了topic
+	assert.Contains(t, strings.Join(mapValues(s1.DistributedTopics()), ";"), s2.Key())
+	assert.NotNil(t, s1.SetTopicBalancer("topic1", ConsistentHashBalancer))
+}
@@ -0,0 +1,111 @@
+package topicservice
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// gossip 的安全:
+//   - GossipConf.SecretKeys: memberlist 用keyring 加密(AES-GCM)所有的gossip 包, 没有密钥的节点加入不了集群, 也注入不了消息。
+//     第一个是主密钥, 用来加密, 其他的只用来解密。轮换密钥: 所有节点SetSecretKeys([new, old]),
+//     然后所有节点SetSecretKeys([new]), 这期间新旧密钥加密的包都能解开。
+//   - GossipConf.Label: 包外面带上集群标签, 标签不同的包直接丢弃, 用来隔离同一个网络里的多个集群(不是加密)。
+//   - 广播的消息带上发送节点的名字, 只接受发送节点修改自己的记录(Service == From), 而且发送节点必须是集群成员,
+//     没有From 的消息(旧格式)一律不接受。push/pull 同步的全量数据里本来就有其他节点的记录, 不做这个检查, 靠版本合并。
+//     memberlist 的NotifyMsg 拿不到传输层的发送地址, From 是消息自己声明的: 不加密时能连上gossip 端口的人
+//     都可以冒充任意成员, 这个检查只能防止成员的bug 改了别人的记录; 只有配置了SecretKeys, 才只有持有密钥的节点能发消息。
+//     SecretKeys 不会随ServiceConfig 发布到etcd 和管理接口, 见publicValue
+
+var ErrInvalidSender = errors.New("gossip message service does not match sender")
+
+// decodeSecretKeys base64 的密钥, 长度必须是16/24/32 字节(AES-128/192/256)
+func decodeSecretKeys(keys []string) ([][]byte, error) {
+	decoded := make([][]byte, 0, len(keys))
+	for i, key := range keys {
+		b, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gossip secret key[%d]: %w", i, err)
+		}
+		if err := memberlist.ValidateKey(b); err != nil {
+			return nil, fmt.Errorf("invalid gossip secret key[%d]: %w", i, err)
+		}
+		decoded = append(decoded, b)
+	}
+	return decoded, nil
+}
+
+func newKeyring(keys []string) (*memberlist.Keyring, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	decoded, err := decodeSecretKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	return memberlist.NewKeyring(decoded, decoded[0])
+}
+
+// Encrypted gossip 是否加密
+func (s *TopicState) Encrypted() bool {
+	return s.keyring != nil
+}
+
+// SetSecretKeys 轮换密钥: 安装keys 里的所有密钥, 第一个作为主密钥, 删除不在keys 里的密钥。
+// 只能在创建时配置了SecretKeys 的TopicState 上调用, 不能从不加密切换到加密
+func (s *TopicState) SetSecretKeys(keys []string) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("gossip secret keys is empty")
+	}
+	if s.keyring == nil {
+		return fmt.Errorf("gossip encryption is not enabled")
+	}
+	decoded, err := decodeSecretKeys(keys)
+	if err != nil {
+		return err
+	}
+	for _, key := range decoded {
+		if err := s.keyring.AddKey(key); err != nil {
+			return err
+		}
+	}
+	if err := s.keyring.UseKey(decoded[0]); err != nil {
+		return err
+	}
+	keep := make(map[string]bool, len(decoded))
+	for _, key := range decoded {
+		keep[string(key)] = true
+	}
+	for _, key := range s.keyring.GetKeys() {
+		if keep[string(key)] {
+			continue
+		}
+		if err := s.keyring.RemoveKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *TopicState) encodeMessage(updates []TopicInfo) ([]byte, error) {
+	return s.codec.Encode(GossipMessage{From: s.name, Updates: updates})
+}
+
+// decodeMessage 解析广播的消息, 并检查每条记录都是发送节点自己的, 不接受没有From 的旧格式([]TopicInfo)
+func (s *TopicState) decodeMessage(b []byte) ([]TopicInfo, error) {
+	msg, err := decodeGossip(s.codec, b)
+	if err != nil {
+		return nil, err
+	}
+	if msg.From == "" || msg.From == s.name || !s.isMember(msg.From) {
+		return nil, fmt.Errorf("unknown sender:%q", msg.From)
+	}
+	for _, info := range msg.Updates {
+		if info.Service != msg.From {
+			return nil, fmt.Errorf("%w, sender:%s, service:%s, topic:%s", ErrInvalidSender, msg.From, info.Service, info.Topic)
+		}
+	}
+	return msg.Updates, nil
+}
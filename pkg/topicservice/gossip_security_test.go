@@ -0,0 +1,120 @@
+package topicservice
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(b byte) string {
+	key := make([]byte, 16)
+	for i := range key {
+		key[i] = b
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func newSecureTopicState(t *testing.T, name string, conf GossipConf) *TopicState {
+	conf.Addr = "127.0.0.1"
+	s, err := NewTopicStateWithConf(name, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestGossipSecretKeys(t *testing.T) {
+	_, err := NewTopicStateWithConf("s-0", GossipConf{Addr: "127.0.0.1", SecretKeys: []string{"short"}})
+	assert.NotNil(t, err)
+
+	k1, k2 := testKey(1), testKey(2)
+	s1 := newSecureTopicState(t, "s-1", GossipConf{SecretKeys: []string{k1}, Label: "c1"})
+	assert.True(t, s1.Encrypted())
+	addr := s1.cluster.LocalNode().Address()
+
+	// 密钥不对, 标签不对, 都加入不了
+	wrongKey := newSecureTopicState(t, "s-x", GossipConf{SecretKeys: []string{k2}, Label: "c1"})
+	assert.NotNil(t, wrongKey.Join([]string{addr}))
+	wrongLabel := newSecureTopicState(t, "s-y", GossipConf{SecretKeys: []string{k1}, Label: "c2"})
+	assert.NotNil(t, wrongLabel.Join([]string{addr}))
+	plain := newSecureTopicState(t, "s-z", GossipConf{Label: "c1"})
+	assert.NotNil(t, plain.Join([]string{addr}))
+
+	s2 := newSecureTopicState(t, "s-2", GossipConf{SecretKeys: []string{k1}, Label: "c1"})
+	assert.Nil(t, s2.Join([]string{addr}))
+	assert.Nil(t, s2.Subscribe("topic1"))
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"s-2"}, s1.Subscribers("topic1"))
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// 轮换密钥: 先都装上新密钥, 再都删掉旧密钥
+	assert.Nil(t, s1.SetSecretKeys([]string{k2, k1}))
+	assert.Nil(t, s2.SetSecretKeys([]string{k2, k1}))
+	assert.Nil(t, s1.SetSecretKeys([]string{k2}))
+	assert.Nil(t, s2.SetSecretKeys([]string{k2}))
+	assert.Equal(t, 1, len(s1.keyring.GetKeys()))
+
+	s3 := newSecureTopicState(t, "s-3", GossipConf{SecretKeys: []string{k2}, Label: "c1"})
+	assert.Nil(t, s3.Join([]string{addr}))
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"s-2"}, s3.Subscribers("topic1"))
+	}, 3*time.Second, 10*time.Millisecond)
+
+	assert.NotNil(t, plain.SetSecretKeys([]string{k1}))
+}
+
+func TestGossipSenderValidation(t *testing.T) {
+	s1 := newSecureTopicState(t, "s-1", GossipConf{SecretKeys: []string{testKey(1)}})
+	s2 := newSecureTopicState(t, "s-2", GossipConf{SecretKeys: []string{testKey(1)}})
+	assert.Nil(t, s2.Join([]string{s1.cluster.LocalNode().Address()}))
+
+	msg, _ := json.Marshal(GossipMessage{From: "s-2", Updates: []TopicInfo{{Op: ADD, Topic: "topic1", Service: "s-2", Version: 1}}})
+	updates, err := s1.decodeMessage(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(updates))
+
+	// s-2 冒充s-3
+	msg, _ = json.Marshal(GossipMessage{From: "s-2", Updates: []TopicInfo{{Op: DEL, Topic: "topic1", Service: "s-3", Version: 9}}})
+	_, err = s1.decodeMessage(msg)
+	assert.True(t, errors.Is(err, ErrInvalidSender))
+
+	// 不是集群成员
+	msg, _ = json.Marshal(GossipMessage{From: "s-9", Updates: []TopicInfo{{Op: ADD, Topic: "topic1", Service: "s-9", Version: 1}}})
+	_, err = s1.decodeMessage(msg)
+	assert.NotNil(t, err)
+
+	// 不接受没有发送者的旧格式, 不加密时也一样
+	legacy, _ := json.Marshal([]TopicInfo{{Op: ADD, Topic: "topic1", Service: "s-2"}})
+	_, err = s1.decodeMessage(legacy)
+	assert.NotNil(t, err)
+	plain := newSecureTopicState(t, "s-4", GossipConf{})
+	_, err = plain.decodeMessage(legacy)
+	assert.NotNil(t, err)
+
+	(&GossipDelegate{state: s1}).NotifyMsg(msg)
+	assert.Empty(t, s1.Subscribers("topic1"))
+}
+
+func TestPublicValueRedactsSecrets(t *testing.T) {
+	key := testKey(1)
+	sc := ServiceConfig{Name: "topic_service", Id: "1", Gossip: GossipConf{Enabled: true, SecretKeys: []string{key}}}
+	sc.Etcd.Pass = "etcd-pass"
+	sc.Subscription.Redis.Pass = "redis-pass"
+	data, err := publicValue(sc)
+	assert.Nil(t, err)
+	for _, secret := range []string{key, "etcd-pass", "redis-pass"} {
+		assert.NotContains(t, string(data), secret)
+	}
+	// 只去掉发布出去的, 本地的配置不变
+	assert.Equal(t, []string{key}, sc.Gossip.SecretKeys)
+
+	var published ServiceConfig
+	assert.Nil(t, json.Unmarshal(data, &published))
+	assert.Equal(t, sc.String(), published.String())
+	assert.True(t, published.Gossip.Enabled)
+}
@@ -0,0 +1,270 @@
+package topicservice
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zeromicro/go-zero/core/discov"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// 集成测试: 进程内启动embed etcd 和多个Service, 不需要外部的etcd, go test -short 时跳过
+
+// startEmbedEtcd 启动单节点的etcd, 端口随机, 测试结束后关闭, 返回client 地址
+func startEmbedEtcd(t *testing.T) []string {
+	t.Helper()
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	local, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenClientUrls = []url.URL{*local}
+	cfg.AdvertiseClientUrls = []url.URL{*local}
+	cfg.ListenPeerUrls = []url.URL{*local}
+	cfg.AdvertisePeerUrls = []url.URL{*local}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("embed etcd start timeout")
+	}
+	return []string{e.Clients[0].Addr().String()}
+}
+
+type testCluster struct {
+	t        *testing.T
+	hosts    []string
+	services []*Service
+	conf     func(sc *ServiceConfig) // 修改默认的配置
+}
+
+func newTestCluster(t *testing.T) *testCluster {
+	if testing.Short() {
+		t.Skip("skip embed etcd integration test in short mode")
+	}
+	return &testCluster{t: t, hosts: startEmbedEtcd(t)}
+}
+
+// start 启动一个etcd 发现模式的Service, topics 是要分配的topic
+func (c *testCluster) start(id string, isLeader bool, topics []string) *Service {
+	c.t.Helper()
+	sc := &ServiceConfig{
+		Name:        "topic_service",
+		Id:          id,
+		IsLeader:    isLeader,
+		ElectionTTL: 2,
+		Etcd:        discov.EtcdConf{Hosts: c.hosts, Key: "services"},
+	}
+	if c.conf != nil {
+		c.conf(sc)
+	}
+	s, err := NewService(sc)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	s.SetTopics(topics)
+	if err := s.Start(context.Background()); err != nil {
+		c.t.Fatal(err)
+	}
+	c.t.Cleanup(func() { s.Stop() })
+	c.services = append(c.services, s)
+	return s
+}
+
+// service 创建一个有etcd client 但是没有Start 的Service, 用来单独测试某个功能
+func (c *testCluster) service(id string) *Service {
+	c.t.Helper()
+	s, err := NewService(&ServiceConfig{
+		Name: "topic_service",
+		Id:   id,
+		Etcd: discov.EtcdConf{Hosts: c.hosts, Key: "services"},
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if s.etcdClient, err = newEtcdClient(*s.sc); err != nil {
+		c.t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.ctx, s.cancel = ctx, cancel
+	c.t.Cleanup(func() {
+		cancel()
+		s.etcdClient.Close()
+	})
+	return s
+}
+
+// waitAssigned 等所有服务都看到同样的分配结果, 并且每个topic 都分配给了alive 里的服务
+func (c *testCluster) waitAssigned(alive []*Service, topics int) {
+	c.t.Helper()
+	keys := make(map[string]bool, len(alive))
+	for _, s := range alive {
+		keys[s.Key()] = true
+	}
+	assert.Eventually(c.t, func() bool {
+		want := alive[0].DistributedTopics()
+		if len(want) != topics {
+			return false
+		}
+		for _, services := range want {
+			for _, v := range strings.Split(services, TopicServiceSeq) {
+				if !keys[v] {
+					return false
+				}
+			}
+		}
+		for _, s := range alive[1:] {
+			if !assert.ObjectsAreEqual(want, s.DistributedTopics()) {
+				return false
+			}
+		}
+		return true
+	}, 15*time.Second, 20*time.Millisecond)
+}
+
+// waitLeader 等alive 里只有leader 是leader, 并且所有服务都观察到了它
+func (c *testCluster) waitLeader(alive []*Service) *Service {
+	c.t.Helper()
+	var leader *Service
+	assert.Eventually(c.t, func() bool {
+		leader = nil
+		for _, s := range alive {
+			if s.IsLeader() {
+				if leader != nil {
+					return false
+				}
+				leader = s
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, s := range alive {
+			if l, ok := s.Leader(); !ok || l.String() != leader.Key() {
+				return false
+			}
+		}
+		return true
+	}, 15*time.Second, 20*time.Millisecond)
+	return leader
+}
+
+func TestIntegrationElectionFailover(t *testing.T) {
+	c := newTestCluster(t)
+	topics := []string{"topic1", "topic2", "topic3", "topic4", "topic5", "topic6"}
+	s1 := c.start("1", true, topics)
+	s2 := c.start("2", false, topics)
+	s3 := c.start("3", false, topics)
+
+	// 配置了IsLeader 的服务优先成为leader, 把topic 分配给所有服务
+	alive := []*Service{s1, s2, s3}
+	assert.Equal(t, s1.Key(), c.waitLeader(alive).Key())
+	c.waitAssigned(alive, len(topics))
+	for _, s := range alive {
+		assert.Len(t, s.getServiceList(), 3)
+	}
+
+	// leader 退出, 剩下的服务选出新leader, topic 重新分配给剩下的服务
+	assert.Nil(t, s1.Stop())
+	alive = []*Service{s2, s3}
+	leader := c.waitLeader(alive)
+	assert.NotEqual(t, s1.Key(), leader.Key())
+	c.waitAssigned(alive, len(topics))
+
+	// 新服务加入, 新leader 把它加进分配结果
+	s4 := c.start("4", false, topics)
+	alive = append(alive, s4)
+	c.waitAssigned(alive, len(topics))
+	assert.Equal(t, leader.Key(), c.waitLeader(alive).Key())
+}
+
+func TestIntegrationCatalog(t *testing.T) {
+	c := newTestCluster(t)
+	s1 := c.start("1", true, []string{"topic1"})
+	s2 := c.start("2", false, []string{"topic1"})
+	alive := []*Service{s1, s2}
+	c.waitLeader(alive)
+	c.waitAssigned(alive, 1)
+
+	// 任意服务都可以修改目录, leader watch 到后重新分配
+	ctx := context.Background()
+	assert.Nil(t, s2.CreateTopic(ctx, TopicSpec{Name: "topic2", Replicas: 2}))
+	assert.ErrorIs(t, s2.CreateTopic(ctx, TopicSpec{Name: "topic2"}), ErrTopicExists)
+	c.waitAssigned(alive, 2)
+	assert.Eventually(t, func() bool {
+		return strings.Count(s2.DistributedTopics()["topic2"], TopicServiceSeq) == 1
+	}, 10*time.Second, 20*time.Millisecond)
+
+	assert.Nil(t, s1.DeleteTopic(ctx, "topic2"))
+	assert.ErrorIs(t, s1.DeleteTopic(ctx, "topic2"), ErrTopicNotFound)
+	c.waitAssigned(alive, 1)
+}
+
+func TestIntegrationTopicLayoutManyTopics(t *testing.T) {
+	testTopics := func(n int) []string {
+		topics := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			topics = append(topics, fmt.Sprintf("topic%d", i))
+		}
+		return topics
+	}
+
+	// 每个topic 一个key, 一个事务最多修改maxTxnOps 个key
+	c := newTestCluster(t)
+	c.conf = func(sc *ServiceConfig) { sc.TopicLayout = TopicLayoutTopic }
+	topics := testTopics(maxTxnOps)
+	s1 := c.start("1", true, topics)
+	s2 := c.start("2", false, topics)
+	alive := []*Service{s1, s2}
+	c.waitLeader(alive)
+	c.waitAssigned(alive, len(topics))
+
+	// 超过了不拆成多个事务, 直接报错, follower 还是看到完整的旧分配结果
+	more := make(map[string]string)
+	for _, topic := range testTopics(2 * maxTxnOps) {
+		more[topic] = topicData(topic, []ServiceInfo{{Name: "topic_service", Id: "1"}}, "")
+	}
+	assert.ErrorIs(t, s1.setTopicToEtcd(more), ErrTooManyTopicKeys)
+	time.Sleep(200 * time.Millisecond)
+	assert.Len(t, s2.DistributedTopics(), len(topics))
+
+	// 按node 分片, key 数是service 的个数
+	c = newTestCluster(t)
+	c.conf = func(sc *ServiceConfig) { sc.TopicLayout = TopicLayoutNode }
+	topics = testTopics(3 * maxTxnOps)
+	s1 = c.start("1", true, topics)
+	s2 = c.start("2", false, topics)
+	alive = []*Service{s1, s2}
+	c.waitLeader(alive)
+	c.waitAssigned(alive, len(topics))
+}
+
+func TestIntegrationPublishRing(t *testing.T) {
+	c := newTestCluster(t)
+	topics := []string{"topic1", "topic2", "topic3"}
+	s1 := c.start("1", true, topics)
+	s2 := c.start("2", false, topics)
+	alive := []*Service{s1, s2}
+	c.waitLeader(alive)
+	c.waitAssigned(alive, len(topics))
+
+	// leader 发布分配用的环, 所有服务的环和它一样
+	assert.Eventually(t, func() bool {
+		ring, err := s2.PublishedRing(context.Background())
+		if err != nil || len(ring.Nodes) != 2 {
+			return false
+		}
+		return ring.Fingerprint() == s1.RingFingerprint() && ring.Fingerprint() == s2.RingFingerprint()
+	}, 10*time.Second, 20*time.Millisecond)
+	assert.Equal(t, s1.RingFingerprint(), s2.AdminStatus().RingFingerprint)
+}
@@ -0,0 +1,147 @@
+package topicservice
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics topicservice 的prometheus 指标, 用Service.RegisterMetrics 注册到调用者的registry,
+// broker 把registry 暴露出去就能采集。所有指标都带service 标签(ServiceInfo.String()), 同一个进程里多个Service 可以注册到同一个registry。
+// 方法都可以在nil 上调用, 没有注册指标时什么都不做。
+type Metrics struct {
+	leaderChanges    prometheus.Counter
+	assignments      *prometheus.CounterVec //label mode: leader|local
+	assignDuration   prometheus.Histogram
+	topicsPerService *prometheus.GaugeVec   //label target: 分配到的service
+	etcdWriteErrors  *prometheus.CounterVec //label op: topics|handoffs|subscription
+	leaseLost        *prometheus.CounterVec //label lease: election|subscription
+	broadcasts       prometheus.Counter
+	mergeSize        *prometheus.HistogramVec //label source: broadcast|push_pull
+}
+
+const metricsNamespace = "topicservice"
+
+// RegisterMetrics 创建指标并注册到reg, 在Start 之前调用
+func (s *Service) RegisterMetrics(reg prometheus.Registerer) error {
+	labels := prometheus.Labels{"service": s.Key()}
+	m := &Metrics{
+		leaderChanges: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "leader_changes_total", ConstLabels: labels,
+			Help: "Number of leader changes observed by this service.",
+		}),
+		assignments: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "assignments_total", ConstLabels: labels,
+			Help: "Number of topic assignment recomputations.",
+		}, []string{"mode"}),
+		assignDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Name: "assignment_duration_seconds", ConstLabels: labels,
+			Help:    "Duration of topic assignment recomputations, including the etcd write on the leader.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		}),
+		topicsPerService: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace, Name: "assigned_topics", ConstLabels: labels,
+			Help: "Number of topics assigned to each target service by the last assignment.",
+		}, []string{"target"}),
+		etcdWriteErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "etcd_write_errors_total", ConstLabels: labels,
+			Help: "Number of failed etcd writes.",
+		}, []string{"op"}),
+		leaseLost: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "lease_lost_total", ConstLabels: labels,
+			Help: "Number of etcd sessions whose lease keepalive was lost.",
+		}, []string{"lease"}),
+		broadcasts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Name: "gossip_broadcasts_total", ConstLabels: labels,
+			Help: "Number of gossip broadcasts queued.",
+		}),
+		mergeSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Name: "gossip_merge_entries", ConstLabels: labels,
+			Help:    "Number of entries in each merged gossip message or remote state.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		}, []string{"source"}),
+	}
+	collectors := []prometheus.Collector{
+		m.leaderChanges, m.assignments, m.assignDuration, m.topicsPerService,
+		m.etcdWriteErrors, m.leaseLost, m.broadcasts, m.mergeSize,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace, Name: "is_leader", ConstLabels: labels,
+			Help: "1 if this service is the leader.",
+		}, func() float64 {
+			if s.IsLeader() {
+				return 1
+			}
+			return 0
+		}),
+	}
+	if s.topicState != nil {
+		ts := s.topicState
+		collectors = append(collectors,
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: metricsNamespace, Name: "gossip_members", ConstLabels: labels,
+				Help: "Number of alive gossip members, including this service.",
+			}, func() float64 { return float64(ts.cluster.NumMembers()) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: metricsNamespace, Name: "gossip_broadcast_queue", ConstLabels: labels,
+				Help: "Number of gossip broadcasts waiting to be sent.",
+			}, func() float64 { return float64(ts.broadcasts.NumQueued()) }),
+		)
+	}
+	for i, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			// 把已经注册的取消掉, 否则重试时会AlreadyRegistered
+			for _, registered := range collectors[:i] {
+				reg.Unregister(registered)
+			}
+			return err
+		}
+	}
+	s.metrics.Store(m)
+	if s.topicState != nil {
+		s.topicState.metrics.Store(m)
+	}
+	return nil
+}
+
+func (m *Metrics) leaderChanged() {
+	if m != nil {
+		m.leaderChanges.Inc()
+	}
+}
+
+// assigned 记录一次分配, counts: service-->分配到的topic 数
+func (m *Metrics) assigned(mode string, start time.Time, counts map[string]int) {
+	if m == nil {
+		return
+	}
+	m.assignments.WithLabelValues(mode).Inc()
+	m.assignDuration.Observe(time.Since(start).Seconds())
+	m.topicsPerService.Reset()
+	for target, n := range counts {
+		m.topicsPerService.WithLabelValues(target).Set(float64(n))
+	}
+}
+
+func (m *Metrics) etcdWriteFailed(op string) {
+	if m != nil {
+		m.etcdWriteErrors.WithLabelValues(op).Inc()
+	}
+}
+
+func (m *Metrics) leaseLostInc(lease string) {
+	if m != nil {
+		m.leaseLost.WithLabelValues(lease).Inc()
+	}
+}
+
+func (m *Metrics) broadcastQueued() {
+	if m != nil {
+		m.broadcasts.Inc()
+	}
+}
+
+func (m *Metrics) merged(source string, n int) {
+	if m != nil {
+		m.mergeSize.WithLabelValues(source).Observe(float64(n))
+	}
+}
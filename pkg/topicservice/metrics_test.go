@@ -0,0 +1,106 @@
+package topicservice
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// 按名字和标签找指标的值
+func metricValue(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) (float64, bool) {
+	families, err := reg.Gather()
+	assert.Nil(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	next:
+		for _, m := range family.GetMetric() {
+			got := make(map[string]string)
+			for _, pair := range m.GetLabel() {
+				got[pair.GetName()] = pair.GetValue()
+			}
+			for k, v := range labels {
+				if got[k] != v {
+					continue next
+				}
+			}
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				return m.GetCounter().GetValue(), true
+			case dto.MetricType_GAUGE:
+				return m.GetGauge().GetValue(), true
+			case dto.MetricType_HISTOGRAM:
+				return float64(m.GetHistogram().GetSampleCount()), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func TestServiceMetrics(t *testing.T) {
+	s, err := NewService(&ServiceConfig{
+		Name:      "topic_service",
+		Id:        "1",
+		Discovery: DiscoveryGossip,
+		Gossip:    GossipConf{Enabled: true, Addr: "127.0.0.1"},
+	})
+	assert.Nil(t, err)
+	reg := prometheus.NewRegistry()
+	assert.Nil(t, s.RegisterMetrics(reg))
+	assert.NotNil(t, s.RegisterMetrics(reg)) //重复注册
+	s.SetTopics([]string{"topic1", "topic2", "topic3"})
+	assert.Nil(t, s.Start(context.Background()))
+	defer s.Stop()
+	s.AddTopicState("topic4")
+
+	self := map[string]string{"service": "topic_service-1"}
+	for _, c := range []struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}{
+		{"topicservice_is_leader", self, 1},
+		{"topicservice_leader_changes_total", self, 1},
+		{"topicservice_assignments_total", map[string]string{"mode": "local"}, 1},
+		{"topicservice_assignment_duration_seconds", self, 1},
+		{"topicservice_assigned_topics", map[string]string{"target": "topic_service-1"}, 3},
+		{"topicservice_gossip_members", self, 1},
+		{"topicservice_gossip_broadcasts_total", self, 1},
+	} {
+		v, ok := metricValue(t, reg, c.name, c.labels)
+		assert.True(t, ok, c.name)
+		assert.Equal(t, c.want, v, c.name)
+	}
+	_, ok := metricValue(t, reg, "topicservice_gossip_broadcast_queue", self)
+	assert.True(t, ok)
+}
+
+func TestServiceMetricsRegisterFailed(t *testing.T) {
+	s, err := NewService(&ServiceConfig{
+		Name:      "topic_service",
+		Id:        "1",
+		Discovery: DiscoveryGossip,
+		Gossip:    GossipConf{Enabled: true, Addr: "127.0.0.1"},
+	})
+	assert.Nil(t, err)
+	defer s.Stop()
+	reg := prometheus.NewRegistry()
+	// 中间的一个指标注册失败, 前面注册成功的要取消掉, 重试才能成功
+	conflict := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "gossip_broadcasts_total",
+		ConstLabels: prometheus.Labels{"service": s.Key()},
+		Help:        "Number of gossip broadcasts queued.",
+	})
+	assert.Nil(t, reg.Register(conflict))
+	assert.NotNil(t, s.RegisterMetrics(reg))
+	assert.Nil(t, s.metrics.Load())
+
+	assert.True(t, reg.Unregister(conflict))
+	assert.Nil(t, s.RegisterMetrics(reg))
+	_, ok := metricValue(t, reg, "topicservice_is_leader", map[string]string{"service": "topic_service-1"})
+	assert.True(t, ok)
+}
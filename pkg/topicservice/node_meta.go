@@ -0,0 +1,146 @@
+package topicservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// NodeMetadata 节点通过memberlist 的NodeMeta 告诉其他节点的信息, 修改后通过gossip 传播(其他节点收到NotifyUpdate),
+// 节点不用回etcd 查服务列表, 就能选择转发的目标。编码后不能超过memberlist.MetaMaxSize(512 字节)。
+type NodeMetadata struct {
+	Name        string   `json:"n,omitempty"`
+	Id          string   `json:"i,omitempty"`
+	IsLeader    bool     `json:"L,omitempty"` // 配置了IsLeader, gossip 模式下优先成为leader
+	Endpoints   []string `json:"e,omitempty"`
+	ForwardAddr string   `json:"f,omitempty"` // ForwardConf.Addr
+	Weight      int      `json:"w,omitempty"`
+	Priority    int      `json:"p,omitempty"`
+	Version     string   `json:"v,omitempty"` // 服务的版本
+	Load        int      `json:"l,omitempty"` // 负载, 比如连接数, 由服务自己定义
+	Draining    bool     `json:"d,omitempty"` // 正在下线, 不要再转发给它
+}
+
+// MemberChangeHandler 节点加入, 离开或者元数据变化时回调, 在memberlist 的goroutine 里调用, 不能阻塞
+type MemberChangeHandler func()
+
+// 广播元数据时等待的时间, 超时只是说明还没有广播出去, 之后还是会广播
+const metaUpdateTimeout = time.Second
+
+func encodeNodeMeta(meta NodeMetadata) ([]byte, error) {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > memberlist.MetaMaxSize {
+		return nil, fmt.Errorf("node meta size:%d exceeds limit:%d", len(b), memberlist.MetaMaxSize)
+	}
+	return b, nil
+}
+
+// SetMeta 设置本节点的元数据, 并广播给其他节点
+func (s *TopicState) SetMeta(meta NodeMetadata) error {
+	b, err := encodeNodeMeta(meta)
+	if err != nil {
+		return err
+	}
+	s.metaMu.Lock()
+	s.localMeta = meta
+	s.localMetaBytes = b
+	s.metaMu.Unlock()
+	return s.cluster.UpdateNode(metaUpdateTimeout)
+}
+
+// UpdateMeta 修改本节点的部分元数据, 比如只更新Load
+func (s *TopicState) UpdateMeta(fn func(meta *NodeMetadata)) error {
+	meta := s.LocalMeta()
+	fn(&meta)
+	return s.SetMeta(meta)
+}
+
+// LocalMeta 返回本节点的元数据
+func (s *TopicState) LocalMeta() NodeMetadata {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	meta := s.localMeta
+	meta.Endpoints = append([]string(nil), meta.Endpoints...)
+	return meta
+}
+
+// PeerMeta 返回其他节点的元数据, 节点不在集群里时返回false
+func (s *TopicState) PeerMeta(name string) (NodeMetadata, bool) {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	meta, ok := s.peerMeta[name]
+	return meta, ok
+}
+
+// PeersMeta 返回所有其他节点的元数据, key 是节点名字
+func (s *TopicState) PeersMeta() map[string]NodeMetadata {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	peers := make(map[string]NodeMetadata, len(s.peerMeta))
+	for name, meta := range s.peerMeta {
+		peers[name] = meta
+	}
+	return peers
+}
+
+// PeersByLoad 返回订阅了topic 的其他节点, 按Load 从小到大排序, 可以用来选择转发目标
+func (s *TopicState) PeersByLoad(topic string) []string {
+	peers := s.PeersMeta()
+	var names []string
+	for _, name := range s.Subscribers(topic) {
+		if _, ok := peers[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return peers[names[i]].Load < peers[names[j]].Load
+	})
+	return names
+}
+
+// OnMemberChange 注册成员变化的回调
+func (s *TopicState) OnMemberChange(fn MemberChangeHandler) {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	s.memberHandlers = append(s.memberHandlers, fn)
+}
+
+func (s *TopicState) notifyMemberChange() {
+	s.metaMu.Lock()
+	handlers := append([]MemberChangeHandler(nil), s.memberHandlers...)
+	s.metaMu.Unlock()
+	for _, fn := range handlers {
+		fn()
+	}
+}
+
+func (s *TopicState) updatePeerMeta(node *memberlist.Node) {
+	if node.Name == s.name {
+		return
+	}
+	var meta NodeMetadata
+	if len(node.Meta) > 0 {
+		if err := json.Unmarshal(node.Meta, &meta); err != nil {
+			logx.Errorf("invalid meta of gossip node:%s err:%v", node.Name, err)
+			return
+		}
+	}
+	s.metaMu.Lock()
+	s.peerMeta[node.Name] = meta
+	s.metaMu.Unlock()
+	s.notifyMemberChange()
+}
+
+func (s *TopicState) deletePeerMeta(name string) {
+	s.metaMu.Lock()
+	delete(s.peerMeta, name)
+	s.metaMu.Unlock()
+	s.notifyMemberChange()
+}
@@ -0,0 +1,49 @@
+package topicservice
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicStateNodeMeta(t *testing.T) {
+	s1 := newTestTopicState(t, "s-1")
+	s2 := newTestTopicState(t, "s-2")
+	assert.Nil(t, s2.SetMeta(NodeMetadata{Endpoints: []string{"127.0.0.1:8080"}, ForwardAddr: "127.0.0.1:9090", Weight: 10, Version: "v1.0.0"}))
+	assert.Nil(t, s2.UpdateTopic(ADD, []string{"topic1"}, false))
+	assert.Nil(t, s2.Join([]string{s1.cluster.LocalNode().Address()}))
+
+	assert.Eventually(t, func() bool {
+		meta, ok := s1.PeerMeta("s-2")
+		return ok && meta.ForwardAddr == "127.0.0.1:9090"
+	}, 3*time.Second, 10*time.Millisecond)
+	meta, _ := s1.PeerMeta("s-2")
+	assert.Equal(t, []string{"127.0.0.1:8080"}, meta.Endpoints)
+	assert.Equal(t, 10, meta.Weight)
+	assert.Equal(t, "v1.0.0", meta.Version)
+	_, ok := s2.PeerMeta("s-2") //不记录自己
+	assert.False(t, ok)
+
+	// 更新负载, 通过NotifyUpdate 传播
+	assert.Nil(t, s2.UpdateMeta(func(meta *NodeMetadata) { meta.Load = 42 }))
+	assert.Eventually(t, func() bool {
+		meta, _ := s1.PeerMeta("s-2")
+		return meta.Load == 42 && meta.Weight == 10
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"s-2"}, s1.PeersByLoad("topic1"))
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// 超过memberlist 的限制
+	err := s2.SetMeta(NodeMetadata{Version: strings.Repeat("x", 600)})
+	assert.NotNil(t, err)
+	assert.Equal(t, 42, s2.LocalMeta().Load)
+
+	assert.Nil(t, s2.Close())
+	assert.Eventually(t, func() bool {
+		_, ok := s1.PeerMeta("s-2")
+		return !ok
+	}, 3*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,475 @@
+package topicservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// 服务加入或离开时, leader 重新计算的分配结果里可能有很多topic 换了service, 如果一次性全部写到etcd,
+// 客户端会被集体重定向。配置了RebalanceConf.MaxMoves 后, leader 分步迁移topic:
+//  1. 新的topic, 或者原来的service 都已经不在了的topic, 直接使用新的分配结果(没有人可以交接)
+//  2. 其他需要迁移的topic 先进入pending 队列, etcd 上还是旧的分配结果
+//  3. 每一步最多有MaxMoves 个topic 处于draining 状态, leader 把交接信息写到 /ns/as/handoff/topic,
+//     旧service 收到后开始排空(drain)该topic 的客户端, 新service 收到后回调OnHandoff 准备接管,
+//     回调返回后通过TopicState 确认(TopicState.AckHandoff), 确认带着交接的StartAt, 区分同一个topic 的多次交接
+//  4. leader 在TopicState 里看到新service 都确认了, 或者超过HandoffTimeout, 才把该topic 的新分配结果写到etcd,
+//     并删除交接信息, 新service 看到交接信息删除后撤销确认, 然后leader 开始迁移下一个pending 的topic
+//
+// 确认和订阅关系(SubscriptionStore)是分开的, 订阅关系是客户端真实的订阅, 转发数据靠它。
+// 没有开启gossip(没有TopicState)时没有确认, 只能等超时
+const (
+	MovePending  = "pending"
+	MoveDraining = "draining"
+
+	defaultRebalanceStepInterval   = 5  // 秒
+	defaultRebalanceHandoffTimeout = 30 // 秒
+)
+
+type RebalanceConf struct {
+	MaxMoves       int `json:",optional"` // 同时迁移的topic 数, 0 表示不限制, 一次性全部迁移
+	StepInterval   int `json:",optional"` // 检查交接进度的间隔(秒), 默认5秒
+	HandoffTimeout int `json:",optional"` // 新service 没有确认时, 最多等多久(秒)就强制迁移, 默认30秒
+}
+
+// TopicMove 一个topic 从From 迁移到To, 也是写到 /ns/as/handoff/topic 的交接信息
+type TopicMove struct {
+	Topic   string
+	From    []string //旧的service, ServiceInfo.String()
+	To      []string //新的service
+	State   string
+	StartAt time.Time `json:",omitempty"`
+	data    string    //新的分配结果, topicData
+}
+
+// RebalanceStatus 当前的迁移计划和进度
+type RebalanceStatus struct {
+	Step     int
+	Moved    int //已经完成迁移的topic 数
+	Pending  []TopicMove
+	Draining []TopicMove
+}
+
+type HandoffRole int
+
+const (
+	HandoffFrom HandoffRole = iota + 1 //旧service, 需要排空客户端
+	HandoffTo                          //新service, 需要接管topic, 同时在From 和To 里的service 也是HandoffTo, 它不用排空
+)
+
+type HandoffHandler func(move TopicMove, role HandoffRole)
+
+// Rebalancer 分步迁移topic 的计划, 只在leader 上使用
+type Rebalancer struct {
+	mu      sync.Mutex
+	conf    RebalanceConf
+	applied map[string]string     //key:topic, value:topicData, 当前应该写到etcd 的分配结果
+	moves   map[string]*TopicMove //key:topic, pending 和 draining 的topic
+	queue   []string              //pending 的topic, 按顺序迁移
+	step    int
+	moved   int
+}
+
+func NewRebalancer(conf RebalanceConf) *Rebalancer {
+	if conf.StepInterval <= 0 {
+		conf.StepInterval = defaultRebalanceStepInterval
+	}
+	if conf.HandoffTimeout <= 0 {
+		conf.HandoffTimeout = defaultRebalanceHandoffTimeout
+	}
+	return &Rebalancer{
+		conf:    conf,
+		applied: make(map[string]string),
+		moves:   make(map[string]*TopicMove),
+	}
+}
+
+func (r *Rebalancer) Enabled() bool {
+	return r.conf.MaxMoves > 0
+}
+
+// topicData 里的service 列表
+func topicDataServices(data string) []string {
+	_, ss, err := parseTopicData(data)
+	if err != nil {
+		return nil
+	}
+	ss, _ = splitTopicBalancer(ss)
+	if ss == "" {
+		return nil
+	}
+	return strings.Split(ss, TopicServiceSeq)
+}
+
+// Plan 根据etcd 上当前的分配结果current 和新计算的分配结果target 生成迁移计划,
+// 返回现在就应该写到etcd 的分配结果, alive 是当前存活的service
+func (r *Rebalancer) Plan(current, target map[string]string, alive map[string]bool) map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	applied := make(map[string]string, len(target))
+	for topic, data := range target {
+		cur, ok := current[topic]
+		if !ok || cur == data || !r.Enabled() {
+			applied[topic] = data
+			delete(r.moves, topic)
+			continue
+		}
+		from := topicDataServices(cur)
+		anyAlive := false
+		for _, service := range from {
+			if alive[service] {
+				anyAlive = true
+				break
+			}
+		}
+		if !anyAlive {
+			// 旧的service 都不在了, 没有人可以交接
+			applied[topic] = data
+			delete(r.moves, topic)
+			continue
+		}
+		applied[topic] = cur
+		if move, ok := r.moves[topic]; ok {
+			if move.data == data {
+				continue
+			}
+			// 迁移目标变了, 重新排队
+			delete(r.moves, topic)
+		}
+		r.moves[topic] = &TopicMove{
+			Topic: topic,
+			From:  from,
+			To:    topicDataServices(data),
+			State: MovePending,
+			data:  data,
+		}
+	}
+	// target 里已经没有的topic 不再迁移
+	for topic := range r.moves {
+		if _, ok := target[topic]; !ok {
+			delete(r.moves, topic)
+		}
+	}
+	r.queue = r.queue[:0]
+	for topic, move := range r.moves {
+		if move.State == MovePending {
+			r.queue = append(r.queue, topic)
+		}
+	}
+	sort.Strings(r.queue)
+	r.applied = applied
+	return copyStringMap(applied)
+}
+
+// Step 推进迁移: draining 的topic 如果已经确认或者超时就完成迁移, 然后开始迁移新的pending topic,
+// 返回新开始交接的和完成交接的topic, 以及现在应该写到etcd 的分配结果
+func (r *Rebalancer) Step(confirmed func(move TopicMove) bool, now time.Time) (started, finished []TopicMove, applied map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.moves) == 0 {
+		return nil, nil, copyStringMap(r.applied)
+	}
+	r.step++
+
+	draining := 0
+	timeout := time.Duration(r.conf.HandoffTimeout) * time.Second
+	topics := make([]string, 0, len(r.moves))
+	for topic := range r.moves {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		move := r.moves[topic]
+		if move.State != MoveDraining {
+			continue
+		}
+		if confirmed(*move) || now.Sub(move.StartAt) >= timeout {
+			r.applied[topic] = move.data
+			delete(r.moves, topic)
+			r.moved++
+			finished = append(finished, *move)
+			continue
+		}
+		draining++
+	}
+
+	for draining < r.conf.MaxMoves && len(r.queue) > 0 {
+		topic := r.queue[0]
+		r.queue = r.queue[1:]
+		move, ok := r.moves[topic]
+		if !ok {
+			continue
+		}
+		move.State = MoveDraining
+		move.StartAt = now
+		started = append(started, *move)
+		draining++
+	}
+	return started, finished, copyStringMap(r.applied)
+}
+
+func (r *Rebalancer) Status() RebalanceStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := RebalanceStatus{Step: r.step, Moved: r.moved}
+	for _, topic := range r.queue {
+		if move, ok := r.moves[topic]; ok {
+			status.Pending = append(status.Pending, *move)
+		}
+	}
+	for _, move := range r.moves {
+		if move.State == MoveDraining {
+			status.Draining = append(status.Draining, *move)
+		}
+	}
+	sort.Slice(status.Draining, func(i, j int) bool {
+		return status.Draining[i].Topic < status.Draining[j].Topic
+	})
+	return status
+}
+
+// Applied 返回leader 最近一次计划写到etcd 的分配结果
+func (r *Rebalancer) Applied() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return copyStringMap(r.applied)
+}
+
+// Reset 清空迁移计划, leader 切换时使用
+func (r *Rebalancer) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.applied = make(map[string]string)
+	r.moves = make(map[string]*TopicMove)
+	r.queue = nil
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	cp := make(map[string]string, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp
+}
+
+func (s *Service) HandoffPath() string {
+	return fmt.Sprintf("/%s/%s/handoff", s.sc.Ns, s.sc.As)
+}
+
+// OnHandoff 注册topic 交接的回调, 旧service(HandoffFrom)应该开始排空该topic 的客户端,
+// 新service(HandoffTo)应该在回调里准备好接管该topic, 所有回调返回后自动向leader 确认
+func (s *Service) OnHandoff(fn HandoffHandler) {
+	s.Lock()
+	defer s.Unlock()
+	s.handoffHandlers = append(s.handoffHandlers, fn)
+}
+
+// RebalanceStatus 返回leader 上的迁移计划和进度, 不是leader 返回false
+func (s *Service) RebalanceStatus() (RebalanceStatus, bool) {
+	if !s.IsLeader() {
+		return RebalanceStatus{}, false
+	}
+	return s.rebalancer.Status(), true
+}
+
+// etcd 上当前的分配结果, topic-->topicData
+func (s *Service) currentAssignment() map[string]string {
+	s.Lock()
+	defer s.Unlock()
+	current := make(map[string]string, len(s.distributedTopics))
+	for topic, services := range s.distributedTopics {
+		current[topic] = topic + ":" + services
+		if balancer := s.distributedBalancers[topic]; balancer != "" {
+			current[topic] += TopicBalancerSep + balancer
+		}
+	}
+	return current
+}
+
+// 新service 是否都已经通过TopicState 确认了这次交接
+func (s *Service) handoffConfirmed(move TopicMove) bool {
+	if s.topicState == nil {
+		return false
+	}
+	for _, service := range move.To {
+		if !s.topicState.HandoffAcked(move.Topic, move.StartAt.UnixNano(), service) {
+			return false
+		}
+	}
+	return true
+}
+
+// ackHandoff 新service 确认(ADD)已经准备好接管topic, 或者交接结束后撤销(DEL)
+func (s *Service) ackHandoff(move TopicMove, op int) {
+	if s.topicState == nil {
+		return
+	}
+	if err := s.topicState.AckHandoff(move.Topic, move.StartAt.UnixNano(), op); err != nil {
+		logx.Errorf("ack handoff topic:%s op:%d err:%v", move.Topic, op, err)
+	}
+}
+
+// leader 推进一步迁移, 并把交接信息和分配结果写到etcd
+func (s *Service) rebalanceStep() {
+	started, finished, applied := s.rebalancer.Step(s.handoffConfirmed, time.Now())
+	if len(started) == 0 && len(finished) == 0 {
+		return
+	}
+	if err := s.updateHandoffs(started, finished); err != nil {
+		s.metrics.Load().etcdWriteFailed("handoffs")
+		logx.Errorf("update handoffs err:%v", err)
+		return
+	}
+	for _, move := range finished {
+		logx.Infof("topic:%s moved from %v to %v", move.Topic, move.From, move.To)
+	}
+	if err := s.setTopicToEtcd(applied); err != nil {
+		s.metrics.Load().etcdWriteFailed("topics")
+		logx.Error(err)
+	}
+}
+
+func (s *Service) rebalanceLoop() {
+	ticker := time.NewTicker(time.Duration(s.rebalancer.conf.StepInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.IsLeader() {
+				continue
+			}
+			s.assignLock.Lock()
+			s.rebalanceStep()
+			s.assignLock.Unlock()
+		}
+	}
+}
+
+func (s *Service) updateHandoffs(started, finished []TopicMove) error {
+	s.Lock()
+	cli := s.etcdClient
+	election := s.election
+	s.Unlock()
+	if cli == nil || election == nil {
+		return ErrNotLeader
+	}
+	ops := make([]clientv3.Op, 0, len(started)+len(finished))
+	for _, move := range started {
+		data, err := json.Marshal(move)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, clientv3.OpPut(s.HandoffPath()+"/"+move.Topic, string(data)))
+	}
+	for _, move := range finished {
+		ops = append(ops, clientv3.OpDelete(s.HandoffPath()+"/"+move.Topic))
+	}
+	txnResp, err := cli.Txn(s.ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(election.Key()), "=", election.Rev())).
+		Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	if !txnResp.Succeeded {
+		return ErrNotLeader
+	}
+	return nil
+}
+
+// 新leader 清理旧leader 留下的交接信息, 重新计划
+func (s *Service) resetRebalance() {
+	s.rebalancer.Reset()
+	s.Lock()
+	cli := s.etcdClient
+	election := s.election
+	s.Unlock()
+	if cli == nil || election == nil {
+		return
+	}
+	_, err := cli.Txn(s.ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(election.Key()), "=", election.Rev())).
+		Then(clientv3.OpDelete(s.HandoffPath()+"/", clientv3.WithPrefix())).Commit()
+	if err != nil {
+		logx.Errorf("clean handoffs err:%v", err)
+	}
+}
+
+// 所有服务都watch /ns/as/handoff, 根据自己在交接里的角色回调
+func (s *Service) startDiscovHandoffs() error {
+	handled := make(map[string]bool) //key: 交接信息, 避免同一个交接重复回调
+	return WatchPrefix(s.ctx, s.getEtcdClient(), s.HandoffPath()+"/", func(kvs map[string]string) {
+		current := make(map[string]bool, len(kvs))
+		for _, v := range kvs {
+			current[v] = true
+			if handled[v] {
+				continue
+			}
+			handled[v] = true
+			var move TopicMove
+			if err := json.Unmarshal([]byte(v), &move); err != nil {
+				logx.Errorf("invalid handoff:%s, err:%v", v, err)
+				continue
+			}
+			s.handleHandoff(move)
+		}
+		for v := range handled {
+			if !current[v] {
+				delete(handled, v)
+				s.finishHandoff(v)
+			}
+		}
+	})
+}
+
+// handoffRole 自己在交接里的角色, 不在交接里返回0。
+// 在To 里的service 迁移后还负责该topic, 不用排空, leader 要等它确认
+func (s *Service) handoffRole(move TopicMove) HandoffRole {
+	for _, service := range move.To {
+		if service == s.Key() {
+			return HandoffTo
+		}
+	}
+	for _, service := range move.From {
+		if service == s.Key() {
+			return HandoffFrom
+		}
+	}
+	return 0
+}
+
+func (s *Service) handleHandoff(move TopicMove) {
+	role := s.handoffRole(move)
+	if role == 0 {
+		return
+	}
+	logx.Infof("%s handoff topic:%s, role:%d, from:%v, to:%v", s.Key(), move.Topic, role, move.From, move.To)
+	s.Lock()
+	handlers := append([]HandoffHandler(nil), s.handoffHandlers...)
+	s.Unlock()
+	for _, fn := range handlers {
+		fn(move, role)
+	}
+	if role == HandoffTo {
+		s.ackHandoff(move, ADD)
+	}
+}
+
+// finishHandoff 交接信息从etcd 删除了(完成或者新leader 清理), 撤销自己的确认
+func (s *Service) finishHandoff(v string) {
+	var move TopicMove
+	if err := json.Unmarshal([]byte(v), &move); err != nil {
+		return
+	}
+	if s.handoffRole(move) == HandoffTo {
+		s.ackHandoff(move, DEL)
+	}
+}
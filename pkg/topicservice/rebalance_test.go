@@ -0,0 +1,120 @@
+package topicservice
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebalancerMovementBudget(t *testing.T) {
+	r := NewRebalancer(RebalanceConf{MaxMoves: 1, HandoffTimeout: 10})
+	current := map[string]string{
+		"topic1": "topic1:s-1",
+		"topic2": "topic2:s-1",
+		"topic3": "topic3:s-3",
+	}
+	target := map[string]string{
+		"topic1": "topic1:s-2",
+		"topic2": "topic2:s-2",
+		"topic3": "topic3:s-2",
+		"topic4": "topic4:s-2",
+	}
+	alive := map[string]bool{"s-1": true, "s-2": true}
+
+	// topic3 的service 已经不在了, topic4 是新的topic, 都直接迁移; topic1 和 topic2 需要交接
+	applied := r.Plan(current, target, alive)
+	assert.Equal(t, map[string]string{
+		"topic1": "topic1:s-1",
+		"topic2": "topic2:s-1",
+		"topic3": "topic3:s-2",
+		"topic4": "topic4:s-2",
+	}, applied)
+	assert.Len(t, r.Status().Pending, 2)
+
+	now := time.Now()
+	confirmed := map[string]bool{}
+	confirm := func(move TopicMove) bool { return confirmed[move.Topic] }
+
+	started, finished, _ := r.Step(confirm, now)
+	assert.Len(t, started, 1)
+	assert.Equal(t, "topic1", started[0].Topic)
+	assert.Equal(t, []string{"s-1"}, started[0].From)
+	assert.Equal(t, []string{"s-2"}, started[0].To)
+	assert.Empty(t, finished)
+
+	// 没有确认, 也没有超时, 不会开始下一个
+	started, finished, _ = r.Step(confirm, now.Add(time.Second))
+	assert.Empty(t, started)
+	assert.Empty(t, finished)
+
+	confirmed["topic1"] = true
+	started, finished, applied = r.Step(confirm, now.Add(2*time.Second))
+	assert.Equal(t, "topic1", finished[0].Topic)
+	assert.Equal(t, "topic2", started[0].Topic)
+	assert.Equal(t, "topic1:s-2", applied["topic1"])
+	assert.Equal(t, "topic2:s-1", applied["topic2"])
+
+	// 超时强制迁移
+	started, finished, applied = r.Step(confirm, now.Add(time.Minute))
+	assert.Empty(t, started)
+	assert.Equal(t, "topic2", finished[0].Topic)
+	assert.Equal(t, target, applied)
+	assert.Equal(t, 2, r.Status().Moved)
+}
+
+func TestRebalancerDisabled(t *testing.T) {
+	r := NewRebalancer(RebalanceConf{})
+	current := map[string]string{"topic1": "topic1:s-1"}
+	target := map[string]string{"topic1": "topic1:s-2"}
+	assert.Equal(t, target, r.Plan(current, target, map[string]bool{"s-1": true, "s-2": true}))
+	assert.Empty(t, r.Status().Pending)
+}
+
+func TestServiceHandoffAck(t *testing.T) {
+	s1 := newGossipService(t, "1", nil)
+	seed := []string{s1.topicState.cluster.LocalNode().Address()}
+	s2, leader := newGossipService(t, "2", seed), newGossipService(t, "3", seed)
+	var roles []HandoffRole
+	s1.OnHandoff(func(move TopicMove, role HandoffRole) { roles = append(roles, role) })
+
+	// s1 同时在From 和To 里, 还负责topic1, 要确认; s2 只在From 里, 不用确认
+	move := TopicMove{
+		Topic:   "topic1",
+		From:    []string{s1.Key(), s2.Key()},
+		To:      []string{s1.Key()},
+		State:   MoveDraining,
+		StartAt: time.Now(),
+	}
+	assert.False(t, leader.handoffConfirmed(move))
+	s1.handleHandoff(move)
+	s2.handleHandoff(move)
+	assert.Equal(t, []HandoffRole{HandoffTo}, roles)
+	assert.Eventually(t, func() bool { return leader.handoffConfirmed(move) }, 5*time.Second, 10*time.Millisecond)
+	// 确认不会写到订阅关系里
+	for _, topic := range s1.SubscriptionStore().LocalSubscriptions() {
+		assert.False(t, isHandoffAckTopic(topic))
+	}
+	for topic := range leader.SubscriptionStore().Subscriptions() {
+		assert.False(t, isHandoffAckTopic(topic))
+	}
+
+	// 之前交接的确认不算, 名字是前缀的topic 也不算
+	next := move
+	next.StartAt = move.StartAt.Add(time.Second)
+	assert.False(t, leader.handoffConfirmed(next))
+	other := next
+	other.Topic = "topic1/sub"
+	s1.handleHandoff(other)
+	next.To = []string{s1.Key(), s2.Key()}
+	s1.handleHandoff(next)
+	s2.handleHandoff(next)
+	assert.Eventually(t, func() bool { return leader.handoffConfirmed(next) }, 5*time.Second, 10*time.Millisecond)
+
+	// 交接结束后撤销确认, 只撤销这次交接的
+	data, _ := json.Marshal(next)
+	s2.finishHandoff(string(data))
+	assert.Eventually(t, func() bool { return !leader.handoffConfirmed(next) }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, leader.handoffConfirmed(other))
+}
@@ -3,17 +3,19 @@ package topicservice
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"net/http"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/jursonmo/practise_new/pkg/hash"
+	"github.com/redis/go-redis/v9"
 	"github.com/zeromicro/go-zero/core/discov"
 	"github.com/zeromicro/go-zero/core/logx"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
 )
 
 //  1. 所有服务都watch , 感知其他服务的存在，并觉得哪个是leader， leader通过一定的算法，分配当前每个topic分别对应的services, 并更新到/ns/as/topics/xxx
@@ -31,28 +33,52 @@ import (
 //     目前已经可以用gossip 来同步topic-service的对应关系. TODO: 有客户端订阅topic时，service.AddTopicState(topic) 通知其他服务，
 type ServiceInfo = ServiceConfig
 type ServiceConfig struct {
-	Name      string            `json:"name,optional"`
-	Id        string            `json:"id,optional"` //服务的唯一性
-	Endpoints []string          `json:",optional"`   //broker service 目前是可以不用设置endpoints
-	Weight    int               `json:",optional"`   //权重
-	Priority  int               `json:",optional"`   //优先级
-	Ns        string            `json:",optional"`
-	As        string            `json:",optional"`
-	Etcd      discov.EtcdConf   //`json:"-"` //注册到哪里去, 完整的注册路径: /ns/as/key/id
-	IsLeader  bool              `json:",optional"` // 配置是否是leader，多个服务可以设置都设置了该配置，Id最小的那个是leader
-	Metadata  map[string]string `json:",optional"`
-	Gossip    GossipConf        `json:",optional"`
+	Name        string          `json:"name,optional"`
+	Id          string          `json:"id,optional"` //服务的唯一性
+	Endpoints   []string        `json:",optional"`   //broker service 目前是可以不用设置endpoints
+	Weight      int             `json:",optional"`   //权重
+	Priority    int             `json:",optional"`   //优先级
+	Version     string          `json:",optional"`   //服务的版本, 通过gossip 元数据告诉其他服务
+	Ns          string          `json:",optional"`
+	As          string          `json:",optional"`
+	Etcd        discov.EtcdConf //`json:"-"` //注册到哪里去, 完整的注册路径: /ns/as/key/id
+	Discovery   string          `json:",optional"` // 服务发现, leader 选举和topic 分配用什么: etcd|gossip, 默认etcd
+	IsLeader    bool            `json:",optional"` // 配置了IsLeader 的服务优先竞选leader, 真正的leader 由etcd 选举决定
+	Draining    bool            `json:",optional"` // 正在下线(Drain), leader 不再给它分配topic, 不需要配置
+	ElectionTTL int             `json:",optional"` // leader 选举session 租约的ttl(秒), 默认10秒
+	TopicLayout string          `json:",optional"` // topic 分配结果在etcd 上的布局: all|topic|node, 默认node
+	Balancer    string          `json:",optional"` // 默认负载算法的名字(RegisterBalancer 注册的), 默认consistent_hash
+	// topic 单独指定的负载算法, key:topic, value:负载算法的名字
+	TopicBalancers map[string]string `json:",optional"`
+	Rebalance      RebalanceConf     `json:",optional"` // 分步迁移topic, 避免服务变化时所有topic 一次性迁移
+	Subscription   SubscriptionConf  `json:",optional"` // 实时的topic-->services 订阅关系存在哪里
+	Forward        ForwardConf       `json:",optional"` // service 之间转发publish 的数据
+	Metadata       map[string]string `json:",optional"`
+	Gossip         GossipConf        `json:",optional"`
+	Admin          AdminConf         `json:",optional"` // 管理接口, 查看集群状态, 手动重新分配topic
 }
 
 type GossipConf struct {
-	Enabled bool   `json:",optional"`
-	Addr    string `json:",optional"`
-	Port    int    `json:",optional"`
+	Enabled      bool   `json:",optional"`
+	Addr         string `json:",optional"`
+	Port         int    `json:",optional"`
+	TombstoneTTL int    `json:",optional"` // 删除的订阅记录保留多久(秒), 默认600秒
+	LeaveGrace   int    `json:",optional"` // 节点离开后等多久(秒)才清理它的订阅, 默认5秒, -1 表示立即清理
+	// Discovery 是gossip 时, 启动后加入的种子节点 ip:port, 第一个启动的节点可以不配置
+	Seeds []string `json:",optional"`
+	// base64 的密钥(16/24/32 字节), 配置了就加密gossip, 第一个是主密钥, 其他的只用来解密(轮换密钥时用)。
+	// 注册到etcd, 选举的value 和管理接口里都会去掉, 见publicValue
+	SecretKeys []string `json:",optional"`
+	Label      string   `json:",optional"` // 集群标签, 标签不同的节点互相丢弃对方的包, 用于隔离同一个网络里的多个集群
+	Codec      string   `json:",optional"` // gossip 消息的编码: json|binary, 默认json, 方便调试
+	Compress   bool     `json:",optional"` // binary 编码时是否压缩
+	DeltaState bool     `json:",optional"` // push/pull 时只发送自己的记录, topic 很多时用
 }
 
 const (
-	TopicsSep       = ";" //topic之间的分隔符
-	TopicServiceSeq = "|" //topic负载的多个service之间的分隔符
+	TopicsSep        = ";" //topic之间的分隔符
+	TopicServiceSeq  = "|" //topic负载的多个service之间的分隔符
+	TopicBalancerSep = "@" //topic 单独指定负载算法时, 负载算法的名字放在services 后面, topic1:s1|s2@balancer
 )
 
 type Service struct {
@@ -63,24 +89,55 @@ type Service struct {
 	isLeader  bool //是否是leader, 只有leader才会分配topic和service(broker)的对应关系
 	pubClient *discov.Publisher
 
-	topicState *TopicState
+	election       *concurrency.Election //leader 才有, 用于Resign 和 Proclaim
+	leader         *ServiceConfig        //当前观察到的leader
+	leaderHandlers []LeaderChangeHandler
+	assignLock     sync.Mutex //避免服务列表变化和选举成功同时分配topic
+
+	rebalancer      *Rebalancer
+	handoffHandlers []HandoffHandler
+
+	topicState   *TopicState
+	subs         SubscriptionStore //实时的订阅关系, gossip 时就是topicState
+	redisClient  *redis.Client     //Subscription.Store 是redis 时才有
+	forwarder    *Forwarder
+	deliver      DeliverHandler
+	adminServer  *http.Server
+	adminAddr    string
+	draining     bool
+	clientTopics map[string]struct{}     //客户端通过AddTopicState 订阅的topic, 不包括SetTopics 的静态topic
+	metrics      atomic.Pointer[Metrics] //RegisterMetrics 注册后才有
 
 	balance     *Balance
 	serviceList []ServiceInfo
 	topics      []string
+	catalog     map[string]TopicSpec //topic 目录, key: topic
 	etcdClient  *clientv3.Client
-	lease       *clientv3.LeaseGrantResponse //租约,用于撤销
-	topicPerKey bool
 	//topic和service的对应关系
 	// topicServiceMap map[string]*ServiceConfig
 
 	distributedTopics map[string]string
+	//topic 单独指定的负载算法, 来自etcd 上的分配结果, leader 切换后新leader 用它恢复
+	distributedBalancers map[string]string
 }
 
 func (s ServiceInfo) String() string {
 	return fmt.Sprintf("%s-%s", s.Name, s.Id)
 }
 
+// redacted 去掉密钥和密码的拷贝, 其他服务, 客户端和管理接口都不需要它们
+func (s ServiceInfo) redacted() ServiceInfo {
+	s.Gossip.SecretKeys = nil
+	s.Etcd.Pass = ""
+	s.Subscription.Redis.Pass = ""
+	return s
+}
+
+// publicValue 发布出去的ServiceConfig(注册到etcd 和选举的value), 能读etcd 的人拿不到gossip 的密钥和密码
+func publicValue(sc ServiceConfig) ([]byte, error) {
+	return json.Marshal(sc.redacted())
+}
+
 // 服务器唯一Key,唯一标识一个服务
 func (s *Service) Key() string {
 	return s.sc.String()
@@ -95,35 +152,58 @@ func NewService(sc *ServiceConfig) (*Service, error) {
 	if sc.Id == "" {
 		return nil, fmt.Errorf("ServiceConfig Id is empty")
 	}
-	if sc.Etcd.Key == "" {
-		return nil, fmt.Errorf("ServiceConfig Etcd.Key is empty")
-	}
 	if sc.Ns == "" {
 		sc.Ns = "ns"
 	}
 	if sc.As == "" {
 		sc.As = "as"
 	}
+	switch sc.Discovery {
+	case "", DiscoveryEtcd:
+		if sc.Etcd.Key == "" {
+			return nil, fmt.Errorf("ServiceConfig Etcd.Key is empty")
+		}
+		// 补充key的完整路径，方便后面的订阅
+		sc.Etcd.Key = fmt.Sprintf("/%s/%s/%s", sc.Ns, sc.As, sc.Etcd.Key)
+	case DiscoveryGossip:
+		if err := checkGossipDiscovery(sc); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown discovery:%s", sc.Discovery)
+	}
 
-	// 补充key的完整路径，方便后面的订阅
-	sc.Etcd.Key = fmt.Sprintf("/%s/%s/%s", sc.Ns, sc.As, sc.Etcd.Key)
+	//默认使用一致性hash算法
+	balancerName := sc.Balancer
+	if balancerName == "" {
+		balancerName = ConsistentHashBalancer
+	}
+	defaultBalancer, err := NewBalancer(balancerName)
+	if err != nil {
+		return nil, err
+	}
 
 	s := &Service{
 		sc: sc,
 		//balance: DefaultBalance, //应该每个服务创建一个Balance
-		balance: NewBalance(&myConsistentHash{
-			chash: hash.NewConsistentHash(),
-			name:  "consistent_hash",
-			desc:  "consistent hash balance alg",
-		}), //默认使用一致性hash算法
+		balance: NewBalance(defaultBalancer),
 		//topicServiceMap: make(map[string]*ServiceConfig),
+		rebalancer: NewRebalancer(sc.Rebalance),
+	}
+	for topic, name := range sc.TopicBalancers {
+		if err := s.balance.SetTopicBalancer(topic, name); err != nil {
+			return nil, err
+		}
 	}
 
 	if s.sc.Gossip.Enabled {
-		topicState, err := NewTopicState(s.Key(), sc.Gossip.Addr, sc.Gossip.Port)
+		topicState, err := NewTopicStateWithConf(s.Key(), sc.Gossip)
 		if err != nil {
 			panic(err)
 		}
+		if err := topicState.SetMeta(s.nodeMeta()); err != nil {
+			logx.Errorf("set gossip node meta err:%v", err)
+		}
 		s.topicState = topicState
 	}
 	return s, nil
@@ -133,13 +213,128 @@ func (s *Service) SetDefaultBalancer(balance ServiceBalancer) {
 	s.balance.UpdateDefaultBalancer(balance)
 }
 
+// SetTopicBalancer 给topic 指定负载算法(名字), name 为空表示恢复成默认负载算法,
+// 如果是leader, 立即重新分配并把负载算法的名字和分配结果一起写到etcd。
+// gossip 发现模式下每个节点各自分配, 只在一个节点上修改会导致节点之间的分配结果不一样, 不支持, 用配置的TopicBalancers
+func (s *Service) SetTopicBalancer(topic string, name string) error {
+	if s.gossipDiscovery() {
+		return fmt.Errorf("set topic balancer is not supported in gossip discovery, use TopicBalancers in config")
+	}
+	if err := s.balance.SetTopicBalancer(topic, name); err != nil {
+		return err
+	}
+	if s.IsLeader() {
+		s.assignTopics()
+	}
+	return nil
+}
+
+// GetTopicBalancer 返回topic 单独指定的负载算法名字, 使用默认负载算法时返回空
+func (s *Service) GetTopicBalancer(topic string) string {
+	if s.IsLeader() || s.gossipDiscovery() {
+		return s.balance.TopicBalancerName(topic)
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.distributedBalancers[topic]
+}
+
+// 新leader 恢复之前leader 给topic 指定的负载算法, 本地配置的优先
+func (s *Service) restoreTopicBalancers() {
+	s.Lock()
+	balancers := make(map[string]string, len(s.distributedBalancers))
+	for topic, name := range s.distributedBalancers {
+		balancers[topic] = name
+	}
+	s.Unlock()
+	for topic, name := range balancers {
+		if _, ok := s.sc.TopicBalancers[topic]; ok || s.balance.TopicBalancerName(topic) != "" {
+			continue
+		}
+		if err := s.balance.SetTopicBalancer(topic, name); err != nil {
+			logx.Errorf("restore topic:%s balancer:%s err:%v", topic, name, err)
+		}
+	}
+}
+
 func (s *Service) Start(ctx context.Context) error {
+	s.Lock()
 	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.Unlock()
+	if s.gossipDiscovery() {
+		//服务列表, leader 和topic 分配都来自gossip
+		logx.Info("-----start gossip discovery-------")
+		if err := s.startGossipDiscovery(); err != nil {
+			return err
+		}
+	} else if err := s.startEtcdDiscovery(); err != nil {
+		return err
+	}
+
+	if err := s.startSubscriptionStore(); err != nil {
+		return err
+	}
+
+	if err := s.startForwarder(); err != nil {
+		return err
+	}
+
+	if !s.gossipDiscovery() {
+		//监听topic 的交接信息
+		if err := s.startDiscovHandoffs(); err != nil {
+			return err
+		}
+		if s.rebalancer.Enabled() {
+			go s.rebalanceLoop()
+		}
+
+		//竞选leader, 并观察leader 的变化
+		logx.Info("-----start election-------")
+		s.startElection()
+	}
+
+	//gossip
+	if s.topicState != nil {
+		//记录当前topics, 不广播。如果在加入集群前, 发布自己的topics , 会发生什么。
+		s.topicState.UpdateTopic(ADD, s.topics, false) //表示所有服务器都订阅了这几个topics
+
+		//没有开启管理接口时, 定时打印topic state
+		if s.sc.Admin.Addr == "" {
+			go func() {
+				ticker := time.NewTicker(time.Second * 10)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-s.ctx.Done():
+						return
+					case <-ticker.C:
+					}
+					logx.Info("----topic state members:", s.topicState.Members())
+					logx.Info("----topic state local topics:", s.topicState.GetLocalTopics())
+					logx.Infof("----topic state global topics:%+v", s.topicState.GetTopics())
+				}
+			}()
+		}
+	}
+
+	return s.startAdmin()
+}
+
+func (s *Service) startEtcdDiscovery() error {
 	//注册到etcd
 	if err := s.Register(); err != nil {
 		return err
 	}
 
+	//选举和写topic 信息都需要etcd client
+	etcdClient, err := newEtcdClient(*s.sc)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.etcdClient = etcdClient
+	s.Unlock()
+
 	//订阅services
 	logx.Info("-----start discov service-------")
 	if err := s.StartDiscovService(); err != nil {
@@ -152,67 +347,133 @@ func (s *Service) Start(ctx context.Context) error {
 		return err
 	}
 
-	//gossip
-	if s.topicState != nil {
-		//记录当前topics, 不广播。如果在加入集群前, 发布自己的topics , 会发生什么。
-		s.topicState.UpdateTopic(ADD, s.topics, false) //表示所有服务器都订阅了这几个topics
-
-		//定时打印topic state
-		go func() {
-			for {
-				time.Sleep(time.Second * 10)
-				logx.Info("----topic state members:", s.topicState.Members())
-				logx.Info("----topic state local topics:", s.topicState.GetLocalTopics())
-				logx.Infof("----topic state global topics:%+v", s.topicState.GetTopics())
-			}
-		}()
-	}
-
-	return nil
+	//监听topic 目录, 运行时增删topic
+	return s.startDiscovCatalog()
 }
 
 func (s *Service) Stop() error {
-	if s.pubClient != nil {
-		s.pubClient.Stop()
-	}
-	if s.cancel != nil {
-		s.cancel()
-	}
-	if s.etcdClient != nil {
-		if s.lease != nil {
-			//撤销租约
-			logx.Infof("revoke %s lease", s.sc.String())
-			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-			_, err := s.etcdClient.Revoke(ctx, s.lease.ID)
-			if err != nil {
-				logx.Error(err)
-			}
-			cancel()
+	s.stopAdmin()
+	s.deregister()
+	s.resign()
+	s.Lock()
+	cancel := s.cancel
+	etcdClient := s.etcdClient
+	s.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	if s.forwarder != nil {
+		s.forwarder.Close()
+	}
+	if subs := s.SubscriptionStore(); subs != nil {
+		if err := subs.Close(); err != nil {
+			logx.Error(err)
 		}
-		s.etcdClient.Close()
+	}
+	if s.redisClient != nil {
+		s.redisClient.Close()
+	}
+	if s.topicState != nil {
+		//订阅关系不是gossip 时, topicState 还在集群里
+		s.topicState.Close()
+	}
+	if etcdClient != nil {
+		etcdClient.Close()
 	}
 	return nil
 }
 
+// AddTopicState 本service 上有客户端订阅了topic, 通过配置的SubscriptionStore 通知其他服务
 func (s *Service) AddTopicState(topic string) {
-	if s.topicState != nil {
-		s.topicState.AddTopic([]string{topic})
+	s.Lock()
+	if s.clientTopics == nil {
+		s.clientTopics = make(map[string]struct{})
+	}
+	s.clientTopics[topic] = struct{}{}
+	s.Unlock()
+	if subs := s.SubscriptionStore(); subs != nil {
+		if err := subs.Subscribe(topic); err != nil {
+			s.subscriptionWriteFailed()
+			logx.Errorf("subscribe topic:%s err:%v", topic, err)
+		}
 	}
 }
 func (s *Service) DelTopicState(topic string) {
-	if s.topicState != nil {
-		s.topicState.DelTopic([]string{topic})
+	s.Lock()
+	delete(s.clientTopics, topic)
+	s.Unlock()
+	if subs := s.SubscriptionStore(); subs != nil {
+		if err := subs.Unsubscribe(topic); err != nil {
+			s.subscriptionWriteFailed()
+			logx.Errorf("unsubscribe topic:%s err:%v", topic, err)
+		}
+	}
+}
+
+// nodeMeta 通过gossip 元数据告诉其他服务的配置
+func (s *Service) nodeMeta() NodeMetadata {
+	return NodeMetadata{
+		Name:        s.sc.Name,
+		Id:          s.sc.Id,
+		IsLeader:    s.sc.IsLeader,
+		Endpoints:   s.sc.Endpoints,
+		ForwardAddr: s.sc.Forward.Addr,
+		Weight:      s.sc.Weight,
+		Priority:    s.sc.Priority,
+		Version:     s.sc.Version,
 	}
 }
+
+// SetLoad 更新本服务的负载, 通过gossip 元数据传播给其他服务, 没有开启gossip 时什么都不做
+func (s *Service) SetLoad(load int) error {
+	if s.topicState == nil {
+		return nil
+	}
+	return s.topicState.UpdateMeta(func(meta *NodeMetadata) {
+		meta.Load = load
+	})
+}
+
+// PeersMeta 其他服务通过gossip 元数据告诉的配置和负载, 没有开启gossip 时返回nil
+func (s *Service) PeersMeta() map[string]NodeMetadata {
+	if s.topicState == nil {
+		return nil
+	}
+	return s.topicState.PeersMeta()
+}
+
+func (s *Service) subscriptionWriteFailed() {
+	if s.sc.Subscription.Store == SubscriptionEtcd {
+		s.metrics.Load().etcdWriteFailed("subscription")
+	}
+}
+
 func (s *Service) SetTopics(topics []string) {
 	s.Lock()
 	defer s.Unlock()
-	s.topics = topics
+	s.topics = append([]string(nil), topics...)
 }
+
+// GetTopics 返回要分配的topic: SetTopics 的和topic 目录里的
 func (s *Service) GetTopics() []string {
 	s.Lock()
-	defer s.Unlock()
-	return s.topics
+	topics := s.topics
+	s.Unlock()
+	catalog := s.catalogTopics()
+	all := append([]string(nil), topics...)
+	if len(catalog) == 0 {
+		return all
+	}
+	seen := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		seen[topic] = true
+	}
+	for _, topic := range catalog {
+		if !seen[topic] {
+			all = append(all, topic)
+		}
+	}
+	return all
 }
 
 func (s *Service) GetServicesByTopic(topic string) ([]ServiceConfig, error) {
@@ -229,70 +490,107 @@ func (s *Service) GetServiceConfig() *ServiceConfig {
 }
 
 // 1. 服务列表有变化：
-//    1.1 如果是leader, 就重新计算 topic-->services，并更新到etcd
-//	  1.2 如果是follower, 只需要关闭 s.etcdClient.Close()
-// 2. 服务列表没有变化: 即原来是leader的还是leader, 是follower还是follower， 所以啥都不需要做。
+//    1.1 如果是leader(etcd 选举产生), 就重新计算 topic-->services，并更新到etcd
+//	  1.2 如果是follower, 只需要记录服务列表, 成为leader 时再分配
+// 2. 服务列表没有变化: 啥都不需要做。
 
 func (s *Service) StartDiscovService() error {
-	DiscovCustomService(s.sc.Etcd.Hosts, s.sc.Etcd.Key, func(list []ServiceConfig) error {
+	return DiscovCustomService(s.sc.Etcd.Hosts, s.sc.Etcd.Key, func(list []ServiceConfig) error {
 		logx.Debugf("get Custom %s service:%+v", s.sc.Etcd.Key, list)
+		s.Lock()
 		if reflect.DeepEqual(s.serviceList, list) {
-			//服务列表没有变化: 即原来是leader的还是leader, 是follower还是follower， 所以啥都不需要做。
+			s.Unlock()
 			logx.Info("serviceList no change")
 			return nil
 		}
 		s.serviceList = list
+		s.Unlock()
 
-		leader := findLeader(list)
-		if leader == nil {
-			return errors.New("leader == nil")
-		}
-		logx.Debugf("leader:%+v", leader)
-		if leader.Id == s.sc.Id {
-			s.isLeader = true
-		} else {
-			s.isLeader = false
-		}
-		if s.isLeader {
-			logx.Infof("I am the leader, name:%s, id:%s", s.sc.Name, s.sc.Id)
-			//set services leader to etcd
-			s.PublishLeader()
-			//更新balance的services
-			s.balance.UpdateServices(list)
-			//重新分配topic和service的对应关系
-			logx.Info("-----------------------------------")
-			topicService := make(map[string]string)
-			for _, topic := range s.topics {
-				services := s.balance.GetServiceByTopic(topic)
-				logx.Infof("assign topic:%s, services:%+v", topic, services)
-				topicService[topic] = topicData(topic, services)
-			}
-			logx.Info("-----------------------------------")
-			//如果两个service 都在keepalive 会发生什么
-			err := s.setTopicToEtcd(topicService)
-			if err != nil {
-				logx.Error(err)
-			}
-
-			// 由leader 去join 其他的service
-			logx.Info("i am leader, so gossip join other service")
-			err = s.ServicesJoin()
-			if err != nil {
-				logx.Error(err)
-			}
-			logx.Info("topicState members:", s.topicState.Members())
-		} else {
-			logx.Infof("I am not the leader, leader is %+v", leader)
-			// 如果不是leader ,
-			if s.etcdClient != nil {
-				logx.Errorf("close %s etcdClient", s.sc.String())
-				s.etcdClient.Close()
-				s.etcdClient = nil
-			}
+		if !s.IsLeader() {
+			leader, _ := s.Leader()
+			logx.Infof("I am not the leader, leader is %s", leader.String())
+			return nil
 		}
+		s.assignTopics()
 		return nil
 	})
-	return nil
+}
+
+// getServiceList 返回服务列表的拷贝, 服务列表在发现的回调里更新
+func (s *Service) getServiceList() []ServiceInfo {
+	s.Lock()
+	defer s.Unlock()
+	return append([]ServiceInfo(nil), s.serviceList...)
+}
+
+// getEtcdClient etcd 发现模式下Start 之后才有
+func (s *Service) getEtcdClient() *clientv3.Client {
+	s.Lock()
+	defer s.Unlock()
+	return s.etcdClient
+}
+
+// leader 根据当前的服务列表重新分配topic和service的对应关系, 并更新到etcd
+func (s *Service) assignTopics() {
+	s.assignLock.Lock()
+	defer s.assignLock.Unlock()
+	if !s.IsLeader() {
+		return
+	}
+	list := s.assignableServices()
+	if len(list) == 0 {
+		logx.Info("no service discovered yet, skip assign topics")
+		return
+	}
+	start := time.Now()
+	counts := make(map[string]int, len(list))
+
+	//更新balance的services
+	s.balance.UpdateServices(list)
+	//重新分配topic和service的对应关系
+	logx.Info("-----------------------------------")
+	topicService := make(map[string]string)
+	topics := s.GetTopics()
+	//删除了的topic 不再占用负载算法的状态
+	s.balance.RetainTopics(topics)
+	for _, topic := range topics {
+		services := s.balance.GetServiceByTopic(topic)
+		logx.Infof("assign topic:%s, services:%+v", topic, services)
+		for _, v := range services {
+			counts[v.String()]++
+		}
+		topicService[topic] = topicData(topic, services, s.balance.TopicBalancerName(topic))
+	}
+	logx.Info("-----------------------------------")
+	alive := make(map[string]bool, len(list))
+	for _, v := range list {
+		alive[v.String()] = true
+	}
+	current := s.rebalancer.Applied()
+	if len(current) == 0 {
+		current = s.currentAssignment()
+	}
+	//没有开启分步迁移时, applied 就是topicService
+	applied := s.rebalancer.Plan(current, topicService, alive)
+	err := s.setTopicToEtcd(applied)
+	if err != nil {
+		s.metrics.Load().etcdWriteFailed("topics")
+		logx.Error(err)
+	}
+	s.metrics.Load().assigned("leader", start, counts)
+	if s.rebalancer.Enabled() {
+		s.rebalanceStep()
+	}
+
+	// 由leader 去join 其他的service
+	logx.Info("i am leader, so gossip join other service")
+	err = s.ServicesJoin()
+	if err != nil {
+		logx.Error(err)
+	}
+	if s.topicState != nil {
+		logx.Info("topicState members:", s.topicState.Members())
+	}
 }
 
 func (s *Service) ServicesJoin() error {
@@ -300,8 +598,9 @@ func (s *Service) ServicesJoin() error {
 		return nil
 	}
 
-	topicStateNode := make([]string, 0, len(s.serviceList))
-	for _, service := range s.serviceList {
+	serviceList := s.getServiceList()
+	topicStateNode := make([]string, 0, len(serviceList))
+	for _, service := range serviceList {
 		// 排除自己
 		if service.Id == s.sc.Id {
 			continue
@@ -326,14 +625,27 @@ func (s *Service) ServicesJoin() error {
 	return nil
 }
 
-// topic:s1,s2
-func topicData(topic string, ss []ServiceInfo) string {
+// topic:s1|s2 或者 topic:s1|s2@balancer
+func topicData(topic string, ss []ServiceInfo, balancer string) string {
 	var ts []string
 	for _, s := range ss {
 		ts = append(ts, s.String())
 	}
 
-	return topic + ":" + strings.Join(ts, TopicServiceSeq)
+	data := topic + ":" + strings.Join(ts, TopicServiceSeq)
+	if balancer != "" {
+		data += TopicBalancerSep + balancer
+	}
+	return data
+}
+
+// s1|s2@balancer --> s1|s2, balancer
+func splitTopicBalancer(ss string) (services string, balancer string) {
+	idx := strings.LastIndex(ss, TopicBalancerSep)
+	if idx == -1 {
+		return ss, ""
+	}
+	return ss[:idx], ss[idx+1:]
 }
 
 func parseTopicData(d string) (topic string, ss string, err error) {
@@ -346,52 +658,43 @@ func parseTopicData(d string) (topic string, ss string, err error) {
 	return topic, ss, nil
 }
 
-func (s *Service) PublishLeader() {
-	//TODO: publish leader to etcd
-}
 func (s *Service) IsLeader() bool {
+	s.Lock()
+	defer s.Unlock()
 	return s.isLeader
 }
 
 func (s *Service) Register() error {
-	data, err := json.Marshal(s.sc)
-	if err != nil {
-		return err
-	}
 	//注册到etcd
-	key := s.sc.Etcd.Key // 由于没有指定Etcd.ID, 所以最终注册的key是:/ns/as/key/7587883611715931480
-	logx.Infof("register the service, key:%s, value:%s", key, string(data))
-	s.pubClient = discov.NewPublisher(s.sc.Etcd.Hosts, key, string(data))
-	if err := s.pubClient.KeepAlive(); err != nil {
+	pub, err := s.publish(*s.sc)
+	if err != nil {
 		return err
 	}
+	s.Lock()
+	s.pubClient = pub
+	s.Unlock()
 	return nil
 }
 
-func findLeader(list []ServiceConfig) *ServiceConfig {
-	if len(list) == 0 {
-		return nil
-	}
-	leaders := []ServiceConfig{}
-	for _, v := range list {
-		if v.IsLeader {
-			leaders = append(leaders, v)
-		}
-	}
-	if len(leaders) == 1 {
-		return &leaders[0]
+// publish 注册服务, 由于没有指定Etcd.ID, 所以最终注册的key是:/ns/as/key/7587883611715931480
+func (s *Service) publish(sc ServiceConfig) (*discov.Publisher, error) {
+	data, err := publicValue(sc)
+	if err != nil {
+		return nil, err
 	}
-	if len(leaders) == 0 {
-		logx.Info("no leader found, chose min id")
+	logx.Infof("register the service, key:%s, value:%s", sc.Etcd.Key, string(data))
+	pub := discov.NewPublisher(sc.Etcd.Hosts, sc.Etcd.Key, string(data))
+	if err := pub.KeepAlive(); err != nil {
+		return nil, err
 	}
+	return pub, nil
+}
 
-	leader := list[0]
-	for _, v := range list {
-		if v.Id < leader.Id {
-			leader = v
-		}
-	}
-	return &leader
+// DistributedTopics 返回分配的 topic-->services(s1|s2)
+func (s *Service) DistributedTopics() map[string]string {
+	s.Lock()
+	defer s.Unlock()
+	return copyStringMap(s.distributedTopics)
 }
 
 func (s *Service) SetDistributedTopics(topics map[string]string) {
@@ -401,39 +704,19 @@ func (s *Service) SetDistributedTopics(topics map[string]string) {
 }
 
 func (s *Service) StartDiscovTopics() error {
-	return DiscovTopics(s.sc.Etcd.Hosts, s.TopicsPath(), func(vals []string) {
+	return WatchPrefix(s.ctx, s.getEtcdClient(), s.TopicsPath()+"/", func(kvs map[string]string) {
 		// 这是leader 经过负载算法计算后推荐的 topic-->service 信息
-		distributedTopics := make(map[string]string, len(vals))
-		if s.topicPerKey {
-			for _, v := range vals {
-				topic, services, err := parseTopicData(v)
-				if err != nil {
-					logx.Error(err)
-					continue
-				}
-				distributedTopics[topic] = services
-			}
-		} else {
-			if len(vals) == 0 {
-				logx.Errorf("no topic found")
-				return
-			}
-			//所有信息都写在一个key:/ns/as/topics/all 里, 所以values 只有一个值。
-			//以后可以考虑把所有topics信息分散在多个key里，比如/ns/as/topics/node1, /ns/as/topics/node2,这样某个node的负责的topic有变化时，只需要更新这个key即可。
-			//values 是所有 topics信息, len(values) = 1, value:[topic6:topic_service-1;topic1:topic_service-1|topic_service-2]
-			ts := strings.Split(vals[0], TopicsSep)
-			for _, v := range ts {
-				topic, services, err := parseTopicData(v) // v 格式 topic6:topic_service-1
-				if err != nil {
-					logx.Error(err)
-					continue
-				}
-				distributedTopics[topic] = services
-			}
+		vals := make([]string, 0, len(kvs))
+		for _, v := range kvs {
+			vals = append(vals, v)
 		}
+		distributedTopics, distributedBalancers := ParseTopicValues(vals)
 		logx.Infof("%s, get len:%d distributedTopics:%+v", s.sc.String(), len(distributedTopics), distributedTopics)
 		//保存指派的topic和service对应关系
 		s.SetDistributedTopics(distributedTopics)
+		s.Lock()
+		s.distributedBalancers = distributedBalancers
+		s.Unlock()
 	})
 }
 
@@ -485,136 +768,3 @@ func (s *Service) TopicsPath() string {
 func (s *Service) TopicKey(topic string) string {
 	return fmt.Sprintf("%s/%s", s.TopicsPath(), topic)
 }
-
-func (s *Service) setTopicToEtcd(topicService map[string]string) error {
-	var err error
-	if s.etcdClient == nil {
-		// 创建etcd客户端
-		s.etcdClient, err = clientv3.New(clientv3.Config{
-			Endpoints:   s.sc.Etcd.Hosts, // etcd 服务地址
-			DialTimeout: 5 * time.Second,
-		})
-		if err != nil {
-			return err
-		}
-
-	}
-	if s.lease != nil {
-		// 需要撤销之前租约, 相当于关闭keepalive, 同时删除关联的key.
-		//否则会出现watch 相同key的内容的bug。即会出现 topic4:topic_service-1;topic4:topic_service-2
-		_, err = s.etcdClient.Revoke(s.ctx, s.lease.ID)
-		if err != nil {
-			panic(err)
-		}
-		time.Sleep(time.Second)
-		logx.Infof("=============== revoke lease:%d =================", s.lease.ID)
-	}
-
-	// 删除以 "/ns/as/topics" 开头的所有键, 避免其他服务残留数据, 如果不删除，直接更新已经存在的key, disov watch 到的内容也有点问题，同一个key的新旧value都能读到。
-	deleteResp, err := s.etcdClient.Delete(s.ctx, s.TopicsPath(), clientv3.WithPrefix())
-	if err != nil {
-		logx.Error(err)
-		return err
-	}
-	logx.Infof("Deleted %d keys with prefix %s", deleteResp.Deleted, s.TopicsPath())
-
-	// 定义 TTL 时间（例如 10 秒）
-	ttl := int64(20) // keepalive 会在这个时间1/3内发送心跳
-
-	// 创建一个租约
-	s.lease, err = s.etcdClient.Grant(s.ctx, ttl)
-	if err != nil {
-		return err
-	}
-
-	cli := s.etcdClient
-	lease := s.lease
-
-	//s.topicPerKey = true // 测试每个topic对应一个key。
-	if s.topicPerKey {
-		var successed bool
-		// 这种方式是，每个topic对应一个key, 坏处是，设置一次，watch方会watch 很多次变更。
-		// 并且发现bug, 用事务的方式提交或者多次put更新, watch变更的最终结果跟etcd上的不一致(TODO)。
-		// (done: 修复bug的方法是先撤销租约，把所有关联key删除，再设置所有key)
-		txn := true
-		if txn {
-			// 构建事务操作
-			txn := cli.Txn(context.Background())
-			ops := []clientv3.Op{}
-			for topic, service := range topicService {
-				ops = append(ops, clientv3.OpPut(s.TopicKey(topic), service, clientv3.WithLease(lease.ID)))
-			}
-			txn = txn.Then(ops...)
-			// 提交事务
-			txnResp, err := txn.Commit()
-			if err != nil {
-				return err
-			}
-			successed = txnResp.Succeeded
-		} else {
-			// 多次put更新, 出错也不会回滚。可能会部分成功, 部分失败的情况，导致数据不一致，这是不推荐的。
-			for topic, service := range topicService {
-				//time.Sleep(time.Millisecond * 100)
-				_, err = cli.Put(s.ctx, s.TopicKey(topic), service, clientv3.WithLease(lease.ID))
-				if err != nil {
-					return err
-				}
-			}
-			successed = true
-		}
-		// 检查事务执行结果
-		if successed {
-			logx.Info("All keys written successfully with TTL")
-			// 保持租约（可选，如果需要长期续约）
-			ch, kaErr := cli.KeepAlive(s.ctx, lease.ID)
-			if kaErr != nil {
-				logx.Errorf("KeepAlive error: %v\n", kaErr)
-				return err
-			}
-
-			// 打印 KeepAlive 响应, 正常情况下，ttl/3 秒会收到一次心跳.
-			go func() {
-				var ka = &clientv3.LeaseKeepAliveResponse{}
-				for ka = range ch {
-					logx.Infof("KeepAlive response: ID:%d, TTL=%d, service:%s\n", ka.ID, ka.TTL, s.sc.String())
-				}
-				logx.Errorf("service %s lease id:%d keepalive quit", s.sc.String(), ka.ID)
-			}()
-			return nil
-		} else {
-			return errors.New("transaction failed")
-		}
-	} else {
-		//这种方式是，所有topic对应一个key
-		vals := make([]string, 0, len(topicService))
-		for _, v := range topicService {
-			vals = append(vals, v)
-		}
-
-		// 写入键值对到 etcd
-		// key := s.TopicPath() //设置 /ns/as/topics , go-zero watch 不到数据， 所以设置 /ns/as/topics/all
-		key := s.TopicKey("all") //设置成 /ns/as/topics/all，go-zero watch 到数据
-		value := strings.Join(vals, TopicsSep)
-		_, err = cli.Put(s.ctx, key, value, clientv3.WithLease(lease.ID))
-		if err != nil {
-			return err
-		}
-		//set etcd key:/ns/as/topics/all, value:topic6:topic_service-2;topic10:topic_service-1
-		logx.Infof("set etcd key:%s, value:%s, written successfully with TTL", key, value)
-		// 保持租约（可选，如果需要长期续约）
-		ch, kaErr := cli.KeepAlive(s.ctx, lease.ID)
-		if kaErr != nil {
-			logx.Errorf("KeepAlive error: %v\n", kaErr)
-			return err
-		}
-		// 打印 KeepAlive 响应, 正常情况下，ttl/3 秒会收到一次心跳.
-		go func() {
-			var ka = &clientv3.LeaseKeepAliveResponse{}
-			for ka = range ch {
-				logx.Infof("KeepAlive response: TTL=%d, service:%s\n", ka.TTL, s.sc.String())
-			}
-			logx.Errorf("service %s lease id:%d keepalive quit", s.sc.String(), ka.ID)
-		}()
-	}
-	return nil
-}
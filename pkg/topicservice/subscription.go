@@ -0,0 +1,399 @@
+package topicservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/zeromicro/go-zero/core/logx"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// SubscriptionStore 记录实时的 topic-->services 订阅关系, 即哪些service 上有客户端订阅了topic,
+// service 之间转发topic 的publish 数据时, 根据它找到对应的service。
+//   - SubscriptionGossip: TopicState, 通过gossip 同步
+//   - SubscriptionEtcd: /ns/as/ontime/topicX/serviceN, key 关联租约, service 挂了etcd 自动删除
+//   - SubscriptionRedis: set /ns/as/ontime:topic:topicX, 成员是serviceN, 变化通过pub/sub 通知, alive key 过期清理crash 的service
+type SubscriptionStore interface {
+	// Subscribe 本service 上有客户端订阅了topics
+	Subscribe(topics ...string) error
+	// Unsubscribe 本service 上已经没有客户端订阅topics
+	Unsubscribe(topics ...string) error
+	// RemoveSubscriber 删除 topic-->service 的记录, 比如转发给service 的数据被告知它已经没有客户端订阅topic
+	RemoveSubscriber(topic, service string) error
+	// Subscribers 返回有客户端订阅topic 的service, ServiceInfo.String()
+	Subscribers(topic string) []string
+	// Subscriptions 返回所有的 topic-->services 的快照
+	Subscriptions() map[string][]string
+	// LocalSubscriptions 返回本service 上被订阅的topics
+	LocalSubscriptions() []string
+	Close() error
+}
+
+const (
+	SubscriptionGossip = "gossip"
+	SubscriptionEtcd   = "etcd"
+	SubscriptionRedis  = "redis"
+)
+
+var (
+	_ SubscriptionStore = (*TopicState)(nil)
+	_ SubscriptionStore = (*EtcdSubscriptionStore)(nil)
+	_ SubscriptionStore = (*RedisSubscriptionStore)(nil)
+)
+
+type SubscriptionConf struct {
+	Store string                `json:",optional"` // gossip|etcd|redis, 默认gossip(需要开启Gossip)
+	Redis RedisSubscriptionConf `json:",optional"` // Store 是redis 时使用
+}
+
+func (s *Service) OntimePath() string {
+	return fmt.Sprintf("/%s/%s/ontime", s.sc.Ns, s.sc.As)
+}
+
+// SubscriptionStore 返回配置的订阅关系存储, 没有配置时返回nil
+func (s *Service) SubscriptionStore() SubscriptionStore {
+	s.Lock()
+	defer s.Unlock()
+	return s.subs
+}
+
+func (s *Service) startSubscriptionStore() error {
+	switch s.sc.Subscription.Store {
+	case SubscriptionEtcd:
+		cli := s.getEtcdClient()
+		if cli == nil {
+			return fmt.Errorf("subscription store etcd requires etcd discovery")
+		}
+		store, err := NewEtcdSubscriptionStore(s.ctx, cli, s.OntimePath(), s.Key(), s.electionTTL())
+		if err != nil {
+			return err
+		}
+		store.OnLeaseLost(func() { s.metrics.Load().leaseLostInc("subscription") })
+		s.Lock()
+		s.subs = store
+		s.Unlock()
+	case SubscriptionRedis:
+		conf := s.sc.Subscription.Redis
+		if conf.Addr == "" {
+			return fmt.Errorf("subscription redis addr is empty")
+		}
+		cli := redis.NewClient(&redis.Options{Addr: conf.Addr, Password: conf.Pass, DB: conf.DB})
+		store, err := NewRedisSubscriptionStore(s.ctx, cli, s.OntimePath(), s.Key(), s.electionTTL())
+		if err != nil {
+			cli.Close()
+			return err
+		}
+		s.Lock()
+		s.redisClient = cli
+		s.subs = store
+		s.Unlock()
+	case "", SubscriptionGossip:
+		if s.topicState != nil {
+			s.Lock()
+			s.subs = s.topicState
+			s.Unlock()
+		}
+	default:
+		return fmt.Errorf("unknown subscription store:%s", s.sc.Subscription.Store)
+	}
+	return nil
+}
+
+var errSubscriptionClosed = errors.New("subscription store closed")
+
+// EtcdSubscriptionStore 用etcd 记录订阅关系: /ns/as/ontime/topicX/service1, /ns/as/ontime/topicX/service2,
+// 所有key 关联本service 的租约, service 挂了etcd 自动删除它的key; 所有service 都watch /ns/as/ontime/
+type EtcdSubscriptionStore struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	cli     *clientv3.Client
+	prefix  string
+	service string
+	ttl     int
+
+	writeMu     sync.Mutex //串行化写etcd 和重建session, 不阻塞读订阅关系
+	mu          sync.Mutex //保护下面的字段
+	session     *concurrency.Session
+	closed      bool
+	local       map[string]struct{}            //本service 订阅的topic
+	global      map[string]map[string]struct{} //key: topic, value: services
+	onLeaseLost func()
+}
+
+func NewEtcdSubscriptionStore(ctx context.Context, cli *clientv3.Client, prefix, service string, ttl int) (*EtcdSubscriptionStore, error) {
+	e := &EtcdSubscriptionStore{
+		cli:     cli,
+		prefix:  strings.TrimSuffix(prefix, "/") + "/",
+		service: service,
+		ttl:     ttl,
+		local:   make(map[string]struct{}),
+		global:  make(map[string]map[string]struct{}),
+	}
+	e.ctx, e.cancel = context.WithCancel(ctx)
+	e.writeMu.Lock()
+	_, err := e.getSession()
+	e.writeMu.Unlock()
+	if err != nil {
+		e.cancel()
+		return nil, err
+	}
+	if err := WatchPrefix(e.ctx, cli, e.prefix, e.update); err != nil {
+		e.Close()
+		return nil, err
+	}
+	go e.keepSession()
+	return e, nil
+}
+
+// OnLeaseLost 注册租约丢失的回调, session 重建前调用
+func (e *EtcdSubscriptionStore) OnLeaseLost(fn func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onLeaseLost = fn
+}
+
+// session 过期后马上重建, 不等下一次Subscribe
+func (e *EtcdSubscriptionStore) keepSession() {
+	for {
+		e.mu.Lock()
+		session := e.session
+		e.mu.Unlock()
+		if session == nil {
+			return
+		}
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-session.Done():
+		}
+		e.mu.Lock()
+		fn := e.onLeaseLost
+		e.mu.Unlock()
+		if fn != nil && e.ctx.Err() == nil {
+			fn()
+		}
+		for {
+			e.writeMu.Lock()
+			_, err := e.getSession()
+			e.writeMu.Unlock()
+			if err == nil {
+				break
+			}
+			if !sleepCtx(e.ctx, electionRetryDelay) {
+				return
+			}
+		}
+	}
+}
+
+func (e *EtcdSubscriptionStore) key(topic string) string {
+	return e.prefix + topic + "/" + e.service
+}
+
+// topic 里可能有"/", service 里没有, 所以最后一段是service
+func (e *EtcdSubscriptionStore) parseKey(key string) (topic, service string, ok bool) {
+	key = strings.TrimPrefix(key, e.prefix)
+	idx := strings.LastIndex(key, "/")
+	if idx <= 0 {
+		return "", "", false
+	}
+	return key[:idx], key[idx+1:], true
+}
+
+// 租约丢失(比如和etcd 断开太久)后重新创建session, 并把本service 的订阅重新写一遍。
+// 调用者持有writeMu, 访问etcd 时不持有mu, etcd 慢的时候不影响Subscribers
+func (e *EtcdSubscriptionStore) getSession() (*concurrency.Session, error) {
+	e.mu.Lock()
+	session, closed := e.session, e.closed
+	e.mu.Unlock()
+	if closed {
+		return nil, errSubscriptionClosed
+	}
+	if session != nil {
+		select {
+		case <-session.Done():
+			logx.Errorf("%s subscription session done, recreate it", e.service)
+		default:
+			return session, nil
+		}
+	}
+	session, err := concurrency.NewSession(e.cli, concurrency.WithTTL(e.ttl), concurrency.WithContext(e.ctx))
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		session.Close()
+		return nil, errSubscriptionClosed
+	}
+	e.session = session
+	topics := sortedKeys(e.local)
+	e.mu.Unlock()
+	for _, topic := range topics {
+		if _, err := e.cli.Put(e.ctx, e.key(topic), "", clientv3.WithLease(session.Lease())); err != nil {
+			logx.Errorf("resubscribe topic:%s err:%v", topic, err)
+		}
+	}
+	return session, nil
+}
+
+func (e *EtcdSubscriptionStore) update(kvs map[string]string) {
+	global := make(map[string]map[string]struct{})
+	for k := range kvs {
+		topic, service, ok := e.parseKey(k)
+		if !ok {
+			continue
+		}
+		if _, ok := global[topic]; !ok {
+			global[topic] = make(map[string]struct{})
+		}
+		global[topic][service] = struct{}{}
+	}
+	e.mu.Lock()
+	e.global = global
+	var missing []string
+	for topic := range e.local {
+		if _, ok := global[topic][e.service]; !ok {
+			missing = append(missing, topic)
+		}
+	}
+	e.mu.Unlock()
+	if len(missing) > 0 {
+		go e.reassert(missing)
+	}
+}
+
+// reassert 本service 还在订阅, 但是key 被删除了(比如其他service RemoveSubscriber), 重新写回去
+func (e *EtcdSubscriptionStore) reassert(topics []string) {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	session, err := e.getSession()
+	if err != nil {
+		logx.Errorf("%s reassert subscriptions err:%v", e.service, err)
+		return
+	}
+	for _, topic := range topics {
+		e.mu.Lock()
+		_, ok := e.local[topic]
+		e.mu.Unlock()
+		if !ok {
+			continue
+		}
+		logx.Infof("%s reassert subscription of topic:%s", e.service, topic)
+		if _, err := e.cli.Put(e.ctx, e.key(topic), "", clientv3.WithLease(session.Lease())); err != nil {
+			logx.Errorf("reassert topic:%s err:%v", topic, err)
+		}
+	}
+}
+
+func (e *EtcdSubscriptionStore) Subscribe(topics ...string) error {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	session, err := e.getSession()
+	if err != nil {
+		return err
+	}
+	ops := make([]clientv3.Op, 0, len(topics))
+	for _, topic := range topics {
+		ops = append(ops, clientv3.OpPut(e.key(topic), "", clientv3.WithLease(session.Lease())))
+	}
+	n, err := e.commit(ops)
+	// 已经写进etcd 的要记下来, 失败的部分由调用者重试
+	e.mu.Lock()
+	for _, topic := range topics[:n] {
+		e.local[topic] = struct{}{}
+	}
+	e.mu.Unlock()
+	return err
+}
+
+func (e *EtcdSubscriptionStore) Unsubscribe(topics ...string) error {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	ops := make([]clientv3.Op, 0, len(topics))
+	for _, topic := range topics {
+		ops = append(ops, clientv3.OpDelete(e.key(topic)))
+	}
+	n, err := e.commit(ops)
+	e.mu.Lock()
+	for _, topic := range topics[:n] {
+		delete(e.local, topic)
+	}
+	e.mu.Unlock()
+	return err
+}
+
+// commit 每maxTxnOps 个op 一个txn 提交, etcd 默认--max-txn-ops 是128, 一次订阅很多topic 时一个txn 放不下。
+// 每个topic 是单独的key, 不需要所有topic 在一个txn 里, 返回已经提交成功的op 个数
+func (e *EtcdSubscriptionStore) commit(ops []clientv3.Op) (int, error) {
+	for i := 0; i < len(ops); i += maxTxnOps {
+		end := min(i+maxTxnOps, len(ops))
+		if _, err := e.cli.Txn(e.ctx).Then(ops[i:end]...).Commit(); err != nil {
+			return i, err
+		}
+	}
+	return len(ops), nil
+}
+
+// RemoveSubscriber 删除其他service 的key, 用于清理已经不订阅了的记录;
+// service 还在订阅的话, 它watch 到自己的key 被删除后马上重新写回去
+func (e *EtcdSubscriptionStore) RemoveSubscriber(topic, service string) error {
+	if service == e.service {
+		return e.Unsubscribe(topic)
+	}
+	_, err := e.cli.Delete(e.ctx, e.prefix+topic+"/"+service)
+	return err
+}
+
+func (e *EtcdSubscriptionStore) Subscribers(topic string) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return sortedKeys(e.global[topic])
+}
+
+func (e *EtcdSubscriptionStore) Subscriptions() map[string][]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	subs := make(map[string][]string, len(e.global))
+	for topic, services := range e.global {
+		subs[topic] = sortedKeys(services)
+	}
+	return subs
+}
+
+func (e *EtcdSubscriptionStore) LocalSubscriptions() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return sortedKeys(e.local)
+}
+
+// Close 撤销租约, 删除本service 的所有订阅
+func (e *EtcdSubscriptionStore) Close() error {
+	e.mu.Lock()
+	session := e.session
+	e.session = nil
+	e.closed = true
+	e.mu.Unlock()
+	var err error
+	if session != nil {
+		err = session.Close()
+	}
+	e.cancel()
+	return err
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,335 @@
+package topicservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+type RedisSubscriptionConf struct {
+	Addr string `json:",optional"`
+	Pass string `json:",optional"`
+	DB   int    `json:",optional"`
+}
+
+// RedisSubscriptionStore 用redis 记录订阅关系:
+//   - <prefix>:topic:<topic>  set, 成员是订阅了topic 的service
+//   - <prefix>:topics         set, 所有的topic, 用来加载全部订阅关系, 不用SCAN
+//   - <prefix>:alive:<service> 带过期时间的key, service 定时续期, 挂了就过期
+//   - <prefix>:events         pub/sub channel, 订阅关系变化时通知其他service, 内容是TopicInfo
+//
+// service 自己负责在set:topicX 里加上或者删掉自己。收到其他service 转发过来的数据, 发现本地没有客户端订阅这个topic 时,
+// 调用Unsubscribe 删掉自己并通知其他service; 发现别的service 的记录不对时, 可以调用RemoveSubscriber。
+// service crash 后来不及删除自己的记录, 其他service 定时检查alive key, 过期了就把它从所有topic 里删掉。
+type RedisSubscriptionStore struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	cli     *redis.Client
+	pubsub  *redis.PubSub
+	prefix  string
+	service string
+	ttl     time.Duration
+
+	mu     sync.Mutex
+	local  map[string]struct{}            //本service 订阅的topic
+	global map[string]map[string]struct{} //key: topic, value: services
+}
+
+// NewRedisSubscriptionStore ttl 单位是秒, service 超过ttl 没有续期就认为它挂了。cli 由调用者关闭。
+func NewRedisSubscriptionStore(ctx context.Context, cli *redis.Client, prefix, service string, ttl int) (*RedisSubscriptionStore, error) {
+	if ttl <= 0 {
+		ttl = defaultElectionTTL
+	}
+	r := &RedisSubscriptionStore{
+		cli:     cli,
+		prefix:  strings.TrimSuffix(prefix, ":"),
+		service: service,
+		ttl:     time.Duration(ttl) * time.Second,
+		local:   make(map[string]struct{}),
+		global:  make(map[string]map[string]struct{}),
+	}
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	if err := r.heartbeat(); err != nil {
+		r.cancel()
+		return nil, err
+	}
+	// 先订阅channel 再加载, 避免漏掉加载过程中的变化
+	r.pubsub = cli.Subscribe(r.ctx, r.eventsKey())
+	if _, err := r.pubsub.Receive(r.ctx); err != nil {
+		r.pubsub.Close()
+		r.cancel()
+		return nil, err
+	}
+	if err := r.reload(); err != nil {
+		r.pubsub.Close()
+		r.cancel()
+		return nil, err
+	}
+	go r.watch()
+	go r.keepalive()
+	return r, nil
+}
+
+func (r *RedisSubscriptionStore) topicKey(topic string) string {
+	return r.prefix + ":topic:" + topic
+}
+func (r *RedisSubscriptionStore) topicsKey() string {
+	return r.prefix + ":topics"
+}
+func (r *RedisSubscriptionStore) aliveKey(service string) string {
+	return r.prefix + ":alive:" + service
+}
+func (r *RedisSubscriptionStore) eventsKey() string {
+	return r.prefix + ":events"
+}
+
+func (r *RedisSubscriptionStore) publish(ctx context.Context, pipe redis.Pipeliner, op int, topic, service string) {
+	data, _ := json.Marshal(TopicInfo{Op: op, Topic: topic, Service: service})
+	pipe.Publish(ctx, r.eventsKey(), data)
+}
+
+// heartbeat 续期alive key, 并把本service 的订阅重新写一遍, 防止被别的service 误删(比如和redis 断开超过ttl)
+func (r *RedisSubscriptionStore) heartbeat() error {
+	r.mu.Lock()
+	topics := sortedKeys(r.local)
+	r.mu.Unlock()
+	_, err := r.cli.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(r.ctx, r.aliveKey(r.service), time.Now().Unix(), r.ttl)
+		for _, topic := range topics {
+			pipe.SAdd(r.ctx, r.topicKey(topic), r.service)
+			pipe.SAdd(r.ctx, r.topicsKey(), topic)
+		}
+		return nil
+	})
+	return err
+}
+
+// reload 从redis 加载全部订阅关系, 顺便清理alive key 已经过期的service。
+// pub/sub 断开重连时可能漏掉消息, 所以定时reload。
+func (r *RedisSubscriptionStore) reload() error {
+	topics, err := r.cli.SMembers(r.ctx, r.topicsKey()).Result()
+	if err != nil {
+		return err
+	}
+	pipe := r.cli.Pipeline()
+	members := make(map[string]*redis.StringSliceCmd, len(topics))
+	for _, topic := range topics {
+		members[topic] = pipe.SMembers(r.ctx, r.topicKey(topic))
+	}
+	if _, err := pipe.Exec(r.ctx); err != nil {
+		return err
+	}
+
+	global := make(map[string]map[string]struct{}, len(topics))
+	serviceTopics := make(map[string][]string)
+	var empty []string
+	for topic, cmd := range members {
+		services := cmd.Val()
+		if len(services) == 0 {
+			empty = append(empty, topic)
+			continue
+		}
+		global[topic] = make(map[string]struct{}, len(services))
+		for _, service := range services {
+			global[topic][service] = struct{}{}
+			serviceTopics[service] = append(serviceTopics[service], topic)
+		}
+	}
+
+	pipe = r.cli.Pipeline()
+	alive := make(map[string]*redis.IntCmd, len(serviceTopics))
+	for service := range serviceTopics {
+		alive[service] = pipe.Exists(r.ctx, r.aliveKey(service))
+	}
+	if _, err := pipe.Exec(r.ctx); err != nil {
+		return err
+	}
+	for service, cmd := range alive {
+		if cmd.Val() > 0 || service == r.service {
+			continue
+		}
+		logx.Infof("subscription service:%s is dead, remove its topics:%v", service, serviceTopics[service])
+		if err := r.removeSubscriber(service, serviceTopics[service]...); err != nil {
+			logx.Errorf("remove dead service:%s err:%v", service, err)
+			continue
+		}
+		for _, topic := range serviceTopics[service] {
+			delete(global[topic], service)
+			if len(global[topic]) == 0 {
+				delete(global, topic)
+			}
+		}
+	}
+	// 没有service 的topic 从索引里删掉, 如果刚好有service 订阅了它, 下次heartbeat 会加回来
+	if len(empty) > 0 {
+		if err := r.cli.SRem(r.ctx, r.topicsKey(), empty).Err(); err != nil {
+			logx.Errorf("remove empty topics:%v err:%v", empty, err)
+		}
+	}
+
+	r.mu.Lock()
+	r.global = global
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *RedisSubscriptionStore) keepalive() {
+	beat := time.NewTicker(r.ttl / 3)
+	defer beat.Stop()
+	check := time.NewTicker(r.ttl)
+	defer check.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-beat.C:
+			if err := r.heartbeat(); err != nil {
+				logx.Errorf("%s subscription heartbeat err:%v", r.service, err)
+			}
+		case <-check.C:
+			if err := r.reload(); err != nil {
+				logx.Errorf("%s subscription reload err:%v", r.service, err)
+			}
+		}
+	}
+}
+
+func (r *RedisSubscriptionStore) watch() {
+	for msg := range r.pubsub.Channel() {
+		var info TopicInfo
+		if err := json.Unmarshal([]byte(msg.Payload), &info); err != nil {
+			logx.Errorf("invalid subscription event:%s, err:%v", msg.Payload, err)
+			continue
+		}
+		r.apply(info)
+	}
+}
+
+func (r *RedisSubscriptionStore) apply(info TopicInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch info.Op {
+	case ADD:
+		if _, ok := r.global[info.Topic]; !ok {
+			r.global[info.Topic] = make(map[string]struct{})
+		}
+		r.global[info.Topic][info.Service] = struct{}{}
+	case DEL:
+		delete(r.global[info.Topic], info.Service)
+		if len(r.global[info.Topic]) == 0 {
+			delete(r.global, info.Topic)
+		}
+	}
+}
+
+func (r *RedisSubscriptionStore) Subscribe(topics ...string) error {
+	_, err := r.cli.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		for _, topic := range topics {
+			pipe.SAdd(r.ctx, r.topicKey(topic), r.service)
+			pipe.SAdd(r.ctx, r.topicsKey(), topic)
+			r.publish(r.ctx, pipe, ADD, topic, r.service)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	for _, topic := range topics {
+		r.local[topic] = struct{}{}
+	}
+	r.mu.Unlock()
+	for _, topic := range topics {
+		r.apply(TopicInfo{Op: ADD, Topic: topic, Service: r.service})
+	}
+	return nil
+}
+
+func (r *RedisSubscriptionStore) Unsubscribe(topics ...string) error {
+	if err := r.removeSubscriber(r.service, topics...); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	for _, topic := range topics {
+		delete(r.local, topic)
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// RemoveSubscriber 删除其他service 对topic 的订阅并通知所有service,
+// 比如转发给service 的数据被告知没有客户端订阅, 而service 没有及时删掉自己的记录
+func (r *RedisSubscriptionStore) RemoveSubscriber(topic, service string) error {
+	if service == r.service {
+		return r.Unsubscribe(topic)
+	}
+	return r.removeSubscriber(service, topic)
+}
+
+func (r *RedisSubscriptionStore) removeSubscriber(service string, topics ...string) error {
+	_, err := r.cli.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		for _, topic := range topics {
+			pipe.SRem(r.ctx, r.topicKey(topic), service)
+			r.publish(r.ctx, pipe, DEL, topic, service)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		r.apply(TopicInfo{Op: DEL, Topic: topic, Service: service})
+	}
+	return nil
+}
+
+func (r *RedisSubscriptionStore) Subscribers(topic string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return sortedKeys(r.global[topic])
+}
+
+func (r *RedisSubscriptionStore) Subscriptions() map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	subs := make(map[string][]string, len(r.global))
+	for topic, services := range r.global {
+		subs[topic] = sortedKeys(services)
+	}
+	return subs
+}
+
+func (r *RedisSubscriptionStore) LocalSubscriptions() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return sortedKeys(r.local)
+}
+
+// Close 删除本service 的alive key 和所有订阅, 并通知其他service
+func (r *RedisSubscriptionStore) Close() error {
+	topics := r.LocalSubscriptions()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := r.cli.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.aliveKey(r.service))
+		for _, topic := range topics {
+			pipe.SRem(ctx, r.topicKey(topic), r.service)
+			r.publish(ctx, pipe, DEL, topic, r.service)
+		}
+		return nil
+	})
+	r.cancel()
+	if cerr := r.pubsub.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("close redis subscription store err:%w", err)
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package topicservice
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedis 测试用的redis, 只实现了RedisSubscriptionStore 用到的命令(RESP2), 类似miniredis
+type fakeRedis struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	strings map[string]time.Time //value 不重要, 只记录过期时间, 零值表示不过期
+	sets    map[string]map[string]struct{}
+	subs    map[string][]*fakeConn //key: channel
+	offset  time.Duration
+}
+
+type fakeConn struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+func (c *fakeConn) write(s string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w.WriteString(s)
+	c.w.Flush()
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		ln:      ln,
+		strings: make(map[string]time.Time),
+		sets:    make(map[string]map[string]struct{}),
+		subs:    make(map[string][]*fakeConn),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) Addr() string {
+	return f.ln.Addr().String()
+}
+
+// FastForward 让带过期时间的key 提前过期
+func (f *fakeRedis) FastForward(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.offset += d
+}
+
+func (f *fakeRedis) SMembers(key string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return sortedKeys(f.sets[key])
+}
+
+func (f *fakeRedis) exists(key string) bool {
+	if _, ok := f.sets[key]; ok {
+		return true
+	}
+	expire, ok := f.strings[key]
+	if !ok {
+		return false
+	}
+	if !expire.IsZero() && !time.Now().Add(f.offset).Before(expire) {
+		delete(f.strings, key)
+		return false
+	}
+	return true
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, _ := strconv.Atoi(line[1:])
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line)[1:])
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	c := &fakeConn{w: bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		c.write(f.exec(c, strings.ToUpper(args[0]), args[1:]))
+	}
+}
+
+func (f *fakeRedis) exec(c *fakeConn, cmd string, args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch cmd {
+	case "PING":
+		return "+PONG\r\n"
+	case "CLIENT", "SELECT":
+		return "+OK\r\n"
+	case "SET":
+		var expire time.Time
+		for i := 2; i+1 < len(args); i++ {
+			d, _ := strconv.Atoi(args[i+1])
+			switch strings.ToUpper(args[i]) {
+			case "EX":
+				expire = time.Now().Add(f.offset).Add(time.Duration(d) * time.Second)
+			case "PX":
+				expire = time.Now().Add(f.offset).Add(time.Duration(d) * time.Millisecond)
+			}
+		}
+		f.strings[args[0]] = expire
+		return "+OK\r\n"
+	case "DEL", "EXISTS":
+		n := 0
+		for _, key := range args {
+			if f.exists(key) {
+				n++
+				if cmd == "DEL" {
+					delete(f.strings, key)
+					delete(f.sets, key)
+				}
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SADD":
+		set, ok := f.sets[args[0]]
+		if !ok {
+			set = make(map[string]struct{})
+			f.sets[args[0]] = set
+		}
+		n := 0
+		for _, m := range args[1:] {
+			if _, ok := set[m]; !ok {
+				set[m] = struct{}{}
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SREM":
+		set := f.sets[args[0]]
+		n := 0
+		for _, m := range args[1:] {
+			if _, ok := set[m]; ok {
+				delete(set, m)
+				n++
+			}
+		}
+		if len(set) == 0 {
+			delete(f.sets, args[0])
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SMEMBERS":
+		members := sortedKeys(f.sets[args[0]])
+		reply := fmt.Sprintf("*%d\r\n", len(members))
+		for _, m := range members {
+			reply += bulk(m)
+		}
+		return reply
+	case "SUBSCRIBE":
+		reply := ""
+		for i, ch := range args {
+			f.subs[ch] = append(f.subs[ch], c)
+			reply += "*3\r\n" + bulk("subscribe") + bulk(ch) + fmt.Sprintf(":%d\r\n", i+1)
+		}
+		return reply
+	case "PUBLISH":
+		msg := "*3\r\n" + bulk("message") + bulk(args[0]) + bulk(args[1])
+		// 同步写, 保证消息按publish 的顺序到达
+		for _, sc := range f.subs[args[0]] {
+			sc.write(msg)
+		}
+		return fmt.Sprintf(":%d\r\n", len(f.subs[args[0]]))
+	}
+	// HELLO 等不支持的命令, go-redis 会回退到RESP2
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", cmd)
+}
+
+func newTestRedisStore(t *testing.T, f *fakeRedis, service string, ttl int) (*RedisSubscriptionStore, context.CancelFunc) {
+	cli := redis.NewClient(&redis.Options{Addr: f.Addr()})
+	t.Cleanup(func() { cli.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	store, err := NewRedisSubscriptionStore(ctx, cli, "/ns/as/ontime", service, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, cancel
+}
+
+func TestRedisSubscriptionStore(t *testing.T) {
+	f := newFakeRedis(t)
+	s1, cancel1 := newTestRedisStore(t, f, "s-1", 3)
+	defer cancel1()
+	s2, cancel2 := newTestRedisStore(t, f, "s-2", 3)
+	defer cancel2()
+
+	assert.Nil(t, s1.Subscribe("topic1", "topic2"))
+	assert.Nil(t, s2.Subscribe("topic1"))
+	assert.Equal(t, []string{"s-1", "s-2"}, f.SMembers("/ns/as/ontime:topic:topic1"))
+	assert.Equal(t, []string{"topic1", "topic2"}, s1.LocalSubscriptions())
+
+	// 通过pub/sub 拿到对方的订阅
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(map[string][]string{
+			"topic1": {"s-1", "s-2"},
+			"topic2": {"s-1"},
+		}, s2.Subscriptions())
+	}, time.Second, 10*time.Millisecond)
+
+	// s-2 收到转发的topic1 数据, 发现本地没有订阅了
+	assert.Nil(t, s2.Unsubscribe("topic1"))
+	assert.Equal(t, []string{"s-1"}, f.SMembers("/ns/as/ontime:topic:topic1"))
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"s-1"}, s1.Subscribers("topic1"))
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, s1.RemoveSubscriber("topic2", "s-1"))
+	assert.Equal(t, []string{"topic1"}, s1.LocalSubscriptions())
+	assert.Eventually(t, func() bool {
+		return len(s2.Subscribers("topic2")) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// 新的store 启动时从redis 加载全部订阅
+	s3, cancel3 := newTestRedisStore(t, f, "s-3", 3)
+	defer cancel3()
+	assert.Equal(t, map[string][]string{"topic1": {"s-1"}}, s3.Subscriptions())
+
+	assert.Nil(t, s1.Close())
+	assert.Empty(t, f.SMembers("/ns/as/ontime:topic:topic1"))
+	assert.Eventually(t, func() bool {
+		return len(s3.Subscriptions()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRedisSubscriptionStoreDeadService(t *testing.T) {
+	f := newFakeRedis(t)
+	s1, cancel1 := newTestRedisStore(t, f, "s-1", 1)
+	defer cancel1()
+	s2, cancel2 := newTestRedisStore(t, f, "s-2", 1)
+
+	assert.Nil(t, s1.Subscribe("topic1"))
+	assert.Nil(t, s2.Subscribe("topic1"))
+
+	// s-2 crash, 不会调用Close, alive key 过期后被s-1 清理
+	cancel2()
+	f.FastForward(2 * time.Second)
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"s-1"}, f.SMembers("/ns/as/ontime:topic:topic1")) &&
+			assert.ObjectsAreEqual([]string{"s-1"}, s1.Subscribers("topic1"))
+	}, 3*time.Second, 50*time.Millisecond)
+}
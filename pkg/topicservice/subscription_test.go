@@ -0,0 +1,126 @@
+package topicservice
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func newTestEtcdStore(t *testing.T, c *testCluster, service string, ttl int) (*EtcdSubscriptionStore, *clientv3.Client) {
+	t.Helper()
+	cli, err := clientv3.New(clientv3.Config{Endpoints: c.hosts, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	store, err := NewEtcdSubscriptionStore(context.Background(), cli, "/ns/as/ontime", service, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, cli
+}
+
+func TestEtcdSubscriptionStore(t *testing.T) {
+	c := newTestCluster(t)
+	s1, cli := newTestEtcdStore(t, c, "s-1", 60)
+	s2, _ := newTestEtcdStore(t, c, "s-2", 60)
+
+	assert.Nil(t, s1.Subscribe("topic1", "topic2"))
+	assert.Nil(t, s2.Subscribe("topic1"))
+	assert.Equal(t, []string{"topic1", "topic2"}, s1.LocalSubscriptions())
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(map[string][]string{
+			"topic1": {"s-1", "s-2"},
+			"topic2": {"s-1"},
+		}, s2.Subscriptions())
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, s2.Unsubscribe("topic1"))
+	assert.Empty(t, s2.LocalSubscriptions())
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"s-1"}, s1.Subscribers("topic1"))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// s-1 还在订阅topic2, 被其他service 删除后自己写回去
+	assert.Nil(t, s2.RemoveSubscriber("topic2", "s-1"))
+	assert.Eventually(t, func() bool {
+		resp, err := cli.Get(context.Background(), "/ns/as/ontime/topic2/s-1")
+		return err == nil && len(resp.Kvs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"s-1"}, s2.Subscribers("topic2"))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 已经不订阅的记录删除后不会写回去
+	_, err := cli.Put(context.Background(), "/ns/as/ontime/topic3/s-1", "")
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return len(s2.Subscribers("topic3")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, s2.RemoveSubscriber("topic3", "s-1"))
+	assert.Eventually(t, func() bool {
+		return len(s2.Subscribers("topic3")) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Close 撤销租约, 其他service 看不到它的订阅了
+	assert.Nil(t, s1.Close())
+	assert.Eventually(t, func() bool {
+		return len(s2.Subscriptions()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestEtcdSubscriptionStoreManyTopics(t *testing.T) {
+	c := newTestCluster(t)
+	s1, cli := newTestEtcdStore(t, c, "s-1", 60)
+
+	// 超过etcd 默认的--max-txn-ops(128), 分多个txn 提交
+	var topics []string
+	for i := 0; i < 3*maxTxnOps+1; i++ {
+		topics = append(topics, fmt.Sprintf("topic%03d", i))
+	}
+	assert.Nil(t, s1.Subscribe(topics...))
+	assert.Equal(t, topics, s1.LocalSubscriptions())
+	resp, err := cli.Get(context.Background(), "/ns/as/ontime/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(topics)), resp.Count)
+
+	assert.Nil(t, s1.Unsubscribe(topics...))
+	assert.Empty(t, s1.LocalSubscriptions())
+	resp, err = cli.Get(context.Background(), "/ns/as/ontime/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	assert.Nil(t, err)
+	assert.Zero(t, resp.Count)
+}
+
+func TestEtcdSubscriptionStoreLeaseLost(t *testing.T) {
+	c := newTestCluster(t)
+	s1, cli := newTestEtcdStore(t, c, "s-1", 1)
+	s2, _ := newTestEtcdStore(t, c, "s-2", 1)
+	lost := make(chan struct{}, 1)
+	s1.OnLeaseLost(func() { lost <- struct{}{} })
+	assert.Nil(t, s1.Subscribe("topic1"))
+
+	// 租约被撤销, 重建session 后重新写订阅
+	s1.mu.Lock()
+	lease := s1.session.Lease()
+	s1.mu.Unlock()
+	_, err := cli.Revoke(context.Background(), lease)
+	assert.Nil(t, err)
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease lost not notified")
+	}
+	assert.Eventually(t, func() bool {
+		s1.mu.Lock()
+		defer s1.mu.Unlock()
+		return s1.session.Lease() != lease
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"s-1"}, s2.Subscribers("topic1"))
+	}, 5*time.Second, 10*time.Millisecond)
+}
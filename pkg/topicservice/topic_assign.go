@@ -0,0 +1,357 @@
+package topicservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jursonmo/practise_new/pkg/hash"
+	"github.com/zeromicro/go-zero/core/logx"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// topic-->services 分配结果在etcd 上的布局:
+//   - TopicLayoutAll:   所有topic 写在一个key 里, /ns/as/topics/all, value: topic1:s1|s2;topic2:s1
+//   - TopicLayoutTopic: 每个topic 一个key, /ns/as/topics/topic1, value: topic1:s1|s2
+//   - TopicLayoutNode:  按topic 的首选service(node)分片, /ns/as/topics/s1, value: topic1:s1|s2;topic2:s1
+//     某个node 负责的topic 有变化时，只需要更新这个key 即可。
+//
+// leader 每次重新分配后, 只把有变化的key 放在一个事务里更新, 事务的条件是:
+//  1. 自己仍然是leader(选举key 的CreateRevision 没变)
+//  2. /ns/as/topics/ 下的key 在读取之后没有被其他人修改过(ModRevision 比读取时的revision 小)
+//
+// 一个事务最多修改maxTxnOps 个key, 超过时返回ErrTooManyTopicKeys, 不拆成多个事务, 否则follower 会看到一半的分配结果。
+// TopicLayoutNode 的key 数是service 的个数, 一般不会超过。
+//
+// 这些key 没有关联租约, leader 切换时新leader 读取已有的分配结果再做增量更新, 避免删除重建带来的watch 抖动。
+const (
+	TopicLayoutAll   = "all"
+	TopicLayoutTopic = "topic"
+	TopicLayoutNode  = "node"
+
+	allTopicsKey = "all"
+
+	// etcd 默认的--max-txn-ops 是128, 一个事务最多修改128个key
+	maxTxnOps = 128
+)
+
+var (
+	ErrNotLeader = errors.New("not leader")
+	// ErrTooManyTopicKeys 一次分配修改的key 超过一个etcd 事务的限制, TopicLayoutTopic 且topic 很多时会出现
+	ErrTooManyTopicKeys = errors.New("too many topic keys changed in one etcd txn")
+)
+
+func (s *Service) topicLayout() string {
+	switch s.sc.TopicLayout {
+	case TopicLayoutAll, TopicLayoutTopic:
+		return s.sc.TopicLayout
+	default:
+		return TopicLayoutNode
+	}
+}
+
+// topicKeyValues 根据布局把 topic-->topicData 转换成etcd 上的 key-->value
+func topicKeyValues(layout string, topicsPath string, topicService map[string]string) map[string]string {
+	kvs := make(map[string]string)
+	topics := make([]string, 0, len(topicService))
+	for topic := range topicService {
+		topics = append(topics, topic)
+	}
+	// 保证同样的分配结果生成同样的value, 避免无意义的更新
+	sort.Strings(topics)
+
+	shards := make(map[string][]string)
+	for _, topic := range topics {
+		data := topicService[topic]
+		switch layout {
+		case TopicLayoutTopic:
+			kvs[topicsPath+"/"+topic] = data
+		case TopicLayoutAll:
+			shards[allTopicsKey] = append(shards[allTopicsKey], data)
+		default:
+			_, ss, err := parseTopicData(data)
+			ss, _ = splitTopicBalancer(ss)
+			if err != nil || ss == "" {
+				logx.Errorf("topic:%s has no service, skip it", topic)
+				continue
+			}
+			node := strings.Split(ss, TopicServiceSeq)[0]
+			shards[node] = append(shards[node], data)
+		}
+	}
+	for shard, vals := range shards {
+		kvs[topicsPath+"/"+shard] = strings.Join(vals, TopicsSep)
+	}
+	return kvs
+}
+
+// diffTopicKeys 比较新旧的 key-->value, 返回需要put 和delete 的key
+func diffTopicKeys(old, new map[string]string) (puts map[string]string, dels []string) {
+	puts = make(map[string]string)
+	for k, v := range new {
+		if ov, ok := old[k]; !ok || ov != v {
+			puts[k] = v
+		}
+	}
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			dels = append(dels, k)
+		}
+	}
+	sort.Strings(dels)
+	return puts, dels
+}
+
+// ParseTopicValues 把etcd 上 /ns/as/topics/ 下所有的value 解析成 topic-->services 和 topic-->balancer,
+// services 是用TopicServiceSeq 分隔的ServiceInfo.String()
+func ParseTopicValues(vals []string) (map[string]string, map[string]string) {
+	distributedTopics := make(map[string]string)
+	distributedBalancers := make(map[string]string)
+	for _, val := range vals {
+		// 三种布局的value 都可以按TopicsSep 分隔, v 格式 topic6:topic_service-1
+		for _, v := range strings.Split(val, TopicsSep) {
+			if v == "" {
+				continue
+			}
+			topic, services, err := parseTopicData(v)
+			if err != nil {
+				logx.Error(err)
+				continue
+			}
+			services, balancer := splitTopicBalancer(services)
+			distributedTopics[topic] = services
+			if balancer != "" {
+				distributedBalancers[topic] = balancer
+			}
+		}
+	}
+	return distributedTopics, distributedBalancers
+}
+
+func (s *Service) setTopicToEtcd(topicService map[string]string) error {
+	s.Lock()
+	cli := s.etcdClient
+	election := s.election
+	s.Unlock()
+	if cli == nil {
+		return errors.New("etcd client is nil")
+	}
+	if election == nil {
+		return ErrNotLeader
+	}
+
+	getResp, err := cli.Get(s.ctx, s.TopicsPath()+"/", clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	old := make(map[string]string, len(getResp.Kvs))
+	for _, kv := range getResp.Kvs {
+		old[string(kv.Key)] = string(kv.Value)
+	}
+
+	puts, dels := diffTopicKeys(old, topicKeyValues(s.topicLayout(), s.TopicsPath(), topicService))
+	if len(puts) == 0 && len(dels) == 0 {
+		logx.Info("topic assignment not changed")
+		return s.publishRing(cli, election)
+	}
+
+	// 所有变化在一个事务里, follower 要么看到旧的分配结果, 要么看到新的。
+	// etcd 默认一个事务最多128个操作(--max-txn-ops), 超过时不拆成多个事务, 直接报错, topic 很多时用TopicLayoutNode
+	if n := len(puts) + len(dels); n > maxTxnOps {
+		return fmt.Errorf("%w: %d keys changed, layout:%s, use layout %s",
+			ErrTooManyTopicKeys, n, s.topicLayout(), TopicLayoutNode)
+	}
+	keys := make([]string, 0, len(puts))
+	for k := range puts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	// 用范围比较代替每个key 一个比较: /ns/as/topics/ 下的key 在读取之后都没有被修改过
+	prefix := s.TopicsPath() + "/"
+	cmps := []clientv3.Cmp{
+		clientv3.Compare(clientv3.CreateRevision(election.Key()), "=", election.Rev()),
+		clientv3.Compare(clientv3.ModRevision(prefix), "<", getResp.Header.Revision+1).WithPrefix(),
+	}
+	ops := make([]clientv3.Op, 0, len(puts)+len(dels))
+	for _, k := range keys {
+		ops = append(ops, clientv3.OpPut(k, puts[k]))
+	}
+	for _, k := range dels {
+		ops = append(ops, clientv3.OpDelete(k))
+	}
+	txnResp, err := cli.Txn(s.ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	if !txnResp.Succeeded {
+		return fmt.Errorf("update topics txn failed, maybe leader changed or topics modified concurrently")
+	}
+	revision := txnResp.Header.Revision
+	logx.Infof("update topics to etcd, put:%d, del:%d, revision:%d", len(puts), len(dels), revision)
+	return s.publishRing(cli, election)
+}
+
+func (s *Service) RingPath() string {
+	return fmt.Sprintf("/%s/%s/ring", s.sc.Ns, s.sc.As)
+}
+
+// publishRing leader 把分配用的hash 环(默认负载算法的)写到/ns/as/ring, 没有变化时不写。
+// 单独给topic 指定的负载算法不在里面
+func (s *Service) publishRing(cli *clientv3.Client, election *concurrency.Election) error {
+	ring, ok, err := s.balance.DefaultRing()
+	if !ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(ring)
+	if err != nil {
+		return err
+	}
+	resp, err := cli.Get(s.ctx, s.RingPath())
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) > 0 && string(resp.Kvs[0].Value) == string(data) {
+		return nil
+	}
+	txnResp, err := cli.Txn(s.ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(election.Key()), "=", election.Rev())).
+		Then(clientv3.OpPut(s.RingPath(), string(data))).Commit()
+	if err != nil {
+		return err
+	}
+	if !txnResp.Succeeded {
+		return ErrNotLeader
+	}
+	logx.Infof("publish ring, nodes:%d, fingerprint:%s", len(ring.Nodes), ring.Fingerprint())
+	return nil
+}
+
+// PublishedRing 读取leader 发布的hash 环, 和自己的RingFingerprint 比较就知道两边的环是否一样
+func (s *Service) PublishedRing(ctx context.Context) (hash.Ring, error) {
+	cli := s.getEtcdClient()
+	if cli == nil {
+		return hash.Ring{}, errors.New("etcd client is nil")
+	}
+	resp, err := cli.Get(ctx, s.RingPath())
+	if err != nil {
+		return hash.Ring{}, err
+	}
+	if len(resp.Kvs) == 0 {
+		return hash.Ring{}, errors.New("ring not published")
+	}
+	var ring hash.Ring
+	if err := json.Unmarshal(resp.Kvs[0].Value, &ring); err != nil {
+		return hash.Ring{}, err
+	}
+	return ring, nil
+}
+
+// RingFingerprint 本服务默认负载算法的hash 环的指纹, 默认负载算法不是一致性hash 时返回空
+func (s *Service) RingFingerprint() string {
+	ring, ok, err := s.localRing()
+	if !ok || err != nil {
+		return ""
+	}
+	return ring.Fingerprint()
+}
+
+// localRing 本服务根据自己发现的服务列表建的hash 环。etcd 发现模式下只有leader 更新balance,
+// 其他服务用同样的默认负载算法临时建一个
+func (s *Service) localRing() (hash.Ring, bool, error) {
+	if s.IsLeader() || s.gossipDiscovery() {
+		return s.balance.DefaultRing()
+	}
+	balancer, err := NewBalancer(s.balance.DefaultBalancerName())
+	if err != nil {
+		return hash.Ring{}, false, err
+	}
+	exporter, ok := balancer.(RingExporter)
+	if !ok {
+		return hash.Ring{}, false, nil
+	}
+	balancer.Init(activeServices(s.getServiceList()))
+	ring, err := exporter.Ring()
+	return ring, true, err
+}
+
+// WatchPrefix 用clientv3 watch 前缀, 维护 key-->value, 每次变化都回调全量的 key-->value。
+// go-zero 的discov.Subscriber 以value 为索引, 同一个key 更新时会同时读到新旧value, 所以这里不用它。
+func WatchPrefix(ctx context.Context, cli *clientv3.Client, prefix string, handle func(kvs map[string]string)) error {
+	var mu sync.Mutex
+	kvs := make(map[string]string)
+	load := func() (int64, error) {
+		resp, err := cli.Get(ctx, prefix, clientv3.WithPrefix())
+		if err != nil {
+			return 0, err
+		}
+		mu.Lock()
+		kvs = make(map[string]string, len(resp.Kvs))
+		for _, kv := range resp.Kvs {
+			kvs[string(kv.Key)] = string(kv.Value)
+		}
+		mu.Unlock()
+		return resp.Header.Revision, nil
+	}
+	notify := func() {
+		mu.Lock()
+		cp := make(map[string]string, len(kvs))
+		for k, v := range kvs {
+			cp[k] = v
+		}
+		mu.Unlock()
+		handle(cp)
+	}
+
+	rev, err := load()
+	if err != nil {
+		return err
+	}
+	notify()
+
+	go func() {
+		for {
+			wch := cli.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+			for wresp := range wch {
+				if wresp.Err() != nil {
+					logx.Errorf("watch %s err:%v", prefix, wresp.Err())
+					break
+				}
+				mu.Lock()
+				for _, ev := range wresp.Events {
+					if ev.Type == clientv3.EventTypeDelete {
+						delete(kvs, string(ev.Kv.Key))
+					} else {
+						kvs[string(ev.Kv.Key)] = string(ev.Kv.Value)
+					}
+				}
+				mu.Unlock()
+				rev = wresp.Header.Revision
+				notify()
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			// watch 中断(比如被compact), 重新全量读取
+			for {
+				rev, err = load()
+				if err == nil {
+					break
+				}
+				logx.Errorf("reload %s err:%v", prefix, err)
+				if !sleepCtx(ctx, electionRetryDelay) {
+					return
+				}
+			}
+			notify()
+		}
+	}()
+	return nil
+}
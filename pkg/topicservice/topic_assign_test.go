@@ -0,0 +1,56 @@
+package topicservice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicKeyValues(t *testing.T) {
+	topicService := map[string]string{
+		"topic1": "topic1:s-1|s-2@weighted",
+		"topic2": "topic2:s-2",
+		"topic3": "topic3:s-1",
+	}
+	path := "/ns/as/topics"
+
+	assert.Equal(t, map[string]string{
+		path + "/all": "topic1:s-1|s-2@weighted;topic2:s-2;topic3:s-1",
+	}, topicKeyValues(TopicLayoutAll, path, topicService))
+
+	assert.Equal(t, map[string]string{
+		path + "/topic1": "topic1:s-1|s-2@weighted",
+		path + "/topic2": "topic2:s-2",
+		path + "/topic3": "topic3:s-1",
+	}, topicKeyValues(TopicLayoutTopic, path, topicService))
+
+	kvs := topicKeyValues(TopicLayoutNode, path, topicService)
+	assert.Equal(t, map[string]string{
+		path + "/s-1": "topic1:s-1|s-2@weighted;topic3:s-1",
+		path + "/s-2": "topic2:s-2",
+	}, kvs)
+
+	vals := make([]string, 0, len(kvs))
+	for _, v := range kvs {
+		vals = append(vals, v)
+	}
+	topics, balancers := ParseTopicValues(vals)
+	assert.Equal(t, map[string]string{
+		"topic1": "s-1|s-2",
+		"topic2": "s-2",
+		"topic3": "s-1",
+	}, topics)
+	assert.Equal(t, map[string]string{"topic1": "weighted"}, balancers)
+}
+
+func TestDiffTopicKeys(t *testing.T) {
+	old := map[string]string{"a": "1", "b": "2", "c": "3"}
+	new := map[string]string{"a": "1", "b": "22", "d": "4"}
+	puts, dels := diffTopicKeys(old, new)
+	assert.Equal(t, map[string]string{"b": "22", "d": "4"}, puts)
+	assert.Equal(t, []string{"c"}, dels)
+
+	puts, dels = diffTopicKeys(new, new)
+	assert.Empty(t, puts)
+	assert.Empty(t, dels)
+}
@@ -1,16 +1,16 @@
 package topicservice
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/memberlist"
 	"github.com/zeromicro/go-zero/core/logx"
@@ -25,6 +25,26 @@ type TopicInfo struct {
 	Op      int //1:add, 2:del
 	Topic   string
 	Service string //node
+	// Service 的Lamport 计数, 只有Service 自己会增加, 同一个 topic/service 版本大的覆盖版本小的; 0 表示没有版本(旧节点), 不能复活墓碑
+	Version uint64 `json:",omitempty"`
+}
+
+// SubscriptionChangeHandler GlobalTopics 里 topic-->service 有变化时的回调, Op 是ADD 或DEL,
+// 节点离开被清理时, 它的每个topic 都会回调一次DEL
+type SubscriptionChangeHandler func(change TopicInfo)
+
+// 节点离开(或者被判定失败)后等多久才清理它的订阅, 期间重新加入就不清理, 避免网络抖动时订阅关系来回变化
+const defaultLeaveGrace = 5 * time.Second
+
+// 删除的记录保留为墓碑, 防止被其他节点推送过来的旧数据复活, 超过tombstoneTTL 后回收。
+// 离线超过tombstoneTTL 的节点重新加入时可能把已经删除的记录带回来, 记录的owner 看到后会用更大的版本重新删除。
+const defaultTombstoneTTL = 10 * time.Minute
+
+// topicEntry 一个 topic-->service 记录的版本
+type topicEntry struct {
+	Version   uint64
+	Deleted   bool //墓碑
+	UpdatedAt time.Time
 }
 
 // TopicState 表示节点当前的订阅状态
@@ -33,8 +53,33 @@ type TopicState struct {
 	LocalTopics  map[string]TopicInfo   // key是{topic}
 	GlobalTopics map[string]*ServiceSet //map[topic]
 
+	name         string                            //本节点的名字, 也就是Service
+	clock        uint64                            //本节点的Lamport 计数
+	entries      map[string]map[string]*topicEntry //key: topic, service, 包括墓碑
+	tombstoneTTL time.Duration
+	done         chan struct{}
+
+	leaveGrace  time.Duration
+	purgeTimers map[string]*time.Timer //key: 离开的节点, 宽限期到了就清理
+	dead        map[string]time.Time   //已经清理的节点, 其他节点推送过来的它的记录忽略, 重新加入后删除
+
+	changes        []TopicInfo //还没有回调的变化
+	notifyMu       sync.Mutex  //保证回调的顺序
+	changeHandlers []SubscriptionChangeHandler
+
 	cluster    *memberlist.Memberlist
 	broadcasts *memberlist.TransmitLimitedQueue
+	keyring    *memberlist.Keyring //配置了SecretKeys 才有
+	codec      GossipCodec
+	deltaState bool //push/pull 时只发送自己的记录
+
+	metaMu         sync.Mutex
+	localMeta      NodeMetadata
+	localMetaBytes []byte
+	peerMeta       map[string]NodeMetadata //key: 节点名字
+	memberHandlers []MemberChangeHandler
+
+	metrics atomic.Pointer[Metrics]
 }
 
 type ServiceSet struct {
@@ -64,44 +109,333 @@ func (s *ServiceSet) Del(service string) {
 	delete(s.Services, service)
 }
 
-// 添加或更新 topic 信息
-func (s *TopicState) UpdateGlobalTopic(info TopicInfo) {
+// 添加或更新 topic 信息, 版本比本地记录旧的忽略, 返回是否生效
+func (s *TopicState) UpdateGlobalTopic(info TopicInfo) bool {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	applied := s.applyLocked(info)
+	s.mu.Unlock()
+	s.notifyChanges()
+	return applied
+}
 
+func (s *TopicState) applyLocked(info TopicInfo) bool {
+	services, ok := s.entries[info.Topic]
+	if !ok {
+		services = make(map[string]*topicEntry)
+		s.entries[info.Topic] = services
+	}
+	entry, ok := services[info.Service]
+	if ok && info.Version != 0 && info.Version <= entry.Version {
+		return false
+	}
+	// 没有版本的ADD(旧节点推送过来的)不能复活墓碑
+	if ok && info.Version == 0 && info.Op == ADD && entry.Deleted {
+		return false
+	}
+	if !ok {
+		entry = &topicEntry{}
+		services[info.Service] = entry
+	}
+	if info.Version != 0 {
+		entry.Version = info.Version
+	}
+	entry.Deleted = info.Op == DEL
+	entry.UpdatedAt = time.Now()
+	// 看到自己更大的版本(比如重启前的), 后面的操作要用更大的版本
+	if info.Service == s.name && info.Version > s.clock {
+		s.clock = info.Version
+	}
+
+	// 交接确认只保存在entries 里, 不是订阅
+	if !isHandoffAckTopic(info.Topic) {
+		s.setServiceLocked(info.Topic, info.Service, info.Op)
+	}
+	return true
+}
+
+// setServiceLocked 修改GlobalTopics, 有变化时记录下来, 释放锁后由notifyChanges 回调
+func (s *TopicState) setServiceLocked(topic, service string, op int) {
+	sm, ok := s.GlobalTopics[topic]
 	//del
-	if info.Op == DEL {
-		sm, ok := s.GlobalTopics[info.Topic]
-		if ok {
-			sm.Del(info.Service)
-			if len(sm.Services) == 0 {
-				delete(s.GlobalTopics, info.Topic)
-			}
+	if op == DEL {
+		if !ok {
+			return
+		}
+		sm.RLock()
+		_, exist := sm.Services[service]
+		sm.RUnlock()
+		if !exist {
+			return
 		}
+		sm.Del(service)
+		if len(sm.Services) == 0 {
+			delete(s.GlobalTopics, topic)
+		}
+		s.changes = append(s.changes, TopicInfo{Op: DEL, Topic: topic, Service: service})
 		return
 	}
 	//add
-	sm, ok := s.GlobalTopics[info.Topic]
 	if !ok {
 		sm = NewServiceSet()
-		sm.Add(info.Service)
-		s.GlobalTopics[info.Topic] = sm
+		s.GlobalTopics[topic] = sm
+	}
+	sm.RLock()
+	_, exist := sm.Services[service]
+	sm.RUnlock()
+	if exist {
 		return
 	}
-	sm.Add(info.Service)
+	sm.Add(service)
+	s.changes = append(s.changes, TopicInfo{Op: ADD, Topic: topic, Service: service})
 }
 
-func (s *TopicState) GetLocalTopics() map[string]TopicInfo {
+// OnSubscriptionChange 注册 topic-->service 变化的回调, 回调是按变化的顺序串行调用的, 回调里不能再修改TopicState
+func (s *TopicState) OnSubscriptionChange(fn SubscriptionChangeHandler) {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	s.changeHandlers = append(s.changeHandlers, fn)
+}
+
+func (s *TopicState) notifyChanges() {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	s.mu.Lock()
+	changes := s.changes
+	s.changes = nil
+	s.mu.Unlock()
+	for _, change := range changes {
+		for _, fn := range s.changeHandlers {
+			fn(change)
+		}
+	}
+}
+
+// SetLeaveGrace 设置节点离开后等多久才清理它的订阅, 0 表示立即清理
+func (s *TopicState) SetLeaveGrace(grace time.Duration) {
+	if grace < 0 {
+		return
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.LocalTopics
+	s.leaveGrace = grace
 }
 
-// 获取所有 topics
-func (s *TopicState) GetTopics() map[string]*ServiceSet {
+// nodeLeft 节点离开或者被判定失败, 宽限期后清理它的订阅
+func (s *TopicState) nodeLeft(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if name == s.name {
+		return
+	}
+	if t, ok := s.purgeTimers[name]; ok {
+		t.Stop()
+	}
+	s.purgeTimers[name] = time.AfterFunc(s.leaveGrace, func() {
+		s.purgeService(name)
+	})
+}
+
+// nodeJoined 节点加入或者重新加入, 取消还没执行的清理;
+// 重新加入的节点主动和它做一次push/pull, 把它的订阅(可能在离开期间变了)同步过来, 也把自己的同步过去
+func (s *TopicState) nodeJoined(node *memberlist.Node) {
+	s.mu.Lock()
+	t, pending := s.purgeTimers[node.Name]
+	if pending {
+		t.Stop()
+		delete(s.purgeTimers, node.Name)
+	}
+	_, wasDead := s.dead[node.Name]
+	delete(s.dead, node.Name)
+	s.mu.Unlock()
+	if node.Name == s.name || !(pending || wasDead) {
+		return
+	}
+	// NotifyJoin 里不能调用Join(memberlist 持有锁), 所以放到goroutine
+	go func() {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		if _, err := s.cluster.Join([]string{node.Address()}); err != nil {
+			logx.Errorf("push state to rejoined node:%s err:%v", node.Name, err)
+		}
+	}()
+}
+
+func (s *TopicState) isMember(name string) bool {
+	for _, node := range s.cluster.Members() {
+		if node.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// purgeService 删除节点的所有记录(不留墓碑), 节点重新加入后推送过来的记录会重新生效
+func (s *TopicState) purgeService(name string) {
+	// 宽限期内重新加入了
+	if s.isMember(name) {
+		s.mu.Lock()
+		delete(s.purgeTimers, name)
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Lock()
+	delete(s.purgeTimers, name)
+	var topics []string
+	for topic, services := range s.entries {
+		if _, ok := services[name]; !ok {
+			continue
+		}
+		delete(services, name)
+		if len(services) == 0 {
+			delete(s.entries, topic)
+		}
+		s.setServiceLocked(topic, name, DEL)
+		topics = append(topics, topic)
+	}
+	s.dead[name] = time.Now()
+	s.mu.Unlock()
+	logx.Infof("gossip node:%s left, purge its topics:%v", name, topics)
+	s.notifyChanges()
+}
+
+// merge 合并其他节点发过来的记录, 如果别人看到的自己的记录跟本地的订阅不一致(比如重启前的记录),
+// 用更大的版本重新宣告自己的订阅
+func (s *TopicState) merge(infos []TopicInfo) {
+	var add, del []string
+	s.mu.Lock()
+	for _, info := range infos {
+		// 已经清理的节点, 其他节点还没来得及清理, 推送过来的它的记录不要
+		if _, dead := s.dead[info.Service]; dead {
+			continue
+		}
+		if !s.applyLocked(info) || info.Service != s.name || isHandoffAckTopic(info.Topic) {
+			continue
+		}
+		_, local := s.LocalTopics[info.Topic]
+		if info.Op == ADD && !local {
+			del = append(del, info.Topic)
+		} else if info.Op == DEL && local {
+			add = append(add, info.Topic)
+		}
+	}
+	s.mu.Unlock()
+	s.notifyChanges()
+	if len(add) > 0 {
+		logx.Infof("reassert local topics:%v", add)
+		s.UpdateTopic(ADD, add, true)
+	}
+	if len(del) > 0 {
+		logx.Infof("reassert deleted local topics:%v", del)
+		s.UpdateTopic(DEL, del, true)
+	}
+}
+
+// snapshot 返回所有记录, 包括墓碑, 用于push/pull 全量同步
+func (s *TopicState) snapshot() []TopicInfo {
+	return s.snapshotOf("")
+}
+
+// ownSnapshot 返回自己的记录, 包括墓碑
+func (s *TopicState) ownSnapshot() []TopicInfo {
+	return s.snapshotOf(s.name)
+}
+
+// snapshotOf 返回service 的记录, service 为空时返回所有的记录
+func (s *TopicState) snapshotOf(owner string) []TopicInfo {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.GlobalTopics
+	infos := make([]TopicInfo, 0, len(s.entries))
+	for topic, services := range s.entries {
+		for service, entry := range services {
+			if owner != "" && service != owner {
+				continue
+			}
+			op := ADD
+			if entry.Deleted {
+				op = DEL
+			}
+			infos = append(infos, TopicInfo{Op: op, Topic: topic, Service: service, Version: entry.Version})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Topic != infos[j].Topic {
+			return infos[i].Topic < infos[j].Topic
+		}
+		return infos[i].Service < infos[j].Service
+	})
+	return infos
+}
+
+// SetTombstoneTTL 设置墓碑保留多久, 需要比节点可能离线的时间长
+func (s *TopicState) SetTombstoneTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tombstoneTTL = ttl
+}
+
+// gcTombstones 回收超过tombstoneTTL 的墓碑, 返回回收的数量
+func (s *TopicState) gcTombstones(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for topic, services := range s.entries {
+		for service, entry := range services {
+			if entry.Deleted && now.Sub(entry.UpdatedAt) > s.tombstoneTTL {
+				delete(services, service)
+				n++
+			}
+		}
+		if len(services) == 0 {
+			delete(s.entries, topic)
+		}
+	}
+	for name, at := range s.dead {
+		if now.Sub(at) > s.tombstoneTTL {
+			delete(s.dead, name)
+		}
+	}
+	return n
+}
+
+func (s *TopicState) gcLoop() {
+	for {
+		s.mu.Lock()
+		interval := s.tombstoneTTL / 2
+		s.mu.Unlock()
+		if interval < time.Second {
+			interval = time.Second
+		}
+		select {
+		case <-s.done:
+			return
+		case <-time.After(interval):
+		}
+		if n := s.gcTombstones(time.Now()); n > 0 {
+			logx.Infof("gc %d topic tombstones", n)
+		}
+	}
+}
+
+// GetLocalTopics 返回本节点订阅的topics 的拷贝
+func (s *TopicState) GetLocalTopics() map[string]TopicInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	topics := make(map[string]TopicInfo, len(s.LocalTopics))
+	for k, v := range s.LocalTopics {
+		topics[k] = v
+	}
+	return topics
+}
+
+// GetTopics 获取所有 topics, 返回的是拷贝, 内部的map 会被gossip 消息并发修改
+func (s *TopicState) GetTopics() map[string]*ServiceSet {
+	return s.CloneTopics()
 }
 
 func (s *TopicState) CloneTopics() map[string]*ServiceSet {
@@ -123,26 +457,28 @@ type GossipDelegate struct {
 	state *TopicState
 }
 
-// NodeMeta 返回节点元数据（此处为空实现）
+// NodeMeta 返回节点元数据, 通过SetMeta 设置
 func (d *GossipDelegate) NodeMeta(limit int) []byte {
-	return nil
+	d.state.metaMu.Lock()
+	defer d.state.metaMu.Unlock()
+	if len(d.state.localMetaBytes) > limit {
+		return nil
+	}
+	return d.state.localMetaBytes
 }
 
 // NotifyMsg 处理接收到的 Gossip 消息
 func (d *GossipDelegate) NotifyMsg(b []byte) {
-	var updates []TopicInfo
-	//decoder := gob.NewDecoder(bytes.NewReader(b))
-	decoder := json.NewDecoder(bytes.NewReader(b))
-	if err := decoder.Decode(&updates); err != nil {
-		logx.Errorf("NotifyMsg, Failed to decode len:%d message err:%v", len(b), err)
+	updates, err := d.state.decodeMessage(b)
+	if err != nil {
+		logx.Errorf("NotifyMsg, reject len:%d message err:%v", len(b), err)
 		return
 	}
 
 	// 更新本地的订阅信息
 	logx.Infof("NotifyMsg, updates:%+v", updates)
-	for _, info := range updates {
-		d.state.UpdateGlobalTopic(info)
-	}
+	d.state.metrics.Load().merged("broadcast", len(updates))
+	d.state.merge(updates)
 }
 
 // GetBroadcasts 返回要广播的消息（此处为空实现）.
@@ -151,61 +487,60 @@ func (d *GossipDelegate) GetBroadcasts(overhead, limit int) [][]byte {
 	return d.state.broadcasts.GetBroadcasts(overhead, limit)
 }
 
-// LocalState 返回节点的本地状态, 用于发送给其他节点
+// LocalState 返回节点的本地状态, 用于发送给其他节点, 包括墓碑, 这样对方才知道哪些记录已经删除了。
+// DeltaState 时只发送自己的记录, 大小只跟自己订阅的topic 数有关, 不随集群里topic 总数增长,
+// 其他节点的记录靠广播, 以及和它们直接push/pull 来同步。
 func (d *GossipDelegate) LocalState(join bool) []byte {
-	d.state.mu.Lock()
-	defer d.state.mu.Unlock()
-	var buf bytes.Buffer
-	//encoder := gob.NewEncoder(&buf)
-	encoder := json.NewEncoder(&buf)
-	if err := encoder.Encode(d.state.GlobalTopics); err != nil {
+	var infos []TopicInfo
+	if d.state.deltaState {
+		infos = d.state.ownSnapshot()
+	} else {
+		infos = d.state.snapshot()
+	}
+	buf, err := d.state.codec.Encode(GossipMessage{From: d.state.name, Updates: infos})
+	if err != nil {
 		log.Println("Failed to encode local state:", err)
 		return nil
 	}
 	//join true 表示第一次同步本地的数据给对方, 数据的内容往往是本地的初始状态。
-	logx.Infof("LocalState, join:%v, state:%+v", join, d.state.GlobalTopics)
-	return buf.Bytes()
+	logx.Infof("LocalState, join:%v, codec:%s, entries:%d, size:%d", join, d.state.codec.Name(), len(infos), len(buf))
+	return buf
 }
 
-// MergeRemoteState 合并远程节点的状态
+// MergeRemoteState 合并远程节点的状态, 每条记录按版本合并, 旧的记录(包括旧的ADD)不会覆盖新的墓碑
 func (d *GossipDelegate) MergeRemoteState(buf []byte, join bool) {
-	var remoteTopics map[string]*ServiceSet
-	//decoder := gob.NewDecoder(bytes.NewReader(buf))
-	decoder := json.NewDecoder(bytes.NewReader(buf))
-	if err := decoder.Decode(&remoteTopics); err != nil {
+	msg, err := decodeGossip(d.state.codec, buf)
+	if err != nil {
 		log.Println("Failed to decode remote state:", err)
 		return
 	}
+	remote := msg.Updates
 	//join 为true 表示是新节点加入, 数据的内容是新节点的初始状态, 算是增量数据(内容只是新节点自己的数据)。
 	//join 为false 表示数据内容不是新节点第一次发送的数据，数据内容很可能是集群的全量。
-	logx.Infof("MergeRemoteState, join:%v remoteTopics:%+v", join, remoteTopics)
-	// 更新本地状态
-	for topic, info := range remoteTopics {
-		//logx.Infof("MergeRemoteState, topic:%s, info:%+v", topic, info)
-		for service := range info.Services {
-			topicInfo := TopicInfo{
-				Op:      ADD,
-				Topic:   topic,
-				Service: service,
-			}
-			//logx.Infof("MergeRemoteState, topicInfo:%+v", topicInfo)
-			d.state.UpdateGlobalTopic(topicInfo)
-		}
-	}
+	logx.Infof("MergeRemoteState, join:%v from:%s entries:%d", join, msg.From, len(remote))
+	d.state.metrics.Load().merged("push_pull", len(remote))
+	d.state.merge(remote)
 }
 
-type eventDelegate struct{}
+type eventDelegate struct {
+	state *TopicState
+}
 
 func (ed *eventDelegate) NotifyJoin(node *memberlist.Node) {
 	logx.Info("A gossip node has joined: " + node.String())
+	ed.state.updatePeerMeta(node)
+	ed.state.nodeJoined(node)
 }
 
 func (ed *eventDelegate) NotifyLeave(node *memberlist.Node) {
 	logx.Info("A gossip node has left: " + node.String())
+	ed.state.deletePeerMeta(node.Name)
+	ed.state.nodeLeft(node.Name)
 }
 
 func (ed *eventDelegate) NotifyUpdate(node *memberlist.Node) {
 	logx.Info("A gossip node was updated: " + node.String())
+	ed.state.updatePeerMeta(node)
 }
 
 func ParseAddress(address string) (string, int, error) {
@@ -232,18 +567,48 @@ func ParseAddress(address string) (string, int, error) {
 }
 
 func NewTopicState(ID string, addr string, port int) (*TopicState, error) {
+	return NewTopicStateWithConf(ID, GossipConf{Addr: addr, Port: port})
+}
+
+// NewTopicStateWithConf 根据GossipConf 创建TopicState, 包括密钥, 集群标签, 墓碑和离开的宽限期
+func NewTopicStateWithConf(ID string, conf GossipConf) (*TopicState, error) {
+	keyring, err := newKeyring(conf.SecretKeys)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := NewGossipCodec(conf.Codec, conf.Compress)
+	if err != nil {
+		return nil, err
+	}
 	s := &TopicState{
 		LocalTopics:  make(map[string]TopicInfo),
 		GlobalTopics: make(map[string]*ServiceSet),
+		name:         ID,
+		entries:      make(map[string]map[string]*topicEntry),
+		tombstoneTTL: defaultTombstoneTTL,
+		done:         make(chan struct{}),
+		leaveGrace:   defaultLeaveGrace,
+		purgeTimers:  make(map[string]*time.Timer),
+		dead:         make(map[string]time.Time),
+		keyring:      keyring,
+		codec:        codec,
+		deltaState:   conf.DeltaState,
+		peerMeta:     make(map[string]NodeMetadata),
+	}
+	s.SetTombstoneTTL(time.Duration(conf.TombstoneTTL) * time.Second)
+	if conf.LeaveGrace != 0 {
+		s.SetLeaveGrace(time.Duration(max(conf.LeaveGrace, 0)) * time.Second)
 	}
 
 	// 创建 Gossip 配置
 	config := memberlist.DefaultLANConfig()
 	config.Name = ID
-	config.BindAddr = addr
-	config.BindPort = port
+	config.BindAddr = conf.Addr
+	config.BindPort = conf.Port
 	config.Delegate = &GossipDelegate{state: s}
-	config.Events = &eventDelegate{}
+	config.Events = &eventDelegate{state: s}
+	config.Keyring = keyring
+	config.Label = conf.Label
 
 	m, err := memberlist.Create(config)
 	if err != nil {
@@ -259,6 +624,7 @@ func NewTopicState(ID string, addr string, port int) (*TopicState, error) {
 
 	s.cluster = m
 	s.broadcasts = br
+	go s.gcLoop()
 	return s, nil
 }
 
@@ -295,49 +661,186 @@ func (s *TopicState) UpdateTopic(op int, topics []string, needBroadcast bool) er
 		return errors.New("topics is empty")
 	}
 	topicsInfo := make([]TopicInfo, 0, len(topics))
+	s.mu.Lock()
 	for _, topic := range topics {
+		s.clock++
 		topicInfo := TopicInfo{
 			Op:      op,
 			Topic:   topic,
-			Service: s.cluster.LocalNode().Name,
+			Service: s.name,
+			Version: s.clock,
 		}
-		s.UpdateGlobalTopic(topicInfo)
+		s.applyLocked(topicInfo)
 		topicsInfo = append(topicsInfo, topicInfo)
 	}
+	s.mu.Unlock()
+	s.notifyChanges()
+	for _, topicInfo := range topicsInfo {
+		s.updateLocalTopic(topicInfo)
+	}
 
 	if !needBroadcast {
 		return nil
 	}
+	return s.queueBroadcasts(topicsInfo)
+}
 
-	// 广播更新
-	jsonBytes, err := json.Marshal(topicsInfo)
-	if err != nil {
-		logx.Error("Failed to encode message:", err)
-		return err
+// queueBroadcasts 广播更新, 每个topic 一条消息, 同一个 topic/service 新的消息会让队列里旧的失效
+func (s *TopicState) queueBroadcasts(topicsInfo []TopicInfo) error {
+	for _, topicInfo := range topicsInfo {
+		msg, err := s.encodeMessage([]TopicInfo{topicInfo})
+		if err != nil {
+			logx.Error("Failed to encode message:", err)
+			return err
+		}
+
+		atomic.AddInt64(&broadcastNum, 1)
+		s.metrics.Load().broadcastQueued()
+		//消息可能是binary 的, 只打印解码前的内容和长度
+		logx.Infof("gossip Broadcast %d op:%d topic:%s version:%d, len:%d, len(members):%d",
+			atomic.LoadInt64(&broadcastNum), topicInfo.Op, topicInfo.Topic, topicInfo.Version, len(msg), s.cluster.NumMembers())
+
+		s.broadcasts.QueueBroadcast(&broadcast{
+			msgId:   atomic.LoadInt64(&broadcastNum),
+			msg:     msg,
+			topic:   topicInfo.Topic,
+			service: topicInfo.Service,
+			version: topicInfo.Version,
+		})
 	}
+	return nil
+}
 
-	atomic.AddInt64(&broadcastNum, 1)
-	logx.Infof("gossip Broadcast %d message:%s, members:%v, len(members):%d",
-		atomic.LoadInt64(&broadcastNum),
-		string(jsonBytes),
-		s.cluster.Members(), s.cluster.NumMembers())
+// leader 分步迁移topic 时, 新service 通过TopicState 确认接管(见rebalance.go)。
+// 确认记录和订阅记录一样带版本, 用gossip 同步, topic 是handoffAckTopic: 每次交接(topic + StartAt)一个精确的key,
+// 只保存在entries 里, 不进GlobalTopics/LocalTopics, 不算订阅, 也不回调OnSubscriptionChange
+const handoffAckTopicPrefix = "$handoff_ack/"
 
-	s.broadcasts.QueueBroadcast(&broadcast{
-		msgId:  atomic.LoadInt64(&broadcastNum),
-		msg:    jsonBytes,
-		notify: nil,
-	})
+func handoffAckTopic(topic string, startAt int64) string {
+	return handoffAckTopicPrefix + strconv.FormatInt(startAt, 10) + "/" + topic
+}
+
+func isHandoffAckTopic(topic string) bool {
+	return strings.HasPrefix(topic, handoffAckTopicPrefix)
+}
+
+// AckHandoff 确认(op 是ADD)本节点已经接管了topic 的这次交接, 交接结束后撤销(op 是DEL), 广播给其他节点
+func (s *TopicState) AckHandoff(topic string, startAt int64, op int) error {
+	s.mu.Lock()
+	s.clock++
+	info := TopicInfo{Op: op, Topic: handoffAckTopic(topic, startAt), Service: s.name, Version: s.clock}
+	s.applyLocked(info)
+	s.mu.Unlock()
+	return s.queueBroadcasts([]TopicInfo{info})
+}
+
+// HandoffAcked service 是否确认了topic 的这次交接
+func (s *TopicState) HandoffAcked(topic string, startAt int64, service string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[handoffAckTopic(topic, startAt)][service]
+	return ok && !entry.Deleted
+}
+
+func (s *TopicState) updateLocalTopic(info TopicInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if info.Op == DEL {
+		delete(s.LocalTopics, info.Topic)
+		return
+	}
+	s.LocalTopics[info.Topic] = info
+}
+
+// 下面的方法实现 SubscriptionStore, TopicState 是gossip 的订阅关系存储
+
+func (s *TopicState) Subscribe(topics ...string) error {
+	return s.UpdateTopic(ADD, topics, true)
+}
+
+func (s *TopicState) Unsubscribe(topics ...string) error {
+	return s.UpdateTopic(DEL, topics, true)
+}
+
+// RemoveSubscriber 只删除本地看到的记录, 不广播, 也不改变版本, service 之后的操作仍然生效;
+// service 自己Unsubscribe 时会广播给所有节点
+func (s *TopicState) RemoveSubscriber(topic, service string) error {
+	if service == s.name {
+		return s.Unsubscribe(topic)
+	}
+	s.UpdateGlobalTopic(TopicInfo{Op: DEL, Topic: topic, Service: service})
 	return nil
 }
 
+func (s *TopicState) Subscribers(topic string) []string {
+	s.mu.Lock()
+	sm, ok := s.GlobalTopics[topic]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	sm.RLock()
+	defer sm.RUnlock()
+	return sortedKeys(sm.Services)
+}
+
+func (s *TopicState) Subscriptions() map[string][]string {
+	topics := s.CloneTopics()
+	subs := make(map[string][]string, len(topics))
+	for topic, sm := range topics {
+		subs[topic] = sortedKeys(sm.Services)
+	}
+	return subs
+}
+
+func (s *TopicState) LocalSubscriptions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	topics := make([]string, 0, len(s.LocalTopics))
+	for topic := range s.LocalTopics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Close 离开gossip 集群, 可以重复调用
+func (s *TopicState) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+		close(s.done)
+	}
+	s.mu.Lock()
+	for name, t := range s.purgeTimers {
+		t.Stop()
+		delete(s.purgeTimers, name)
+	}
+	s.mu.Unlock()
+	if err := s.cluster.Leave(time.Second); err != nil {
+		logx.Error(err)
+	}
+	return s.cluster.Shutdown()
+}
+
 type broadcast struct {
 	msgId  int64
 	msg    []byte
 	notify chan<- struct{}
+
+	topic   string
+	service string
+	version uint64
 }
 
+// Invalidates 同一个 topic/service 版本更新的消息让旧的消息失效, 旧的消息不用再发了
 func (b *broadcast) Invalidates(other memberlist.Broadcast) bool {
-	return false
+	o, ok := other.(*broadcast)
+	if !ok || b.topic == "" {
+		return false
+	}
+	return o.topic == b.topic && o.service == b.service && o.version < b.version
 }
 
 func (b *broadcast) Message() []byte {
@@ -0,0 +1,153 @@
+package topicservice
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTopicState(t *testing.T, name string) *TopicState {
+	s, err := NewTopicState(name, "127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestTopicStateTombstone(t *testing.T) {
+	s := newTestTopicState(t, "s-1")
+	d := &GossipDelegate{state: s}
+
+	s.merge([]TopicInfo{{Op: ADD, Topic: "topic1", Service: "s-2", Version: 3}})
+	assert.Equal(t, []string{"s-2"}, s.Subscribers("topic1"))
+	s.merge([]TopicInfo{{Op: DEL, Topic: "topic1", Service: "s-2", Version: 4}})
+	assert.Empty(t, s.Subscribers("topic1"))
+
+	// 其他节点推送过来的旧数据不能复活已经删除的记录
+	old, _ := json.Marshal([]TopicInfo{{Op: ADD, Topic: "topic1", Service: "s-2", Version: 3}})
+	d.MergeRemoteState(old, false)
+	assert.Empty(t, s.Subscribers("topic1"))
+	legacy, _ := json.Marshal(map[string]*ServiceSet{"topic1": {Services: map[string]struct{}{"s-2": {}}}})
+	d.MergeRemoteState(legacy, false)
+	assert.Empty(t, s.Subscribers("topic1"))
+
+	// 墓碑也会推送给其他节点
+	s2 := newTestTopicState(t, "s-3")
+	s2.merge([]TopicInfo{{Op: ADD, Topic: "topic1", Service: "s-2", Version: 3}})
+	(&GossipDelegate{state: s2}).MergeRemoteState(d.LocalState(false), false)
+	assert.Empty(t, s2.Subscribers("topic1"))
+
+	// 新的版本正常生效
+	s.merge([]TopicInfo{{Op: ADD, Topic: "topic1", Service: "s-2", Version: 5}})
+	assert.Equal(t, []string{"s-2"}, s.Subscribers("topic1"))
+
+	s.merge([]TopicInfo{{Op: DEL, Topic: "topic1", Service: "s-2", Version: 6}})
+	assert.Equal(t, 0, s.gcTombstones(time.Now()))
+	assert.Equal(t, 1, s.gcTombstones(time.Now().Add(defaultTombstoneTTL+time.Second)))
+	assert.Empty(t, s.snapshot())
+}
+
+func TestTopicStateReassert(t *testing.T) {
+	s := newTestTopicState(t, "s-1")
+	assert.Nil(t, s.UpdateTopic(ADD, []string{"topic1"}, false))
+	assert.Equal(t, []TopicInfo{{Op: ADD, Topic: "topic1", Service: "s-1", Version: 1}}, s.snapshot())
+
+	// 其他节点还记着重启前的自己删除了topic1(版本更大), 用更大的版本重新宣告
+	s.merge([]TopicInfo{{Op: DEL, Topic: "topic1", Service: "s-1", Version: 5}})
+	assert.Equal(t, []string{"s-1"}, s.Subscribers("topic1"))
+	assert.Equal(t, []TopicInfo{{Op: ADD, Topic: "topic1", Service: "s-1", Version: 6}}, s.snapshot())
+
+	// 重启前订阅过的topic2 现在没有了
+	s.merge([]TopicInfo{{Op: ADD, Topic: "topic2", Service: "s-1", Version: 7}})
+	assert.Empty(t, s.Subscribers("topic2"))
+	assert.Equal(t, []string{"topic1"}, s.LocalSubscriptions())
+}
+
+func TestBroadcastInvalidates(t *testing.T) {
+	q := &memberlist.TransmitLimitedQueue{NumNodes: func() int { return 3 }, RetransmitMult: 3}
+	q.QueueBroadcast(&broadcast{msg: []byte("1"), topic: "topic1", service: "s-1", version: 1})
+	q.QueueBroadcast(&broadcast{msg: []byte("2"), topic: "topic2", service: "s-1", version: 2})
+	assert.Equal(t, 2, q.NumQueued())
+	q.QueueBroadcast(&broadcast{msg: []byte("3"), topic: "topic1", service: "s-1", version: 3})
+	assert.Equal(t, 2, q.NumQueued())
+	q.QueueBroadcast(&broadcast{msg: []byte("4"), topic: "topic1", service: "s-2", version: 1})
+	assert.Equal(t, 3, q.NumQueued())
+}
+
+func TestTopicStatePurgeOnLeave(t *testing.T) {
+	s1 := newTestTopicState(t, "s-1")
+	s1.SetLeaveGrace(100 * time.Millisecond)
+	var mu sync.Mutex
+	var changes []TopicInfo
+	s1.OnSubscriptionChange(func(change TopicInfo) {
+		mu.Lock()
+		changes = append(changes, change)
+		mu.Unlock()
+	})
+
+	s2 := newTestTopicState(t, "s-2")
+	assert.Nil(t, s2.UpdateTopic(ADD, []string{"topic1", "topic2"}, false))
+	// 加入时push/pull 同步订阅
+	assert.Nil(t, s2.Join([]string{s1.cluster.LocalNode().Address()}))
+	assert.Eventually(t, func() bool {
+		return len(s1.Subscribers("topic1")) == 1 && len(s1.Subscribers("topic2")) == 1
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// s-2 离开, 宽限期后清理
+	assert.Nil(t, s2.Close())
+	assert.Eventually(t, func() bool {
+		return len(s1.Subscriptions()) == 0
+	}, 3*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []TopicInfo{
+		{Op: ADD, Topic: "topic1", Service: "s-2"},
+		{Op: ADD, Topic: "topic2", Service: "s-2"},
+		{Op: DEL, Topic: "topic1", Service: "s-2"},
+		{Op: DEL, Topic: "topic2", Service: "s-2"},
+	}, sortChanges(changes))
+	mu.Unlock()
+
+	// 其他节点推送过来的s-2 的旧记录忽略
+	s1.merge([]TopicInfo{{Op: ADD, Topic: "topic1", Service: "s-2", Version: 1}})
+	assert.Empty(t, s1.Subscribers("topic1"))
+}
+
+func TestTopicStateLeaveGrace(t *testing.T) {
+	s := newTestTopicState(t, "s-1")
+	s.SetLeaveGrace(time.Hour)
+	s.merge([]TopicInfo{{Op: ADD, Topic: "topic1", Service: "s-2", Version: 1}})
+
+	// 宽限期内重新加入, 不清理
+	s.nodeLeft("s-2")
+	s.nodeJoined(&memberlist.Node{Name: "s-2"})
+	s.mu.Lock()
+	assert.Empty(t, s.purgeTimers)
+	s.mu.Unlock()
+	assert.Equal(t, []string{"s-2"}, s.Subscribers("topic1"))
+
+	// 清理后重新加入, 它推送过来的记录重新生效
+	s.purgeService("s-2")
+	assert.Empty(t, s.Subscribers("topic1"))
+	s.mu.Lock()
+	delete(s.dead, "s-2") // nodeJoined 会去连接它, 这里只模拟状态
+	s.mu.Unlock()
+	s.merge([]TopicInfo{{Op: ADD, Topic: "topic1", Service: "s-2", Version: 1}})
+	assert.Equal(t, []string{"s-2"}, s.Subscribers("topic1"))
+}
+
+func sortChanges(changes []TopicInfo) []TopicInfo {
+	sorted := append([]TopicInfo(nil), changes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Op != sorted[j].Op {
+			return sorted[i].Op < sorted[j].Op
+		}
+		return sorted[i].Topic < sorted[j].Topic
+	})
+	return sorted
+}